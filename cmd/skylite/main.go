@@ -0,0 +1,356 @@
+// Command skylite inspects and repairs skylite databases by working on their stores directly.
+//
+//	skylite [-objects dir] <command> <database> [arguments]
+//
+// The database is the path of its store. Commands that change the store need it to be closed by every other process,
+// the store can't be opened for writing while another process holds it.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"s3qlite/internal/objectstore"
+	"s3qlite/internal/vfs"
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(v *vfs.VFS, name string, args []string) error
+	flags *flag.FlagSet // flags of the command, given before the database
+}
+
+var commands = map[string]command{
+	"info":      {"<database>", "summarize the database and its store", info, nil},
+	"pages":     {"<database>", "list the stored pages", pages, nil},
+	"dump-page": {"[-raw] [-revision n] <database> <page>", "print a page, numbered from 1 like SQLite does", dumpPage, dumpPageFlags},
+	"verify":    {"<database>", "check that every page can be read back intact", verify, nil},
+	"export":    {"<database> <file>", "write the database to a plain SQLite file", export, nil},
+	"import":    {"<database> <file>", "create the database from a plain SQLite file", importFile, nil},
+	"compact":   {"<database>", "move page contents into a segment in the object store", compact, nil},
+	"gc":        {"<database>", "delete page contents no page or page version refers to", gc, nil},
+	"changelog": {"[-from n] <database>", "list the commits from revision n on and the pages they wrote", changelog, changelogFlags},
+	"prune":     {"[-commits n] [-age d] <database>", "drop the history older than the last n commits or age d", prune, pruneFlags},
+}
+
+// lockTimeout bounds the wait for a store another process has open
+const lockTimeout = 5 * time.Second
+
+// errProblems is returned by commands that ran but found problems, they have already been reported
+var errProblems = errors.New("problems found")
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: skylite [flags] <command> <database> [arguments]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s %s\t%s\n", name, commands[name].usage, commands[name].help)
+	}
+	_ = w.Flush()
+	fmt.Fprintf(out, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	objects := flag.String("objects", "", "directory of the object store holding compacted segments")
+	verbose := flag.Bool("v", false, "log what the VFS does")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "skylite: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	err := run(cmd, flag.Args()[1:], *objects, *verbose)
+	if errors.Is(err, errProblems) {
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "skylite %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func run(cmd command, args []string, objects string, verbose bool) error {
+	if cmd.flags != nil {
+		if err := cmd.flags.Parse(args); err != nil {
+			return err
+		}
+		args = cmd.flags.Args()
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: skylite %s", cmd.usage)
+	}
+	database := args[0]
+	args = args[1:]
+	path, err := filepath.Abs(database)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "skylite")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	level := zerolog.WarnLevel
+	if verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).Level(level).With().Timestamp().Logger()
+	boltOptions := vfs.DefaultBoltOptions()
+	boltOptions.Timeout = lockTimeout
+	v, err := vfs.NewVFS(vfs.Options{
+		DataDir:     filepath.Dir(path),
+		TmpDir:      tmpDir,
+		BoltOptions: boltOptions,
+		Logger:      &logger,
+	})
+	if err != nil {
+		return err
+	}
+	if objects != "" {
+		store, err := objectstore.NewLocalStore(objects)
+		if err != nil {
+			return err
+		}
+		v.UseObjectStore(store)
+	}
+	return cmd.run(v, filepath.Base(path), args)
+}
+
+func info(v *vfs.VFS, name string, args []string) error {
+	info, err := v.Info(name)
+	if err != nil {
+		return err
+	}
+	journalMode := "rollback"
+	if info.WAL {
+		journalMode = "wal"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "page size:\t%d\n", info.PageSize)
+	fmt.Fprintf(w, "revision:\t%d\n", info.Revision)
+	fmt.Fprintf(w, "journal mode:\t%s\n", journalMode)
+	fmt.Fprintf(w, "codec:\t%s\n", info.Codec)
+	fmt.Fprintf(w, "file size:\t%d\n", info.FileSize)
+	fmt.Fprintf(w, "pages:\t%d (%d deltas)\n", info.Pages, info.Deltas)
+	fmt.Fprintf(w, "local contents:\t%d (%d bytes)\n", info.Contents, info.ContentBytes)
+	fmt.Fprintf(w, "segments:\t%d\n", len(info.Segments))
+	for _, segment := range info.Segments {
+		fmt.Fprintf(w, "\t%s\n", segment)
+	}
+	return w.Flush()
+}
+
+func pages(v *vfs.VFS, name string, args []string) error {
+	info, err := v.Info(name)
+	if err != nil {
+		return err
+	}
+	pages, err := v.Pages(name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "PAGE\tOFFSET\tREVISION\tSIZE\tCODEC\tHASH\tBASE\n")
+	for _, page := range pages {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\t%s\t%s\n", page.Offset/int64(info.PageSize)+1, page.Offset, page.Revision,
+			page.Size, page.Codec, shortHash(page.Hash), shortHash(page.Base))
+	}
+	return w.Flush()
+}
+
+func shortHash(hash []byte) string {
+	if hash == nil {
+		return "-"
+	}
+	return hex.EncodeToString(hash[:8])
+}
+
+var (
+	dumpPageFlags = flag.NewFlagSet("dump-page", flag.ContinueOnError)
+	raw           = dumpPageFlags.Bool("raw", false, "write the page as is instead of a hex dump")
+	revision      = dumpPageFlags.Int64("revision", -1, "print the page as it was at this revision")
+)
+
+func dumpPage(v *vfs.VFS, name string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: skylite dump-page [-raw] [-revision n] <database> <page>")
+	}
+	number, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || number < 1 {
+		return fmt.Errorf("invalid page number %q", args[0])
+	}
+	info, err := v.Info(name)
+	if err != nil {
+		return err
+	}
+	off := (number - 1) * int64(info.PageSize)
+	var page []byte
+	if *revision >= 0 {
+		page, err = v.ReadPageAt(name, off, *revision)
+	} else {
+		page, err = v.ReadPage(name, off)
+	}
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if *raw {
+		_, err = out.Write(page)
+		return err
+	}
+	_, err = io.WriteString(out, hex.Dump(page))
+	return err
+}
+
+func verify(v *vfs.VFS, name string, args []string) error {
+	problems, err := v.Verify(name)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return errProblems
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func export(v *vfs.VFS, name string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: skylite export <database> <file>")
+	}
+	path := args[0]
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	// Write next to the destination so a failed export never leaves a partial file behind
+	out, err := os.CreateTemp(filepath.Dir(path), ".skylite-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	n, err := v.Export(name, out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), path); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d bytes to %s\n", n, path)
+	return nil
+}
+
+func importFile(v *vfs.VFS, name string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: skylite import <database> <file>")
+	}
+	pages, err := v.ImportFile(name, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d pages from %s\n", pages, args[0])
+	return nil
+}
+
+func compact(v *vfs.VFS, name string, args []string) error {
+	if _, err := v.Info(name); err != nil {
+		return err
+	}
+	moved, err := v.Compact(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("moved %d contents to the object store\n", moved)
+	return nil
+}
+
+func gc(v *vfs.VFS, name string, args []string) error {
+	deleted, freed, err := v.GC(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted %d contents (%d bytes)\n", deleted, freed)
+	return nil
+}
+
+var (
+	pruneFlags = flag.NewFlagSet("prune", flag.ContinueOnError)
+	commits    = pruneFlags.Int("commits", 0, "keep the states after the last n commits")
+	age        = pruneFlags.Duration("age", 0, "keep the states within this age")
+)
+
+func prune(v *vfs.VFS, name string, args []string) error {
+	if *commits <= 0 && *age <= 0 {
+		return errors.New("prune needs -commits or -age")
+	}
+	pruned, err := v.PruneHistory(name, vfs.HistoryRetention{Commits: *commits, Age: *age})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted %d page versions\n", pruned)
+	return nil
+}
+
+var (
+	changelogFlags = flag.NewFlagSet("changelog", flag.ContinueOnError)
+	from           = changelogFlags.Int64("from", 0, "list commits from this revision on")
+)
+
+func changelog(v *vfs.VFS, name string, args []string) error {
+	info, err := v.Info(name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "REVISION\tTIME\tCLIENT\tPAGES\n")
+	err = v.Changelog(name, *from, func(entry vfs.ChangelogEntry) error {
+		pages := make([]string, len(entry.Offsets))
+		for i, off := range entry.Offsets {
+			pages[i] = strconv.FormatInt(off/int64(info.PageSize)+1, 10)
+		}
+		client := entry.ClientID
+		if client == "" {
+			client = "-"
+		}
+		_, err := fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", entry.Revision, entry.Time.UTC().Format(time.RFC3339Nano), client,
+			strings.Join(pages, ","))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -1,10 +1,13 @@
+//go:build SQLITE3VFS_LOADABLE_EXT
+// +build SQLITE3VFS_LOADABLE_EXT
+
 #include "sqlite3ext.h"
-#include <stdio.h>
+#include <stdlib.h>
 
 /* sqlite3vfs already called SQLITE_EXTENSION_INIT1 */
 extern const sqlite3_api_routines *sqlite3_api;
 
-extern void S3qliteRegister();
+extern char* skyliteRegister();
 
 // This routine is called when the extension is loaded.
 // Register the new VFS.
@@ -13,8 +16,14 @@ int sqlite3_skylite_init(sqlite3 *db, char **pzErrMsg, const sqlite3_api_routine
   SQLITE_EXTENSION_INIT2(pApi);
 
   // call into Go
-  S3qliteRegister();
+  char* err = skyliteRegister();
+  if( err!=NULL ){
+    *pzErrMsg = sqlite3_mprintf("%s", err);
+    free(err);
+    rc = SQLITE_ERROR;
+  }
 
+  // The Go runtime can't be unloaded
   if( rc==SQLITE_OK ) rc = SQLITE_OK_LOAD_PERMANENTLY;
   return rc;
-}
\ No newline at end of file
+}
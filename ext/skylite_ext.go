@@ -1,28 +1,95 @@
 //go:build SQLITE3VFS_LOADABLE_EXT
 // +build SQLITE3VFS_LOADABLE_EXT
 
+// The skylite loadable extension registers the VFS with SQLite. Build it with
+//
+//	go build -buildmode=c-shared -tags SQLITE3VFS_LOADABLE_EXT -o skylite.so ./ext
+//
+// and load it with `.load ./skylite` in the sqlite3 shell or sqlite3_load_extension. The VFS is configured through
+// the environment of the loading process:
+//
+//	SKYLITE_VFS_NAME   name the VFS is registered under, defaults to skylite
+//	SKYLITE_DATA_DIR   directory holding the database stores, defaults to the working directory
+//	SKYLITE_TMP_DIR    parent of the directory for journals and temporary files, defaults to the system temp dir
+//	SKYLITE_PAGE_SIZE  page size of new databases
+//	SKYLITE_CACHE_DIR  directory of the disk cache of remote page contents, there is none when unset
+//	SKYLITE_CACHE_SIZE size of the disk cache in bytes
+//	SKYLITE_LOG_LEVEL  zerolog level of the log written to stderr, defaults to info
 package main
 
-// import C is necessary for us to export in the c-archive .a file
+// import C is necessary for us to export in the c-shared library
 
 import "C"
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"s3qlite/internal/sqlite3vfs"
+	"s3qlite/internal/vfs"
 )
 
 func main() {
 }
 
-//export S3qliteRegister
-func S3qliteRegister() {
-	fmt.Printf("Registering s3qlite vfs\n")
-	//vfs := s3qlite.NewVFS()
-	//
-	//err := sqlite3vfs.RegisterVFS("skylite", vfs)
-	//if err != nil {
-	//	fmt.Printf("register vfs err: %s\n", err)
-	//	panic(err)
-	//	//log.Fatalf("register vfs err: %s", err)
-	//}
-	fmt.Printf("Registered s3qlite vfs\n")
+// register runs once per process, every connection loading the extension after the first shares its VFS
+var register = sync.OnceValue(func() error {
+	name := os.Getenv("SKYLITE_VFS_NAME")
+	if name == "" {
+		name = "skylite"
+	}
+	options := vfs.Options{
+		DataDir:      os.Getenv("SKYLITE_DATA_DIR"),
+		TmpDir:       os.Getenv("SKYLITE_TMP_DIR"),
+		DiskCacheDir: os.Getenv("SKYLITE_CACHE_DIR"),
+	}
+	if options.DataDir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		options.DataDir = dir
+	}
+	level := zerolog.InfoLevel
+	if value := os.Getenv("SKYLITE_LOG_LEVEL"); value != "" {
+		var err error
+		if level, err = zerolog.ParseLevel(value); err != nil {
+			return fmt.Errorf("invalid SKYLITE_LOG_LEVEL %q", value)
+		}
+	}
+	logger := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).Level(level)
+	options.Logger = &logger
+	if size := os.Getenv("SKYLITE_PAGE_SIZE"); size != "" {
+		pageSize, err := strconv.Atoi(size)
+		if err != nil {
+			return fmt.Errorf("invalid SKYLITE_PAGE_SIZE %q", size)
+		}
+		options.PageSize = pageSize
+	}
+	if size := os.Getenv("SKYLITE_CACHE_SIZE"); size != "" {
+		cacheSize, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || cacheSize <= 0 {
+			return fmt.Errorf("invalid SKYLITE_CACHE_SIZE %q", size)
+		}
+		options.DiskCacheSize = cacheSize
+	}
+
+	v, err := vfs.NewVFS(options)
+	if err != nil {
+		return err
+	}
+	return sqlite3vfs.RegisterVFS(name, v)
+})
+
+// skyliteRegister is called by sqlite3_skylite_init, it returns an error message for SQLite to free or NULL.
+//
+//export skyliteRegister
+func skyliteRegister() *C.char {
+	if err := register(); err != nil {
+		return C.CString(fmt.Sprintf("skylite: %s", err))
+	}
+	return nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExtension builds the loadable extension and drives it from the sqlite3 shell
+func TestExtension(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building the extension is slow")
+	}
+	shell, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 shell not found")
+	}
+
+	lib := filepath.Join(t.TempDir(), "skylite.so")
+	build := exec.Command("go", "build", "-buildmode=c-shared", "-tags", "SQLITE3VFS_LOADABLE_EXT", "-o", lib, ".")
+	output, err := build.CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	dataDir := t.TempDir()
+	run := func(sql string) string {
+		cmd := exec.Command(shell, "-batch", "-bail")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(".load %s\n.open file:crud.db?vfs=crud\n%s\n", lib, sql))
+		cmd.Env = append(os.Environ(), "SKYLITE_VFS_NAME=crud", "SKYLITE_DATA_DIR="+dataDir, "SKYLITE_LOG_LEVEL=warn")
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		require.NoError(t, err, stderr.String())
+		return string(out)
+	}
+
+	out := run(`
+		CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);
+		INSERT INTO items (name) VALUES ('a'), ('b'), ('c');
+		UPDATE items SET name = 'bb' WHERE id = 2;
+		DELETE FROM items WHERE id = 1;
+		SELECT * FROM items;`)
+	assert.Equal(t, "2|bb\n3|c\n", out)
+	assert.FileExists(t, filepath.Join(dataDir, "crud.db"))
+
+	out = run(`
+		INSERT INTO items (name) VALUES ('d');
+		SELECT count(*), group_concat(name) FROM items;
+		PRAGMA integrity_check;`)
+	assert.Equal(t, "3|bb,c,d\nok\n", out, "The database should persist between processes")
+}
@@ -0,0 +1,99 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The coordinator owns the transactional keyspace described in LAYOUT.txt. Every database is assigned a fixed length
+// prefix (n/[databasename] -> [prefix]) and below it
+//
+//	[prefix]/t          -> last write counter, its modification revision is the revision of the database and its
+//	                       value the revision that commit read at
+//	[prefix]/p/[offset] -> page pointer
+//	[prefix]/c/[hash]   -> page content referenced by pointers
+//	[prefix]/x/[id]     -> changelog entry of a commit, with a time based id, holding its time and client id. The
+//	                       keys expire shortly after the commit, the entries are read from the watch history.
+//	[prefix]/s          -> exists while a commit too large for one transaction is staged, its pointers written in
+//	                       several before the one writing the counter
+//	[prefix]/k          -> lock held by the client applying the staged commit, leased so the commit of a client
+//	                       that failed is rolled back
+//
+// Revisions are assigned by the coordinator and only ever increase. A pointer read at revision r returns the value
+// written by the newest commit with a revision <= r. The pointers of a staged commit are written at revisions after
+// the previous commit's, up to its own.
+
+// ErrConflict is returned by Commit when a page in the read set changed after the read revision.
+var ErrConflict = errors.New("commit conflict")
+
+// ErrCompacted is returned when a revision is older than the history the coordinator retains.
+var ErrCompacted = errors.New("revision has been compacted")
+
+// Pointer is the value of a page pointer key.
+type Pointer struct {
+	Offset   int64
+	Revision int64  // revision the pointer was written at, after the previous commit and at most its own. Ignored by Commit
+	Value    []byte // empty for a tombstone, marking a page that was deleted
+}
+
+// CommitRequest describes an optimistic transaction.
+type CommitRequest struct {
+	// ReadRevision is the revision the transaction read the database at.
+	ReadRevision int64
+	// Reads are the offsets the transaction read. The commit fails with ErrConflict if any of them was written
+	// by a commit newer than ReadRevision.
+	Reads []int64
+	// Writes are the pointers to store.
+	Writes []Pointer
+	// Time is when the commit was made, defaults to the time Commit is called.
+	Time time.Time
+	// ClientID optionally identifies the client making the commit.
+	ClientID string
+}
+
+// Event is delivered by Watch for every commit.
+type Event struct {
+	Revision int64
+	Pointers []Pointer // revisions are set to the Event revision
+	Time     time.Time // Time of the CommitRequest, zero when the coordinator didn't record it
+	ClientID string    // ClientID of the CommitRequest
+}
+
+// Coordinator arbitrates commits between every process sharing a database.
+type Coordinator interface {
+	// Revision returns the revision of the last commit to the database or 0 if it has never been written.
+	Revision(ctx context.Context, db string) (int64, error)
+
+	// Pointers returns the pointers for the given offsets as of rev, omitting offsets that have never been written.
+	// A rev of 0 reads the latest revision.
+	Pointers(ctx context.Context, db string, rev int64, offsets ...int64) ([]Pointer, error)
+
+	// Range returns every pointer with start <= offset < end as of rev in offset order. An end of 0 means no limit
+	// and a rev of 0 reads the latest revision.
+	Range(ctx context.Context, db string, rev int64, start int64, end int64) ([]Pointer, error)
+
+	// Commit atomically validates the read set of req and applies its writes, returning the new revision.
+	Commit(ctx context.Context, db string, req CommitRequest) (int64, error)
+
+	// Watch delivers every commit with a revision >= fromRev in revision order. The channel is closed when ctx is
+	// cancelled or the watch fails, after which callers should resynchronize with Range.
+	Watch(ctx context.Context, db string, fromRev int64) (<-chan Event, error)
+
+	// PutContent stores page content under its hash. Content is immutable, storing a hash again is a no-op.
+	PutContent(ctx context.Context, db string, hash []byte, data []byte) error
+
+	// GetContent returns the content stored under hash or nil if there is none.
+	GetContent(ctx context.Context, db string, hash []byte) ([]byte, error)
+
+	Close() error
+}
+
+func offsetKey(off int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(off))
+}
+
+func keyOffset(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
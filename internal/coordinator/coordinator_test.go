@@ -0,0 +1,308 @@
+package coordinator
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// testCoordinator is the conformance suite every Coordinator implementation must pass
+func testCoordinator(t *testing.T, c Coordinator, db string) {
+	ctx := context.Background()
+
+	t.Run("EmptyDatabase", func(t *testing.T) {
+		rev, err := c.Revision(ctx, db+"-empty")
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), rev)
+
+		pointers, err := c.Range(ctx, db+"-empty", 0, 0, 0)
+		require.NoError(t, err)
+		assert.Empty(t, pointers)
+	})
+
+	var rev1, rev2 int64
+	t.Run("Commit", func(t *testing.T) {
+		var err error
+		rev1, err = c.Commit(ctx, db, CommitRequest{
+			Writes: []Pointer{{Offset: 0, Value: []byte("a0")}, {Offset: 4096, Value: []byte("a1")}},
+		})
+		require.NoError(t, err)
+		rev, err := c.Revision(ctx, db)
+		require.NoError(t, err)
+		assert.Equal(t, rev1, rev)
+
+		rev2, err = c.Commit(ctx, db, CommitRequest{
+			ReadRevision: rev1,
+			Reads:        []int64{0, 4096},
+			Writes:       []Pointer{{Offset: 4096, Value: []byte("b1")}, {Offset: 8192, Value: []byte("b2")}},
+		})
+		require.NoError(t, err)
+		assert.Greater(t, rev2, rev1)
+	})
+
+	t.Run("ReadAtRevision", func(t *testing.T) {
+		pointers, err := c.Pointers(ctx, db, rev1, 0, 4096, 8192)
+		require.NoError(t, err)
+		assert.Equal(t, []Pointer{
+			{Offset: 0, Revision: rev1, Value: []byte("a0")},
+			{Offset: 4096, Revision: rev1, Value: []byte("a1")},
+		}, pointers)
+
+		pointers, err = c.Pointers(ctx, db, 0, 4096, 8192)
+		require.NoError(t, err)
+		assert.Equal(t, []Pointer{
+			{Offset: 4096, Revision: rev2, Value: []byte("b1")},
+			{Offset: 8192, Revision: rev2, Value: []byte("b2")},
+		}, pointers)
+
+		pointers, err = c.Range(ctx, db, rev2, 4096, 0)
+		require.NoError(t, err)
+		assert.Len(t, pointers, 2)
+		assert.Equal(t, int64(4096), pointers[0].Offset)
+		assert.Equal(t, int64(8192), pointers[1].Offset)
+
+		pointers, err = c.Range(ctx, db, rev2, 0, 8192)
+		require.NoError(t, err)
+		assert.Len(t, pointers, 2)
+		assert.Equal(t, []byte("a0"), pointers[0].Value)
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		_, err := c.Commit(ctx, db, CommitRequest{
+			ReadRevision: rev1,
+			Reads:        []int64{4096},
+			Writes:       []Pointer{{Offset: 4096, Value: []byte("stale")}},
+		})
+		assert.Equal(t, ErrConflict, err)
+
+		// Pages that were not modified since the read revision don't conflict
+		rev3, err := c.Commit(ctx, db, CommitRequest{
+			ReadRevision: rev1,
+			Reads:        []int64{0},
+			Writes:       []Pointer{{Offset: 0, Value: []byte("c0")}},
+		})
+		require.NoError(t, err)
+		assert.Greater(t, rev3, rev2)
+
+		pointers, err := c.Pointers(ctx, db, 0, 4096)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("b1"), pointers[0].Value)
+	})
+
+	t.Run("Content", func(t *testing.T) {
+		hash := []byte{0xde, 0xad, 0xbe, 0xef}
+		data, err := c.GetContent(ctx, db, hash)
+		require.NoError(t, err)
+		assert.Nil(t, data)
+
+		require.NoError(t, c.PutContent(ctx, db, hash, []byte("page")))
+		require.NoError(t, c.PutContent(ctx, db, hash, []byte("ignored")), "Content is immutable")
+		data, err = c.GetContent(ctx, db, hash)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("page"), data)
+
+		// Content writes are not commits
+		rev, err := c.Revision(ctx, db)
+		require.NoError(t, err)
+		pointers, err := c.Range(ctx, db, rev, 0, 0)
+		require.NoError(t, err)
+		assert.Len(t, pointers, 3)
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		events, err := c.Watch(ctx, db, rev2)
+		require.NoError(t, err)
+
+		event := <-events
+		assert.Equal(t, rev2, event.Revision)
+		assert.False(t, event.Time.IsZero(), "Commits without a time should be recorded at the time they're made")
+		assert.Empty(t, event.ClientID)
+		assert.ElementsMatch(t, []Pointer{
+			{Offset: 4096, Revision: rev2, Value: []byte("b1")},
+			{Offset: 8192, Revision: rev2, Value: []byte("b2")},
+		}, event.Pointers)
+
+		event = <-events
+		assert.Greater(t, event.Revision, rev2)
+
+		at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		rev4, err := c.Commit(ctx, db, CommitRequest{
+			Writes:   []Pointer{{Offset: 12288, Value: []byte("d3")}},
+			Time:     at,
+			ClientID: "worker-1",
+		})
+		require.NoError(t, err)
+		event = <-events
+		assert.Equal(t, rev4, event.Revision)
+		assert.Equal(t, []Pointer{{Offset: 12288, Revision: rev4, Value: []byte("d3")}}, event.Pointers)
+		assert.True(t, at.Equal(event.Time), "got %s", event.Time)
+		assert.Equal(t, "worker-1", event.ClientID)
+
+		cancel()
+		for range events {
+		}
+	})
+
+	t.Run("Tombstone", func(t *testing.T) {
+		rev, err := c.Commit(ctx, db, CommitRequest{Writes: []Pointer{{Offset: 12288}}})
+		require.NoError(t, err)
+		pointers, err := c.Pointers(ctx, db, rev, 12288)
+		require.NoError(t, err)
+		require.Len(t, pointers, 1)
+		assert.Empty(t, pointers[0].Value)
+
+		_, err = c.Commit(ctx, db, CommitRequest{ReadRevision: rev - 1, Reads: []int64{12288}})
+		assert.ErrorIs(t, err, ErrConflict, "Deleting a page conflicts with readers of it")
+	})
+
+	t.Run("LargeCommit", func(t *testing.T) {
+		large := db + "-large"
+		pages := func(count int, value string) []Pointer {
+			pointers := make([]Pointer, count)
+			for i := range pointers {
+				pointers[i] = Pointer{Offset: int64(i) * 4096, Value: []byte(value)}
+			}
+			return pointers
+		}
+		rev1, err := c.Commit(ctx, large, CommitRequest{Writes: pages(100, "a")})
+		require.NoError(t, err)
+
+		reads := make([]int64, 1000)
+		for i := range reads {
+			reads[i] = int64(i) * 4096
+		}
+		rev2, err := c.Commit(ctx, large, CommitRequest{ReadRevision: rev1, Reads: reads, Writes: pages(1, "b")})
+		require.NoError(t, err)
+		_, err = c.Commit(ctx, large, CommitRequest{ReadRevision: rev1, Reads: reads, Writes: pages(1, "c")})
+		assert.ErrorIs(t, err, ErrConflict, "Large read sets should be validated")
+
+		_, err = c.Commit(ctx, large, CommitRequest{ReadRevision: rev1, Reads: reads, Writes: pages(1000, "c")})
+		assert.ErrorIs(t, err, ErrConflict)
+		pointers, err := c.Range(ctx, large, 0, 0, 0)
+		require.NoError(t, err)
+		assert.Len(t, pointers, 100, "Conflicting commits shouldn't be applied partially")
+
+		rev3, err := c.Commit(ctx, large, CommitRequest{ReadRevision: rev2, Reads: reads, Writes: pages(1000, "d")})
+		require.NoError(t, err)
+		pointers, err = c.Range(ctx, large, 0, 0, 0)
+		require.NoError(t, err)
+		require.Len(t, pointers, 1000)
+		for _, p := range pointers {
+			assert.Equal(t, []byte("d"), p.Value)
+			assert.Greater(t, p.Revision, rev2)
+			assert.LessOrEqual(t, p.Revision, rev3)
+		}
+		pointers, err = c.Range(ctx, large, rev2, 0, 0)
+		require.NoError(t, err)
+		assert.Len(t, pointers, 100)
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		events, err := c.Watch(ctx, large, rev2+1)
+		require.NoError(t, err)
+		event := <-events
+		assert.Equal(t, rev3, event.Revision)
+		require.Len(t, event.Pointers, 1000, "Watch should deliver every write of a large commit")
+		assert.Equal(t, rev3, event.Pointers[0].Revision)
+		cancel()
+		for range events {
+		}
+	})
+}
+
+func TestEmbedded(t *testing.T) {
+	c := NewEmbedded()
+	defer c.Close()
+	testCoordinator(t, c, "test.db")
+}
+
+// TestEtcd runs the conformance suite against the cluster in SKYLITE_ETCD_ENDPOINTS (comma separated)
+func TestEtcd(t *testing.T) {
+	endpoints := os.Getenv("SKYLITE_ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("SKYLITE_ETCD_ENDPOINTS not set")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	c := NewEtcd(client, "skylite-test/"+time.Now().Format("20060102150405.000000")+"/")
+	defer c.Close()
+	testCoordinator(t, c, "test.db")
+
+	t.Run("ChangelogExpiry", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		rev, err := c.Commit(ctx, "expiry.db", CommitRequest{
+			Writes:   []Pointer{{Offset: 4096, Value: []byte("a")}},
+			ClientID: "worker-2",
+		})
+		require.NoError(t, err)
+		prefix, err := c.prefix(ctx, "expiry.db")
+		require.NoError(t, err)
+		resp, err := client.Get(ctx, changelogPrefix(prefix), clientv3.WithPrefix())
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.NotZero(t, resp.Kvs[0].Lease, "Changelog keys should expire")
+		_, err = client.Revoke(ctx, clientv3.LeaseID(resp.Kvs[0].Lease))
+		require.NoError(t, err)
+
+		events, err := c.Watch(ctx, "expiry.db", rev)
+		require.NoError(t, err)
+		event := <-events
+		assert.Equal(t, rev, event.Revision)
+		assert.Equal(t, "worker-2", event.ClientID, "Watch should read expired entries from the history")
+		assert.Len(t, event.Pointers, 1)
+
+		_, err = c.Commit(ctx, "expiry.db", CommitRequest{Writes: []Pointer{{Offset: 4096, Value: []byte("b")}}})
+		require.NoError(t, err, "Commits should get a new lease when theirs is gone")
+		cancel()
+		for range events {
+		}
+	})
+
+	t.Run("StagedRollback", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		rev, err := c.Commit(ctx, "staged.db", CommitRequest{Writes: []Pointer{{Offset: 0, Value: []byte("a")}}})
+		require.NoError(t, err)
+		prefix, err := c.prefix(ctx, "staged.db")
+		require.NoError(t, err)
+
+		// A client applying a staged commit holds the lock
+		lease, err := client.Grant(ctx, 60)
+		require.NoError(t, err)
+		_, err = client.Txn(ctx).Then(
+			clientv3.OpPut(pointerKey(prefix, 0), "b"),
+			clientv3.OpPut(pointerKey(prefix, 4096), "b"),
+			clientv3.OpPut(stagedKey(prefix), ""),
+			clientv3.OpPut(lockKey(prefix), "", clientv3.WithLease(lease.ID)),
+		).Commit()
+		require.NoError(t, err)
+		pointers, err := c.Range(ctx, "staged.db", 0, 0, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []Pointer{{Offset: 0, Revision: rev, Value: []byte("a")}}, pointers, "Staged writes shouldn't be read")
+		_, err = c.Commit(ctx, "staged.db", CommitRequest{Writes: []Pointer{{Offset: 8192, Value: []byte("c")}}})
+		assert.ErrorIs(t, err, ErrConflict, "Commits should wait for a staged commit")
+
+		// and fails
+		_, err = client.Revoke(ctx, lease.ID)
+		require.NoError(t, err)
+		rev, err = c.Commit(ctx, "staged.db", CommitRequest{Writes: []Pointer{{Offset: 8192, Value: []byte("c")}}})
+		require.NoError(t, err, "The staged commit of a failed client should be rolled back")
+		pointers, err = c.Range(ctx, "staged.db", rev, 0, 0)
+		require.NoError(t, err)
+		require.Len(t, pointers, 2)
+		assert.Equal(t, []byte("a"), pointers[0].Value)
+		assert.Equal(t, int64(8192), pointers[1].Offset)
+	})
+}
@@ -0,0 +1,215 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Embedded is an in-process Coordinator. It keeps the full history of every database in memory, so it is suited to
+// tests and to several VFS instances sharing databases inside one process.
+type Embedded struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	revision int64 // shared by all databases like an etcd cluster revision
+	dbs      map[string]*embeddedDB
+	closed   bool
+}
+
+type embeddedDB struct {
+	revision int64
+	pointers map[int64][]Pointer // every version of an offset in revision order
+	log      []Event
+	content  map[string][]byte
+}
+
+func NewEmbedded() *Embedded {
+	e := &Embedded{
+		dbs: make(map[string]*embeddedDB),
+	}
+	e.cond = sync.NewCond(&e.mutex)
+	return e
+}
+
+var errClosed = errors.New("coordinator closed")
+
+// db must be called with the mutex held
+func (e *Embedded) db(name string) *embeddedDB {
+	db, ok := e.dbs[name]
+	if !ok {
+		db = &embeddedDB{
+			pointers: make(map[int64][]Pointer),
+			content:  make(map[string][]byte),
+		}
+		e.dbs[name] = db
+	}
+	return db
+}
+
+func (e *Embedded) Revision(ctx context.Context, db string) (int64, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return 0, errClosed
+	}
+	return e.db(db).revision, nil
+}
+
+// at returns the version of an offset visible at rev
+func (d *embeddedDB) at(off int64, rev int64) (Pointer, bool) {
+	versions := d.pointers[off]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].Revision > rev })
+	if i == 0 {
+		return Pointer{}, false
+	}
+	return versions[i-1], true
+}
+
+func (e *Embedded) Pointers(ctx context.Context, db string, rev int64, offsets ...int64) ([]Pointer, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil, errClosed
+	}
+	d := e.db(db)
+	if rev == 0 {
+		rev = e.revision
+	}
+	var result []Pointer
+	for _, off := range offsets {
+		if p, ok := d.at(off, rev); ok {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+func (e *Embedded) Range(ctx context.Context, db string, rev int64, start int64, end int64) ([]Pointer, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil, errClosed
+	}
+	d := e.db(db)
+	if rev == 0 {
+		rev = e.revision
+	}
+	var result []Pointer
+	for off := range d.pointers {
+		if off < start || (end != 0 && off >= end) {
+			continue
+		}
+		if p, ok := d.at(off, rev); ok {
+			result = append(result, p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Offset < result[j].Offset })
+	return result, nil
+}
+
+func (e *Embedded) Commit(ctx context.Context, db string, req CommitRequest) (int64, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return 0, errClosed
+	}
+	d := e.db(db)
+	for _, off := range req.Reads {
+		if p, ok := d.at(off, e.revision); ok && p.Revision > req.ReadRevision {
+			return 0, ErrConflict
+		}
+	}
+
+	e.revision++
+	d.revision = e.revision
+	event := Event{Revision: e.revision, Time: req.Time, ClientID: req.ClientID}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, w := range req.Writes {
+		p := Pointer{
+			Offset:   w.Offset,
+			Revision: e.revision,
+			Value:    append([]byte(nil), w.Value...),
+		}
+		d.pointers[w.Offset] = append(d.pointers[w.Offset], p)
+		event.Pointers = append(event.Pointers, p)
+	}
+	d.log = append(d.log, event)
+	e.cond.Broadcast()
+	return e.revision, nil
+}
+
+func (e *Embedded) Watch(ctx context.Context, db string, fromRev int64) (<-chan Event, error) {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return nil, errClosed
+	}
+	d := e.db(db)
+	next := sort.Search(len(d.log), func(i int) bool { return d.log[i].Revision >= fromRev })
+	e.mutex.Unlock()
+
+	events := make(chan Event)
+	stop := context.AfterFunc(ctx, func() {
+		e.mutex.Lock()
+		e.cond.Broadcast()
+		e.mutex.Unlock()
+	})
+	go func() {
+		defer close(events)
+		defer stop()
+		for {
+			e.mutex.Lock()
+			for next >= len(d.log) && !e.closed && ctx.Err() == nil {
+				e.cond.Wait()
+			}
+			if e.closed || ctx.Err() != nil {
+				e.mutex.Unlock()
+				return
+			}
+			event := d.log[next]
+			e.mutex.Unlock()
+
+			select {
+			case events <- event:
+				next++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (e *Embedded) PutContent(ctx context.Context, db string, hash []byte, data []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return errClosed
+	}
+	d := e.db(db)
+	if _, ok := d.content[string(hash)]; !ok {
+		d.content[string(hash)] = append([]byte(nil), data...)
+	}
+	return nil
+}
+
+func (e *Embedded) GetContent(ctx context.Context, db string, hash []byte) ([]byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil, errClosed
+	}
+	return e.db(db).content[string(hash)], nil
+}
+
+func (e *Embedded) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.closed = true
+	e.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,579 @@
+package coordinator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const prefixLength = 16
+
+// maxTxnOps is etcd's default --max-txn-ops, the most compares and the most operations a transaction may hold
+const maxTxnOps = 128
+
+// changelogTTL is how long a changelog key outlives its commit at most. Watch reads the entries from the events that
+// put them, which the cluster keeps until it compacts their revisions whether or not the keys still exist.
+const changelogTTL = time.Minute
+
+// Etcd is a Coordinator backed by an etcd v3 cluster. Revisions are etcd store revisions, so the history available
+// to Pointers, Range and Watch is bounded by the cluster's compaction policy.
+type Etcd struct {
+	client      *clientv3.Client
+	namespace   string
+	mutex       sync.Mutex // guards prefixes and the changelog lease
+	prefixes    map[string]string
+	lease       clientv3.LeaseID // the changelog keys are attached to, expiring at leaseExpiry
+	leaseExpiry time.Time
+}
+
+// NewEtcd creates a coordinator that keeps its keys below namespace, allowing several deployments to share a cluster.
+func NewEtcd(client *clientv3.Client, namespace string) *Etcd {
+	return &Etcd{
+		client:    client,
+		namespace: namespace,
+		prefixes:  make(map[string]string),
+	}
+}
+
+// prefix resolves n/[db], allocating a new random prefix the first time a database is used
+func (e *Etcd) prefix(ctx context.Context, db string) (string, error) {
+	e.mutex.Lock()
+	prefix, ok := e.prefixes[db]
+	e.mutex.Unlock()
+	if ok {
+		return prefix, nil
+	}
+
+	nameKey := e.namespace + "n/" + db
+	random := make([]byte, prefixLength/2)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	proposed := e.namespace + hex.EncodeToString(random)
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(nameKey), "=", 0)).
+		Then(clientv3.OpPut(nameKey, proposed)).
+		Else(clientv3.OpGet(nameKey)).
+		Commit()
+	if err != nil {
+		return "", err
+	}
+	prefix = proposed
+	if !resp.Succeeded {
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			return "", errors.New("database prefix disappeared")
+		}
+		prefix = string(kvs[0].Value)
+	}
+
+	e.mutex.Lock()
+	e.prefixes[db] = prefix
+	e.mutex.Unlock()
+	return prefix, nil
+}
+
+func counterKey(prefix string) string {
+	return prefix + "/t"
+}
+
+// stagedKey exists while a commit too large for one transaction is applied, its creation revision is where the
+// commit's writes start
+func stagedKey(prefix string) string {
+	return prefix + "/s"
+}
+
+// lockKey is held by the client applying a staged commit, attached to a lease so it's released if the client fails
+func lockKey(prefix string) string {
+	return prefix + "/k"
+}
+
+func pointerPrefix(prefix string) string {
+	return prefix + "/p/"
+}
+
+func contentKey(prefix string, hash []byte) string {
+	return prefix + "/c/" + string(hash)
+}
+
+func pointerKey(prefix string, off int64) string {
+	return pointerPrefix(prefix) + string(offsetKey(off))
+}
+
+func changelogPrefix(prefix string) string {
+	return prefix + "/x/"
+}
+
+// changelogKey returns a key ordered by t, with random bytes so commits made at the same time by different clients
+// don't collide. The commit revision is the modification revision of the key.
+func changelogKey(prefix string, t time.Time) (string, error) {
+	id := binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+	id = append(id, make([]byte, 8)...)
+	if _, err := rand.Read(id[8:]); err != nil {
+		return "", err
+	}
+	return changelogPrefix(prefix) + string(id), nil
+}
+
+// changelog entry layout, big endian: [unix nanoseconds uint64][client id]. The offsets written are those of the
+// pointers put in the same revision, and for a staged commit those put since the staged key was created.
+func encodeChange(req CommitRequest) []byte {
+	buf := binary.BigEndian.AppendUint64(nil, uint64(req.Time.UnixNano()))
+	return append(buf, req.ClientID...)
+}
+
+// decodeChange sets the time and client id of event from a changelog entry
+func decodeChange(buf []byte, event *Event) {
+	if len(buf) < 8 {
+		return
+	}
+	event.Time = time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	event.ClientID = string(buf[8:])
+}
+
+// changelogLease returns the lease to attach a changelog key to. A lease is shared by the commits made in the first
+// half of its TTL, so every key is deleted within changelogTTL and never before the commit is applied.
+func (e *Etcd) changelogLease(ctx context.Context) (clientv3.LeaseID, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	now := time.Now()
+	if e.lease != clientv3.NoLease && now.Add(changelogTTL/2).Before(e.leaseExpiry) {
+		return e.lease, nil
+	}
+	resp, err := e.client.Grant(ctx, int64(changelogTTL/time.Second))
+	if err != nil {
+		return clientv3.NoLease, etcdErr(err)
+	}
+	e.lease, e.leaseExpiry = resp.ID, now.Add(changelogTTL)
+	return e.lease, nil
+}
+
+// forgetLease drops the cached changelog lease when the cluster no longer has it
+func (e *Etcd) forgetLease(lease clientv3.LeaseID) {
+	e.mutex.Lock()
+	if e.lease == lease {
+		e.lease = clientv3.NoLease
+	}
+	e.mutex.Unlock()
+}
+
+func etcdErr(err error) error {
+	if errors.Is(err, rpctypes.ErrCompacted) {
+		return ErrCompacted
+	}
+	return err
+}
+
+func (e *Etcd) Revision(ctx context.Context, db string) (int64, error) {
+	prefix, err := e.prefix(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := e.client.Get(ctx, counterKey(prefix))
+	if err != nil {
+		return 0, etcdErr(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return resp.Kvs[0].ModRevision, nil
+}
+
+// latest returns the revision reads of the latest revision are pinned to, the one before a staged commit began while
+// its writes aren't published
+func (e *Etcd) latest(ctx context.Context, prefix string) (int64, error) {
+	resp, err := e.client.Get(ctx, stagedKey(prefix))
+	if err != nil {
+		return 0, etcdErr(err)
+	}
+	if len(resp.Kvs) != 0 {
+		return resp.Kvs[0].CreateRevision - 1, nil
+	}
+	return resp.Header.Revision, nil
+}
+
+func toPointer(prefix string, kv *mvccpb.KeyValue) Pointer {
+	return Pointer{
+		Offset:   keyOffset(kv.Key[len(pointerPrefix(prefix)):]),
+		Revision: kv.ModRevision,
+		Value:    kv.Value,
+	}
+}
+
+func (e *Etcd) Pointers(ctx context.Context, db string, rev int64, offsets ...int64) ([]Pointer, error) {
+	prefix, err := e.prefix(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if rev == 0 {
+		if rev, err = e.latest(ctx, prefix); err != nil {
+			return nil, err
+		}
+	}
+	return e.pointers(ctx, prefix, rev, offsets)
+}
+
+// pointers reads the pointers at offsets as of rev, in batches pinned to it
+func (e *Etcd) pointers(ctx context.Context, prefix string, rev int64, offsets []int64) ([]Pointer, error) {
+	var result []Pointer
+	const batchSize = maxTxnOps / 2
+	for start := 0; start < len(offsets); start += batchSize {
+		batch := offsets[start:min(start+batchSize, len(offsets))]
+		ops := make([]clientv3.Op, len(batch))
+		for i, off := range batch {
+			ops[i] = clientv3.OpGet(pointerKey(prefix, off), clientv3.WithRev(rev))
+		}
+		resp, err := e.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return nil, etcdErr(err)
+		}
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				result = append(result, toPointer(prefix, kv))
+			}
+		}
+	}
+	return result, nil
+}
+
+func (e *Etcd) Range(ctx context.Context, db string, rev int64, start int64, end int64) ([]Pointer, error) {
+	prefix, err := e.prefix(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if rev == 0 {
+		if rev, err = e.latest(ctx, prefix); err != nil {
+			return nil, err
+		}
+	}
+	endKey := clientv3.GetPrefixRangeEnd(pointerPrefix(prefix))
+	if end != 0 {
+		endKey = pointerKey(prefix, end)
+	}
+	resp, err := e.client.Get(ctx, pointerKey(prefix, start), clientv3.WithRange(endKey), clientv3.WithRev(rev))
+	if err != nil {
+		return nil, etcdErr(err)
+	}
+	result := make([]Pointer, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		result = append(result, toPointer(prefix, kv))
+	}
+	return result, nil
+}
+
+func (e *Etcd) Commit(ctx context.Context, db string, req CommitRequest) (int64, error) {
+	prefix, err := e.prefix(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	var compares []clientv3.Cmp
+	if len(req.Reads) < maxTxnOps {
+		compares = make([]clientv3.Cmp, 0, len(req.Reads)+1)
+		for _, off := range req.Reads {
+			compares = append(compares, clientv3.Compare(clientv3.ModRevision(pointerKey(prefix, off)), "<", req.ReadRevision+1))
+		}
+	} else {
+		// Too many reads to compare each, any commit after the read revision conflicts
+		compares = []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(counterKey(prefix)), "<", req.ReadRevision+1)}
+	}
+	compares = append(compares, clientv3.Compare(clientv3.CreateRevision(stagedKey(prefix)), "=", 0))
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	changeKey, err := changelogKey(prefix, req.Time)
+	if err != nil {
+		return 0, err
+	}
+	publish := func(lease clientv3.LeaseID) []clientv3.Op {
+		return []clientv3.Op{
+			clientv3.OpPut(counterKey(prefix), strconv.FormatInt(req.ReadRevision, 10)),
+			clientv3.OpPut(changeKey, string(encodeChange(req)), clientv3.WithLease(lease)),
+		}
+	}
+
+	// Every write is a put, along with the counter and the changelog entry
+	if len(req.Writes)+2 > maxTxnOps {
+		return e.commitStaged(ctx, prefix, req.Writes, compares, publish)
+	}
+	resp, _, err := e.begin(ctx, prefix, compares, func(lease clientv3.LeaseID) []clientv3.Op {
+		return append(putPointers(prefix, req.Writes), publish(lease)...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+func putPointers(prefix string, writes []Pointer) []clientv3.Op {
+	ops := make([]clientv3.Op, 0, len(writes)+4)
+	for _, w := range writes {
+		ops = append(ops, clientv3.OpPut(pointerKey(prefix, w.Offset), string(w.Value)))
+	}
+	return ops
+}
+
+// begin applies the operations made by ops for the changelog lease if compares hold, failing with ErrConflict
+// otherwise. A staged commit whose client lost the lock is rolled back first.
+func (e *Etcd) begin(ctx context.Context, prefix string, compares []clientv3.Cmp, ops func(clientv3.LeaseID) []clientv3.Op) (*clientv3.TxnResponse, clientv3.LeaseID, error) {
+	leaseRetried, rolledBack := false, false
+	for {
+		lease, err := e.changelogLease(ctx)
+		if err != nil {
+			return nil, clientv3.NoLease, err
+		}
+		resp, err := e.client.Txn(ctx).
+			If(compares...).
+			Then(ops(lease)...).
+			Else(clientv3.OpGet(stagedKey(prefix)), clientv3.OpGet(lockKey(prefix))).
+			Commit()
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) && !leaseRetried {
+			// Revoked or expired early, nothing was applied
+			e.forgetLease(lease)
+			leaseRetried = true
+			continue
+		} else if err != nil {
+			return nil, clientv3.NoLease, etcdErr(err)
+		}
+		if resp.Succeeded {
+			return resp, lease, nil
+		}
+		staged := resp.Responses[0].GetResponseRange().Kvs
+		if rolledBack || len(staged) == 0 || len(resp.Responses[1].GetResponseRange().Kvs) != 0 {
+			// Conflicting, or a staged commit is still being applied
+			return nil, clientv3.NoLease, ErrConflict
+		}
+		if err = e.rollback(ctx, prefix, staged[0].CreateRevision); err != nil {
+			return nil, clientv3.NoLease, err
+		}
+		rolledBack = true
+	}
+}
+
+// commitStaged applies a write set too large for one transaction. The first transaction validates the read set,
+// stages the commit and takes the lock, attached to the changelog lease. Later ones add writes while the lock is held
+// and the last publishes the commit, writing the counter. Until then no other commit can be made and readers, pinned
+// to the counter, don't see the writes.
+func (e *Etcd) commitStaged(ctx context.Context, prefix string, writes []Pointer, compares []clientv3.Cmp, publish func(clientv3.LeaseID) []clientv3.Op) (int64, error) {
+	batch := writes[:maxTxnOps-2]
+	writes = writes[len(batch):]
+	resp, lease, err := e.begin(ctx, prefix, compares, func(lease clientv3.LeaseID) []clientv3.Op {
+		return append(putPointers(prefix, batch),
+			clientv3.OpPut(stagedKey(prefix), ""),
+			clientv3.OpPut(lockKey(prefix), "", clientv3.WithLease(lease)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	staged := resp.Header.Revision
+	held := clientv3.Compare(clientv3.CreateRevision(lockKey(prefix)), "=", staged)
+
+	// The last transaction also writes the counter and changelog entry, and removes the staged key and lock
+	for len(writes)+4 > maxTxnOps {
+		batch = writes[:min(maxTxnOps, len(writes))]
+		writes = writes[len(batch):]
+		resp, err = e.client.Txn(ctx).If(held).Then(putPointers(prefix, batch)...).Commit()
+		if err != nil {
+			return 0, e.abort(ctx, prefix, staged, etcdErr(err))
+		} else if !resp.Succeeded {
+			// The lease expired, the next commit rolls back what was written
+			return 0, ErrConflict
+		}
+	}
+	ops := append(putPointers(prefix, writes), publish(lease)...)
+	ops = append(ops, clientv3.OpDelete(stagedKey(prefix)), clientv3.OpDelete(lockKey(prefix)))
+	resp, err = e.client.Txn(ctx).If(held).Then(ops...).Commit()
+	if err != nil {
+		return 0, e.abort(ctx, prefix, staged, etcdErr(err))
+	} else if !resp.Succeeded {
+		return 0, ErrConflict
+	}
+	return resp.Header.Revision, nil
+}
+
+// abort releases the lock of the commit staged at staged and rolls it back, returning cause. Nothing is done if the
+// lock was already released, by the commit being published or its lease expiring.
+func (e *Etcd) abort(ctx context.Context, prefix string, staged int64, cause error) error {
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(lockKey(prefix)), "=", staged)).
+		Then(clientv3.OpDelete(lockKey(prefix))).
+		Commit()
+	if err == nil && resp.Succeeded {
+		err = e.rollback(ctx, prefix, staged)
+	}
+	if err != nil {
+		return errors.Join(cause, etcdErr(err))
+	}
+	return cause
+}
+
+// rollback restores the pointers written since the commit staged at staged began to their values before it, then
+// removes the staged key. A rollback that fails part way is redone by the next commit.
+func (e *Etcd) rollback(ctx context.Context, prefix string, staged int64) error {
+	resp, err := e.client.Get(ctx, pointerPrefix(prefix), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return etcdErr(err)
+	}
+	var offsets []int64
+	for _, kv := range resp.Kvs {
+		if kv.ModRevision >= staged {
+			offsets = append(offsets, keyOffset(kv.Key[len(pointerPrefix(prefix)):]))
+		}
+	}
+	before, err := e.pointers(ctx, prefix, staged-1, offsets)
+	if err != nil {
+		return err
+	}
+	values := make(map[int64][]byte, len(before))
+	for _, p := range before {
+		values[p.Offset] = p.Value
+	}
+	ops := make([]clientv3.Op, 0, len(offsets)+1)
+	for _, off := range offsets {
+		if value, ok := values[off]; ok {
+			ops = append(ops, clientv3.OpPut(pointerKey(prefix, off), string(value)))
+		} else {
+			ops = append(ops, clientv3.OpDelete(pointerKey(prefix, off)))
+		}
+	}
+	ops = append(ops, clientv3.OpDelete(stagedKey(prefix)))
+
+	compares := []clientv3.Cmp{
+		clientv3.Compare(clientv3.CreateRevision(stagedKey(prefix)), "=", staged),
+		clientv3.Compare(clientv3.CreateRevision(lockKey(prefix)), "=", 0),
+	}
+	for start := 0; start < len(ops); start += maxTxnOps {
+		txn, err := e.client.Txn(ctx).If(compares...).Then(ops[start:min(start+maxTxnOps, len(ops))]...).Commit()
+		if err != nil {
+			return etcdErr(err)
+		} else if !txn.Succeeded {
+			// Rolled back by another client
+			return nil
+		}
+	}
+	return nil
+}
+
+func (e *Etcd) Watch(ctx context.Context, db string, fromRev int64) (<-chan Event, error) {
+	prefix, err := e.prefix(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if fromRev == 0 {
+		fromRev = 1
+	}
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	watch := e.client.Watch(watchCtx, prefix+"/", clientv3.WithPrefix(), clientv3.WithRev(fromRev))
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer cancel()
+		// Pointers written by a staged commit before the revision publishing it, or while rolling one back
+		var staged []Pointer
+		for resp := range watch {
+			if resp.Err() != nil {
+				return
+			}
+			// A response holds whole transactions, group its events by revision. Only revisions that wrote the
+			// counter are commits, content is written in revisions of its own.
+			var pending *Event
+			commit, unstaged := false, false
+			flush := func() bool {
+				if pending != nil && !commit {
+					if unstaged {
+						// Rolled back
+						staged = nil
+					} else {
+						staged = append(staged, pending.Pointers...)
+					}
+				}
+				if pending == nil || !commit {
+					pending = nil
+					return true
+				}
+				if staged != nil {
+					pending.Pointers = append(staged, pending.Pointers...)
+					for i := range pending.Pointers {
+						pending.Pointers[i].Revision = pending.Revision
+					}
+					staged = nil
+				}
+				select {
+				case events <- *pending:
+					pending = nil
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+			for _, ev := range resp.Events {
+				if pending != nil && pending.Revision != ev.Kv.ModRevision {
+					if !flush() {
+						return
+					}
+				}
+				if pending == nil {
+					pending = &Event{Revision: ev.Kv.ModRevision}
+					commit, unstaged = false, false
+				}
+				key := string(ev.Kv.Key)
+				switch {
+				case key == counterKey(prefix):
+					commit = true
+				case key == stagedKey(prefix) && ev.Type == clientv3.EventTypeDelete:
+					unstaged = true
+				case ev.Type == clientv3.EventTypePut && strings.HasPrefix(key, changelogPrefix(prefix)):
+					decodeChange(ev.Kv.Value, pending)
+				case ev.Type == clientv3.EventTypePut && strings.HasPrefix(key, pointerPrefix(prefix)):
+					pending.Pointers = append(pending.Pointers, toPointer(prefix, ev.Kv))
+				}
+			}
+			if !flush() {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (e *Etcd) PutContent(ctx context.Context, db string, hash []byte, data []byte) error {
+	prefix, err := e.prefix(ctx, db)
+	if err != nil {
+		return err
+	}
+	key := contentKey(prefix, hash)
+	_, err = e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	return etcdErr(err)
+}
+
+func (e *Etcd) GetContent(ctx context.Context, db string, hash []byte) ([]byte, error) {
+	prefix, err := e.prefix(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Get(ctx, contentKey(prefix, hash))
+	if err != nil {
+		return nil, etcdErr(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Close closes the underlying client
+func (e *Etcd) Close() error {
+	return e.client.Close()
+}
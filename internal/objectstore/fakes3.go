@@ -0,0 +1,150 @@
+package objectstore
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeS3 is an in-process http.Handler that implements enough of the S3 REST protocol (path-style PUT, GET with
+// Range, DELETE and ListObjectsV2) to exercise S3Store in tests. Signatures are required but not verified.
+type FakeS3 struct {
+	mutex   sync.Mutex
+	buckets map[string]map[string][]byte
+	// MaxKeys limits the size of a list page so pagination gets exercised
+	MaxKeys int
+}
+
+func NewFakeS3(buckets ...string) *FakeS3 {
+	f := &FakeS3{
+		buckets: make(map[string]map[string][]byte),
+		MaxKeys: 1000,
+	}
+	for _, b := range buckets {
+		f.buckets[b] = make(map[string][]byte)
+	}
+	return f
+}
+
+func (f *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "missing signature headers", http.StatusForbidden)
+		return
+	}
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	bucket, ok := f.buckets[bucketName]
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r, bucket)
+	case key == "":
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bucket[key] = data
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet:
+		data, ok := bucket[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		rangeHeader := r.Header.Get("Range")
+		if rangeHeader == "" {
+			_, _ = w.Write(data)
+			return
+		}
+		start, end, err := parseRange(rangeHeader, int64(len(data)))
+		if err != nil {
+			http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[start : end+1])
+	case r.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type fakeListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+}
+
+func (f *FakeS3) list(w http.ResponseWriter, r *http.Request, bucket map[string][]byte) {
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+	var keys []string
+	for k := range bucket {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var result fakeListResult
+	if len(keys) > f.MaxKeys {
+		keys = keys[:f.MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key  string `xml:"Key"`
+			Size int    `xml:"Size"`
+		}{Key: k, Size: len(bucket[k])})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	startStr, endStr, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("unsatisfiable range %q", header)
+	}
+	return start, end, nil
+}
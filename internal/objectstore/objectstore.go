@@ -0,0 +1,27 @@
+package objectstore
+
+import (
+	"errors"
+)
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectStore is a flat namespace of immutable objects, modeled after the subset of the S3 protocol the VFS needs.
+// Keys use '/' as a separator by convention, e.g. [prefix]/l/[level]/[name].
+type ObjectStore interface {
+	// Put stores data under key, replacing any existing object.
+	Put(key string, data []byte) error
+
+	// Get returns the full contents of the object.
+	Get(key string) ([]byte, error)
+
+	// GetRange returns length bytes of the object starting at off.
+	GetRange(key string, off int64, length int64) ([]byte, error)
+
+	// List returns the keys starting with prefix in lexical order.
+	List(prefix string) ([]string, error)
+
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(key string) error
+}
@@ -0,0 +1,90 @@
+package objectstore
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func implementations(t *testing.T) map[string]ObjectStore {
+	local, err := NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	fake := NewFakeS3("test-bucket")
+	fake.MaxKeys = 2
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return map[string]ObjectStore{
+		"local": local,
+		"s3": NewS3Store(S3Config{
+			Endpoint:        server.URL,
+			Bucket:          "test-bucket",
+			AccessKeyID:     "access",
+			SecretAccessKey: "secret",
+		}),
+	}
+}
+
+func TestObjectStore_PutGet(t *testing.T) {
+	for name, store := range implementations(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.Get("db/l/0/missing")
+			assert.Equal(t, ErrNotFound, err)
+
+			require.NoError(t, store.Put("db/l/0/a b+c", []byte("hello, world")))
+			data, err := store.Get("db/l/0/a b+c")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("hello, world"), data)
+
+			data, err = store.GetRange("db/l/0/a b+c", 7, 5)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("world"), data)
+
+			data, err = store.GetRange("db/l/0/a b+c", 7, 100)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("world"), data, "Reads past the end should be short")
+
+			require.NoError(t, store.Delete("db/l/0/a b+c"))
+			require.NoError(t, store.Delete("db/l/0/a b+c"), "Deleting a missing object should succeed")
+			_, err = store.GetRange("db/l/0/a b+c", 0, 1)
+			assert.Equal(t, ErrNotFound, err)
+		})
+	}
+}
+
+func TestObjectStore_List(t *testing.T) {
+	for name, store := range implementations(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"db/l/0/c", "db/l/0/a", "db/l/1/b", "other/l/0/a", "db/l/0/b"} {
+				require.NoError(t, store.Put(key, []byte(key)))
+			}
+			keys, err := store.List("db/l/0/")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"db/l/0/a", "db/l/0/b", "db/l/0/c"}, keys)
+
+			keys, err = store.List("missing/")
+			require.NoError(t, err)
+			assert.Empty(t, keys)
+		})
+	}
+}
+
+func TestLocalStore_RelativeDir(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+
+	store, err := NewLocalStore("./objects/../objects/")
+	require.NoError(t, err)
+	require.NoError(t, store.Put("db/l/0/a", []byte("a")))
+	data, err := store.Get("db/l/0/a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), data)
+	_, err = store.Get("../a")
+	assert.Error(t, err, "Keys outside the directory should be rejected")
+}
@@ -74,8 +74,20 @@ func (rcv *Page) Data(obj *flatbuffers.Table) bool {
 	return false
 }
 
+func (rcv *Page) Codec() Codec {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(10))
+	if o != 0 {
+		return Codec(rcv._tab.GetByte(o + rcv._tab.Pos))
+	}
+	return 0
+}
+
+func (rcv *Page) MutateCodec(n Codec) bool {
+	return rcv._tab.MutateByteSlot(10, byte(n))
+}
+
 func PageStart(builder *flatbuffers.Builder) {
-	builder.StartObject(3)
+	builder.StartObject(4)
 }
 func PageAddRevision(builder *flatbuffers.Builder, revision int64) {
 	builder.PrependInt64Slot(0, revision, 0)
@@ -86,6 +98,9 @@ func PageAddDataType(builder *flatbuffers.Builder, dataType Data) {
 func PageAddData(builder *flatbuffers.Builder, data flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(2, flatbuffers.UOffsetT(data), 0)
 }
+func PageAddCodec(builder *flatbuffers.Builder, codec Codec) {
+	builder.PrependByteSlot(3, byte(codec), 0)
+}
 func PageEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
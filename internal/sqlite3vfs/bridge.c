@@ -0,0 +1,262 @@
+#include "bridge.h"
+#include "_cgo_export.h"
+
+#include <stdlib.h>
+#include <string.h>
+
+#ifdef SQLITE3VFS_LOADABLE_EXT
+SQLITE_EXTENSION_INIT1
+#endif
+
+#define HANDLE(f) (((bridgeFile*)(f))->handle)
+#define VFS_HANDLE(vfs) ((uintptr_t)(vfs)->pAppData)
+
+/* io methods */
+
+static int bridgeClose(sqlite3_file *f) {
+  return goClose(HANDLE(f));
+}
+
+static int bridgeRead(sqlite3_file *f, void *buf, int amt, sqlite3_int64 off) {
+  return goRead(HANDLE(f), buf, amt, off);
+}
+
+static int bridgeWrite(sqlite3_file *f, const void *buf, int amt, sqlite3_int64 off) {
+  return goWrite(HANDLE(f), (void*)buf, amt, off);
+}
+
+static int bridgeTruncate(sqlite3_file *f, sqlite3_int64 size) {
+  return goTruncate(HANDLE(f), size);
+}
+
+static int bridgeSync(sqlite3_file *f, int flags) {
+  return goSync(HANDLE(f), flags);
+}
+
+static int bridgeFileSize(sqlite3_file *f, sqlite3_int64 *pSize) {
+  return goFileSize(HANDLE(f), pSize);
+}
+
+static int bridgeLock(sqlite3_file *f, int lock) {
+  return goLock(HANDLE(f), lock);
+}
+
+static int bridgeUnlock(sqlite3_file *f, int lock) {
+  return goUnlock(HANDLE(f), lock);
+}
+
+static int bridgeCheckReservedLock(sqlite3_file *f, int *pResOut) {
+  return goCheckReservedLock(HANDLE(f), pResOut);
+}
+
+static int bridgeFileControl(sqlite3_file *f, int op, void *arg) {
+  switch( op ){
+    case SQLITE_FCNTL_COMMIT_PHASETWO:
+      return goCommitPhaseTwo(HANDLE(f));
+    case SQLITE_FCNTL_PRAGMA: {
+      /* arg[1] is the pragma name, arg[2] its argument or NULL, arg[0] receives the result */
+      char **args = (char**)arg;
+      char *result = NULL;
+      int rc = goPragma(HANDLE(f), args[1], args[2], &result);
+      if( result!=NULL ){
+        args[0] = sqlite3_mprintf("%s", result);
+        free(result);
+      }
+      return rc;
+    }
+  }
+  return SQLITE_NOTFOUND;
+}
+
+static int bridgeSectorSize(sqlite3_file *f) {
+  return goSectorSize(HANDLE(f));
+}
+
+static int bridgeDeviceCharacteristics(sqlite3_file *f) {
+  return goDeviceCharacteristics(HANDLE(f));
+}
+
+static int bridgeShmMap(sqlite3_file *f, int region, int size, int extend, void volatile **pp) {
+  return goShmMap(HANDLE(f), region, size, extend, (void**)pp);
+}
+
+static int bridgeShmLock(sqlite3_file *f, int offset, int n, int flags) {
+  return goShmLock(HANDLE(f), offset, n, flags);
+}
+
+static void bridgeShmBarrier(sqlite3_file *f) {
+  __sync_synchronize();
+  goShmBarrier(HANDLE(f));
+}
+
+static int bridgeShmUnmap(sqlite3_file *f, int deleteFlag) {
+  return goShmUnmap(HANDLE(f), deleteFlag);
+}
+
+/* Fetched pages are copies, SQLite never writes through them and releases them with xUnfetch */
+static int bridgeFetch(sqlite3_file *f, sqlite3_int64 off, int amt, void **pp) {
+  int found = 0;
+  void *buf = sqlite3_malloc(amt);
+  *pp = NULL;
+  if( buf==NULL ) return SQLITE_NOMEM;
+  int rc = goFetch(HANDLE(f), off, amt, buf, &found);
+  if( rc!=SQLITE_OK || !found ){
+    sqlite3_free(buf);
+    return rc;
+  }
+  *pp = buf;
+  return SQLITE_OK;
+}
+
+static int bridgeUnfetch(sqlite3_file *f, sqlite3_int64 off, void *p) {
+  /* A NULL p asks to unmap everything past off, there are no mappings to drop */
+  if( p!=NULL ) sqlite3_free(p);
+  return SQLITE_OK;
+}
+
+static const sqlite3_io_methods bridgeMethods = {
+  3,                               /* iVersion */
+  bridgeClose,                     /* xClose */
+  bridgeRead,                      /* xRead */
+  bridgeWrite,                     /* xWrite */
+  bridgeTruncate,                  /* xTruncate */
+  bridgeSync,                      /* xSync */
+  bridgeFileSize,                  /* xFileSize */
+  bridgeLock,                      /* xLock */
+  bridgeUnlock,                    /* xUnlock */
+  bridgeCheckReservedLock,         /* xCheckReservedLock */
+  bridgeFileControl,               /* xFileControl */
+  bridgeSectorSize,                /* xSectorSize */
+  bridgeDeviceCharacteristics,     /* xDeviceCharacteristics */
+  NULL,                            /* xShmMap */
+  NULL,                            /* xShmLock */
+  NULL,                            /* xShmBarrier */
+  NULL,                            /* xShmUnmap */
+  bridgeFetch,                     /* xFetch */
+  bridgeUnfetch,                   /* xUnfetch */
+};
+
+/* Files implementing ShmFile get the shared memory methods, SQLite only offers WAL mode to those */
+static const sqlite3_io_methods bridgeShmMethods = {
+  3,                               /* iVersion */
+  bridgeClose,                     /* xClose */
+  bridgeRead,                      /* xRead */
+  bridgeWrite,                     /* xWrite */
+  bridgeTruncate,                  /* xTruncate */
+  bridgeSync,                      /* xSync */
+  bridgeFileSize,                  /* xFileSize */
+  bridgeLock,                      /* xLock */
+  bridgeUnlock,                    /* xUnlock */
+  bridgeCheckReservedLock,         /* xCheckReservedLock */
+  bridgeFileControl,               /* xFileControl */
+  bridgeSectorSize,                /* xSectorSize */
+  bridgeDeviceCharacteristics,     /* xDeviceCharacteristics */
+  bridgeShmMap,                    /* xShmMap */
+  bridgeShmLock,                   /* xShmLock */
+  bridgeShmBarrier,                /* xShmBarrier */
+  bridgeShmUnmap,                  /* xShmUnmap */
+  bridgeFetch,                     /* xFetch */
+  bridgeUnfetch,                   /* xUnfetch */
+};
+
+/* vfs methods */
+
+static int bridgeOpen(sqlite3_vfs *vfs, const char *zName, sqlite3_file *f, int flags, int *pOutFlags) {
+  bridgeFile *file = (bridgeFile*)f;
+  uintptr_t handle = 0;
+  int shm = 0;
+  memset(file, 0, sizeof(*file));
+  int rc = goOpen(VFS_HANDLE(vfs), (char*)zName, flags, pOutFlags, &handle, &shm);
+  if( rc!=SQLITE_OK ){
+    /* pMethods stays NULL so SQLite doesn't call xClose on the failed file */
+    return rc;
+  }
+  file->handle = handle;
+  file->base.pMethods = shm ? &bridgeShmMethods : &bridgeMethods;
+  return SQLITE_OK;
+}
+
+static int bridgeDelete(sqlite3_vfs *vfs, const char *zName, int syncDir) {
+  return goDelete(VFS_HANDLE(vfs), (char*)zName, syncDir);
+}
+
+static int bridgeAccess(sqlite3_vfs *vfs, const char *zName, int flags, int *pResOut) {
+  return goAccess(VFS_HANDLE(vfs), (char*)zName, flags, pResOut);
+}
+
+static int bridgeFullPathname(sqlite3_vfs *vfs, const char *zName, int nOut, char *zOut) {
+  return goFullPathname(VFS_HANDLE(vfs), (char*)zName, nOut, zOut);
+}
+
+static int bridgeRandomness(sqlite3_vfs *vfs, int nByte, char *zOut) {
+  return goRandomness(VFS_HANDLE(vfs), nByte, zOut);
+}
+
+static int bridgeSleep(sqlite3_vfs *vfs, int microseconds) {
+  return goSleep(VFS_HANDLE(vfs), microseconds);
+}
+
+static int bridgeCurrentTimeInt64(sqlite3_vfs *vfs, sqlite3_int64 *piNow) {
+  return goCurrentTimeInt64(VFS_HANDLE(vfs), piNow);
+}
+
+static int bridgeCurrentTime(sqlite3_vfs *vfs, double *prNow) {
+  sqlite3_int64 now = 0;
+  int rc = bridgeCurrentTimeInt64(vfs, &now);
+  *prNow = now/86400000.0;
+  return rc;
+}
+
+static int bridgeGetLastError(sqlite3_vfs *vfs, int nBuf, char *zBuf) {
+  return 0;
+}
+
+int bridgeRegister(const char *name, int maxPathname, uintptr_t handle, sqlite3_vfs **out) {
+  sqlite3_vfs *delegate = sqlite3_vfs_find(0);
+  if( delegate==NULL ) return SQLITE_ERROR;
+  sqlite3_vfs *vfs = calloc(1, sizeof(sqlite3_vfs));
+  if( vfs==NULL ) return SQLITE_NOMEM;
+
+  vfs->iVersion = 2;
+  vfs->szOsFile = sizeof(bridgeFile);
+  vfs->mxPathname = maxPathname;
+  vfs->zName = name;
+  vfs->pAppData = (void*)handle;
+  vfs->xOpen = bridgeOpen;
+  vfs->xDelete = bridgeDelete;
+  vfs->xAccess = bridgeAccess;
+  vfs->xFullPathname = bridgeFullPathname;
+  vfs->xDlOpen = delegate->xDlOpen;
+  vfs->xDlError = delegate->xDlError;
+  vfs->xDlSym = delegate->xDlSym;
+  vfs->xDlClose = delegate->xDlClose;
+  vfs->xRandomness = bridgeRandomness;
+  vfs->xSleep = bridgeSleep;
+  vfs->xCurrentTime = bridgeCurrentTime;
+  vfs->xGetLastError = bridgeGetLastError;
+  vfs->xCurrentTimeInt64 = bridgeCurrentTimeInt64;
+
+  int rc = sqlite3_vfs_register(vfs, 0);
+  if( rc!=SQLITE_OK ){
+    free(vfs);
+    return rc;
+  }
+  *out = vfs;
+  return SQLITE_OK;
+}
+
+int bridgeUnregister(sqlite3_vfs *vfs) {
+  int rc = sqlite3_vfs_unregister(vfs);
+  if( rc==SQLITE_OK ) free(vfs);
+  return rc;
+}
+
+/* Wrappers for the API routines Go calls, they are macros in loadable extensions */
+
+const char *bridgeUriKey(const char *zName, int n) {
+  return sqlite3_uri_key(zName, n);
+}
+
+const char *bridgeUriParameter(const char *zName, const char *key) {
+  return sqlite3_uri_parameter(zName, key);
+}
@@ -0,0 +1,404 @@
+package sqlite3vfs
+
+/*
+#include "bridge.h"
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"runtime/cgo"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// registration is what a registered sqlite3_vfs refers to through its pAppData handle
+type registration struct {
+	vfs    ExtendedVFSv1
+	name   *C.char
+	cvfs   *C.sqlite3_vfs
+	handle cgo.Handle
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]*registration)
+)
+
+// RegisterVFS registers a VFS with sqlite. The name specified must be unique and should match the name given when
+// opening the database: `?vfs={{name}}`.
+func RegisterVFS(name string, vfs VFS, opts ...Option) error {
+	var vfsOpts options
+	for _, opt := range opts {
+		err := opt.setOption(&vfsOpts)
+		if err != nil {
+			return err
+		}
+	}
+	maxPathName := vfsOpts.maxPathName
+	if maxPathName == 0 {
+		maxPathName = 1024
+	}
+	extVFS, ok := vfs.(ExtendedVFSv1)
+	if !ok {
+		extVFS = &defaultVFSv1{vfs}
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[name]; ok {
+		return fmt.Errorf("vfs %q is already registered", name)
+	}
+	reg := &registration{vfs: extVFS, name: C.CString(name)}
+	reg.handle = cgo.NewHandle(reg)
+	var cvfs *C.sqlite3_vfs
+	rc := C.bridgeRegister(reg.name, C.int(maxPathName), C.uintptr_t(reg.handle), &cvfs)
+	if rc != C.SQLITE_OK {
+		reg.handle.Delete()
+		C.free(unsafe.Pointer(reg.name))
+		return errFromCode(int(rc))
+	}
+	reg.cvfs = cvfs
+	registry[name] = reg
+	return nil
+}
+
+// UnregisterVFS removes a VFS registered with RegisterVFS. Every connection using it must have been closed.
+func UnregisterVFS(name string) error {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	reg, ok := registry[name]
+	if !ok {
+		return fmt.Errorf("vfs %q is not registered", name)
+	}
+	if rc := C.bridgeUnregister(reg.cvfs); rc != C.SQLITE_OK {
+		return errFromCode(int(rc))
+	}
+	delete(registry, name)
+	reg.handle.Delete()
+	C.free(unsafe.Pointer(reg.name))
+	return nil
+}
+
+type defaultVFSv1 struct {
+	VFS
+}
+
+func (vfs *defaultVFSv1) Randomness(n []byte) int {
+	i, err := rand.Read(n)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+
+func (vfs *defaultVFSv1) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (vfs *defaultVFSv1) CurrentTime() time.Time {
+	return time.Now()
+}
+
+func vfsFromC(handle C.uintptr_t) ExtendedVFSv1 {
+	return cgo.Handle(handle).Value().(*registration).vfs
+}
+
+func fileFromC(handle C.uintptr_t) File {
+	return cgo.Handle(handle).Value().(File)
+}
+
+// paramName is a WAL or rollback journal file name given to xDelete or xAccess with its URI parameters. Other names
+// those get, like super journals, aren't guaranteed to be filenames sqlite3_uri_key can be used on.
+func paramName(zName *C.char) string {
+	name := C.GoString(zName)
+	if strings.HasSuffix(name, "-wal") || strings.HasSuffix(name, "-journal") {
+		name += uriQuery(zName)
+	}
+	return name
+}
+
+// uriQuery returns the URI parameters of a database, journal or WAL file name as a query string, "" if it has none
+func uriQuery(zName *C.char) string {
+	values := url.Values{}
+	for i := 0; ; i++ {
+		key := C.bridgeUriKey(zName, C.int(i))
+		if key == nil {
+			break
+		}
+		values.Add(C.GoString(key), C.GoString(C.bridgeUriParameter(zName, key)))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return "?" + values.Encode()
+}
+
+//export goOpen
+func goOpen(vfsHandle C.uintptr_t, zName *C.char, cflags C.int, outFlags *C.int, fileHandle *C.uintptr_t, shm *C.int) C.int {
+	flags := OpenFlag(cflags)
+	name := ""
+	if zName != nil {
+		name = C.GoString(zName)
+		if flags&(OpenMainDB|OpenMainJournal|OpenWAL) != 0 {
+			name += uriQuery(zName)
+		}
+	}
+
+	file, retFlags, err := vfsFromC(vfsHandle).Open(name, flags)
+	if err != nil {
+		return C.int(errCode(err, CantOpenError))
+	}
+	if retFlags != 0 && outFlags != nil {
+		*outFlags = C.int(retFlags)
+	}
+	*fileHandle = C.uintptr_t(cgo.NewHandle(file))
+	if _, ok := file.(ShmFile); ok {
+		*shm = 1
+	}
+	return sqliteOK
+}
+
+//export goDelete
+func goDelete(vfsHandle C.uintptr_t, zName *C.char, syncDir C.int) C.int {
+	err := vfsFromC(vfsHandle).Delete(paramName(zName), syncDir > 0)
+	return C.int(errCode(err, IOError))
+}
+
+// The flags argument to xAccess() may be SQLITE_ACCESS_EXISTS to test
+// for the existence of a file, or SQLITE_ACCESS_READWRITE to test
+// whether a file is readable and writable, or SQLITE_ACCESS_READ to
+// test whether a file is at least readable. If SQLITE_OK is
+// returned, then non-zero or zero is written into *pResOut to
+// indicate whether or not the file is accessible.
+//
+//export goAccess
+func goAccess(vfsHandle C.uintptr_t, zName *C.char, cflags C.int, pResOut *C.int) C.int {
+	ok, err := vfsFromC(vfsHandle).Access(paramName(zName), AccessFlag(cflags))
+	*pResOut = 0
+	if ok {
+		*pResOut = 1
+	}
+	return C.int(errCode(err, IOError))
+}
+
+//export goFullPathname
+func goFullPathname(vfsHandle C.uintptr_t, zName *C.char, nOut C.int, zOut *C.char) C.int {
+	s := vfsFromC(vfsHandle).FullPathname(C.GoString(zName))
+	if len(s)+1 > int(nOut) {
+		return C.int(CantOpenError.code)
+	}
+	out := unsafe.Slice((*byte)(unsafe.Pointer(zOut)), int(nOut))
+	copy(out, s)
+	out[len(s)] = 0
+	return sqliteOK
+}
+
+//export goRandomness
+func goRandomness(vfsHandle C.uintptr_t, nByte C.int, zOut *C.char) C.int {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(zOut)), int(nByte))
+	return C.int(vfsFromC(vfsHandle).Randomness(buf))
+}
+
+//export goSleep
+func goSleep(vfsHandle C.uintptr_t, microseconds C.int) C.int {
+	vfsFromC(vfsHandle).Sleep(time.Duration(microseconds) * time.Microsecond)
+	return microseconds
+}
+
+// Find the current time (in Universal Coordinated Time).  Write into *piNow
+// the current time and date as a Julian Day number times 86_400_000.  In
+// other words, write into *piNow the number of milliseconds since the Julian
+// epoch of noon in Greenwich on November 24, 4714 B.C according to the
+// proleptic Gregorian calendar.
+//
+//export goCurrentTimeInt64
+func goCurrentTimeInt64(vfsHandle C.uintptr_t, piNow *C.sqlite3_int64) C.int {
+	ts := vfsFromC(vfsHandle).CurrentTime()
+	unixEpoch := int64(24405875) * 8640000
+	*piNow = C.sqlite3_int64(unixEpoch + ts.UnixMilli())
+	return sqliteOK
+}
+
+//export goClose
+func goClose(fileHandle C.uintptr_t) C.int {
+	// SQLite never uses a file again after xClose, even when it fails
+	handle := cgo.Handle(fileHandle)
+	err := handle.Value().(File).Close()
+	handle.Delete()
+	return C.int(errCode(err, IOError))
+}
+
+//export goRead
+func goRead(fileHandle C.uintptr_t, buf unsafe.Pointer, amt C.int, off C.sqlite3_int64) C.int {
+	p := unsafe.Slice((*byte)(buf), int(amt))
+	n, err := fileFromC(fileHandle).ReadAt(p, int64(off))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return C.int(errCode(err, IOErrorRead))
+	}
+	if n < len(p) {
+		// If xRead() returns SQLITE_IOERR_SHORT_READ it must also fill in the unread portions of the buffer with zeros.
+		clear(p[n:])
+		return C.int(IOErrorShortRead.code)
+	}
+	return sqliteOK
+}
+
+//export goWrite
+func goWrite(fileHandle C.uintptr_t, buf unsafe.Pointer, amt C.int, off C.sqlite3_int64) C.int {
+	p := unsafe.Slice((*byte)(buf), int(amt))
+	n, err := fileFromC(fileHandle).WriteAt(p, int64(off))
+	if err == nil && n < len(p) {
+		err = IOErrorWrite
+	}
+	return C.int(errCode(err, IOErrorWrite))
+}
+
+//export goTruncate
+func goTruncate(fileHandle C.uintptr_t, size C.sqlite3_int64) C.int {
+	err := fileFromC(fileHandle).Truncate(int64(size))
+	return C.int(errCode(err, IOError))
+}
+
+//export goSync
+func goSync(fileHandle C.uintptr_t, flags C.int) C.int {
+	err := fileFromC(fileHandle).Sync(SyncType(flags))
+	return C.int(errCode(err, IOError))
+}
+
+//export goFileSize
+func goFileSize(fileHandle C.uintptr_t, pSize *C.sqlite3_int64) C.int {
+	n, err := fileFromC(fileHandle).FileSize()
+	if err != nil {
+		return C.int(errCode(err, IOError))
+	}
+	*pSize = C.sqlite3_int64(n)
+	return sqliteOK
+}
+
+//export goLock
+func goLock(fileHandle C.uintptr_t, eLock C.int) C.int {
+	err := fileFromC(fileHandle).Lock(LockType(eLock))
+	return C.int(errCode(err, IOError))
+}
+
+//export goUnlock
+func goUnlock(fileHandle C.uintptr_t, eLock C.int) C.int {
+	err := fileFromC(fileHandle).Unlock(LockType(eLock))
+	return C.int(errCode(err, IOError))
+}
+
+//export goCheckReservedLock
+func goCheckReservedLock(fileHandle C.uintptr_t, pResOut *C.int) C.int {
+	locked, err := fileFromC(fileHandle).CheckReservedLock()
+	if err != nil {
+		return C.int(errCode(err, IOError))
+	}
+	*pResOut = 0
+	if locked {
+		*pResOut = 1
+	}
+	return sqliteOK
+}
+
+//export goCommitPhaseTwo
+func goCommitPhaseTwo(fileHandle C.uintptr_t) C.int {
+	err := fileFromC(fileHandle).ConfirmCommit()
+	return C.int(errCode(err, IOError))
+}
+
+//export goPragma
+func goPragma(fileHandle C.uintptr_t, name *C.char, value *C.char, result **C.char) C.int {
+	file, ok := fileFromC(fileHandle).(PragmaFile)
+	if !ok {
+		return C.int(NotFoundError.code)
+	}
+	arg := ""
+	if value != nil {
+		arg = C.GoString(value)
+	}
+	res, err := file.Pragma(C.GoString(name), arg)
+	if errors.Is(err, NotFoundError) {
+		return C.int(NotFoundError.code)
+	} else if err != nil {
+		*result = C.CString(err.Error())
+		return C.int(errCode(err, GenericError))
+	}
+	if res != "" {
+		*result = C.CString(res)
+	}
+	return sqliteOK
+}
+
+//export goSectorSize
+func goSectorSize(fileHandle C.uintptr_t) C.int {
+	return C.int(fileFromC(fileHandle).SectorSize())
+}
+
+//export goDeviceCharacteristics
+func goDeviceCharacteristics(fileHandle C.uintptr_t) C.int {
+	return C.int(fileFromC(fileHandle).DeviceCharacteristics())
+}
+
+//export goShmMap
+func goShmMap(fileHandle C.uintptr_t, region C.int, size C.int, extend C.int, pp *unsafe.Pointer) C.int {
+	*pp = nil
+	file, ok := fileFromC(fileHandle).(ShmFile)
+	if !ok {
+		return C.int(IOErrorShmMap.code)
+	}
+	mem, err := file.ShmMap(int(region), int(size), extend != 0)
+	if err != nil {
+		return C.int(errCode(err, IOErrorShmMap))
+	}
+	if mem == nil {
+		return sqliteOK
+	}
+	if !shmAllocated(mem) {
+		return C.int(IOErrorShmMap.code)
+	}
+	*pp = unsafe.Pointer(&mem[0])
+	return sqliteOK
+}
+
+//export goShmLock
+func goShmLock(fileHandle C.uintptr_t, offset C.int, n C.int, flags C.int) C.int {
+	err := fileFromC(fileHandle).(ShmFile).ShmLock(int(offset), int(n), ShmLockFlag(flags))
+	return C.int(errCode(err, IOError))
+}
+
+//export goShmBarrier
+func goShmBarrier(fileHandle C.uintptr_t) {
+	fileFromC(fileHandle).(ShmFile).ShmBarrier()
+}
+
+//export goShmUnmap
+func goShmUnmap(fileHandle C.uintptr_t, deleteFlag C.int) C.int {
+	err := fileFromC(fileHandle).(ShmFile).ShmUnmap(deleteFlag != 0)
+	return C.int(errCode(err, IOError))
+}
+
+//export goFetch
+func goFetch(fileHandle C.uintptr_t, off C.sqlite3_int64, amt C.int, buf unsafe.Pointer, found *C.int) C.int {
+	file, ok := fileFromC(fileHandle).(Fetcher)
+	if !ok {
+		return sqliteOK
+	}
+	data, err := file.Fetch(int64(off), int(amt))
+	if err != nil {
+		return C.int(errCode(err, IOErrorRead))
+	}
+	if len(data) != int(amt) {
+		return sqliteOK
+	}
+	copy(unsafe.Slice((*byte)(buf), int(amt)), data)
+	*found = 1
+	return sqliteOK
+}
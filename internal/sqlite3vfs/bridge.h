@@ -0,0 +1,26 @@
+#ifndef SQLITE3VFS_BRIDGE_H
+#define SQLITE3VFS_BRIDGE_H
+
+#include <stdint.h>
+
+#ifdef SQLITE3VFS_LOADABLE_EXT
+#include <sqlite3ext.h>
+/* Defined with SQLITE_EXTENSION_INIT1 in bridge.c, set by the extension's entry point */
+SQLITE_EXTENSION_INIT3
+#else
+#include <sqlite3.h>
+#endif
+
+/* Every open file is a bridgeFile, handle is the cgo.Handle of the Go File */
+typedef struct bridgeFile {
+  sqlite3_file base;
+  uintptr_t handle;
+} bridgeFile;
+
+int bridgeRegister(const char *name, int maxPathname, uintptr_t handle, sqlite3_vfs **out);
+int bridgeUnregister(sqlite3_vfs *vfs);
+
+const char *bridgeUriKey(const char *zName, int n);
+const char *bridgeUriParameter(const char *zName, const char *key);
+
+#endif /* SQLITE3VFS_BRIDGE_H */
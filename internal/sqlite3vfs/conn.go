@@ -0,0 +1,123 @@
+package sqlite3vfs
+
+/*
+#include "bridge.h"
+#include <stdlib.h>
+
+// In a loadable extension the SQLite API is a table of function pointers, which cgo can't call directly
+
+static int connOpen(const char *uri, sqlite3 **db) {
+  return sqlite3_open_v2(uri, db, SQLITE_OPEN_READWRITE | SQLITE_OPEN_CREATE | SQLITE_OPEN_URI, NULL);
+}
+
+static int connClose(sqlite3 *db) {
+  return sqlite3_close_v2(db);
+}
+
+static const char *connErrmsg(sqlite3 *db) {
+  return sqlite3_errmsg(db);
+}
+
+static int connExec(sqlite3 *db, const char *sql) {
+  return sqlite3_exec(db, sql, NULL, NULL, NULL);
+}
+
+static int connPrepare(sqlite3 *db, const char *sql, sqlite3_stmt **stmt) {
+  return sqlite3_prepare_v2(db, sql, -1, stmt, NULL);
+}
+
+static int connStep(sqlite3_stmt *stmt) {
+  return sqlite3_step(stmt);
+}
+
+static int connColumnCount(sqlite3_stmt *stmt) {
+  return sqlite3_column_count(stmt);
+}
+
+static const char *connColumnText(sqlite3_stmt *stmt, int i) {
+  return (const char *)sqlite3_column_text(stmt, i);
+}
+
+static int connFinalize(sqlite3_stmt *stmt) {
+  return sqlite3_finalize(stmt);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Conn is a minimal SQLite connection, enough to drive a VFS from tests and tools without a database/sql driver
+type Conn struct {
+	db *C.sqlite3
+}
+
+// OpenConn opens a connection to uri, creating the database if needed. URI filenames are enabled, so the VFS can be
+// picked with file:app.db?vfs={{name}}.
+func OpenConn(uri string) (*Conn, error) {
+	curi := C.CString(uri)
+	defer C.free(unsafe.Pointer(curi))
+	var db *C.sqlite3
+	rc := C.connOpen(curi, &db)
+	if rc != C.SQLITE_OK {
+		err := fmt.Errorf("open %s: %w", uri, errFromCode(int(rc)))
+		if db != nil {
+			err = fmt.Errorf("open %s: %s: %w", uri, C.GoString(C.connErrmsg(db)), errFromCode(int(rc)))
+			C.connClose(db)
+		}
+		return nil, err
+	}
+	return &Conn{db: db}, nil
+}
+
+func (c *Conn) error(rc C.int) error {
+	return fmt.Errorf("%s: %w", C.GoString(C.connErrmsg(c.db)), errFromCode(int(rc)))
+}
+
+// Exec runs one or more statements, discarding their results
+func (c *Conn) Exec(sql string) error {
+	csql := C.CString(sql)
+	defer C.free(unsafe.Pointer(csql))
+	if rc := C.connExec(c.db, csql); rc != C.SQLITE_OK {
+		return c.error(rc)
+	}
+	return nil
+}
+
+// Query runs a single statement and returns its rows as text, NULLs are returned as ""
+func (c *Conn) Query(sql string) ([][]string, error) {
+	csql := C.CString(sql)
+	defer C.free(unsafe.Pointer(csql))
+	var stmt *C.sqlite3_stmt
+	if rc := C.connPrepare(c.db, csql, &stmt); rc != C.SQLITE_OK {
+		return nil, c.error(rc)
+	}
+	defer C.connFinalize(stmt)
+
+	var rows [][]string
+	for {
+		rc := C.connStep(stmt)
+		if rc == C.SQLITE_DONE {
+			return rows, nil
+		} else if rc != C.SQLITE_ROW {
+			return nil, c.error(rc)
+		}
+		row := make([]string, int(C.connColumnCount(stmt)))
+		for i := range row {
+			if text := C.connColumnText(stmt, C.int(i)); text != nil {
+				row[i] = C.GoString(text)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	if rc := C.connClose(c.db); rc != C.SQLITE_OK {
+		return c.error(rc)
+	}
+	return nil
+}
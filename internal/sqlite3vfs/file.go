@@ -0,0 +1,165 @@
+package sqlite3vfs
+
+import "fmt"
+
+type File interface {
+	Close() error
+
+	// ReadAt reads len(p) bytes into p starting at offset off. Reads past the end of the file return the number of
+	// bytes read, the bridge zero fills the rest of p and reports SQLITE_IOERR_SHORT_READ. io.EOF is not an error.
+	ReadAt(p []byte, off int64) (n int, err error)
+
+	// WriteAt writes len(p) bytes from p to the underlying data stream at offset off.
+	// It returns the number of bytes written from p (0 <= n <= len(p)) and any error encountered that caused the write to stop early.
+	// WriteAt must return a non-nil error if it returns n < len(p).
+	WriteAt(p []byte, off int64) (n int, err error)
+
+	Truncate(size int64) error
+
+	Sync(flag SyncType) error
+
+	FileSize() (int64, error)
+
+	// Acquire or upgrade a lock.
+	// elock can be one of the following:
+	// LockShared, LockReserved, LockPending, LockExclusive.
+	//
+	// Additional states can be inserted between the current lock level
+	// and the requested lock level. The locking might fail on one of the later
+	// transitions leaving the lock state different from what it started but
+	// still short of its goal.  The following chart shows the allowed
+	// transitions and the inserted intermediate states:
+	//
+	//    UNLOCKED -> SHARED
+	//    SHARED -> RESERVED
+	//    SHARED -> (PENDING) -> EXCLUSIVE
+	//    RESERVED -> (PENDING) -> EXCLUSIVE
+	//    PENDING -> EXCLUSIVE
+	//
+	// This function should only increase a lock level.
+	// See the sqlite source documentation for unixLock for more details.
+	Lock(elock LockType) error
+
+	// Lower the locking level on file to eFileLock. eFileLock must be
+	// either NO_LOCK or SHARED_LOCK. If the locking level of the file
+	// descriptor is already at or below the requested locking level,
+	// this routine is a no-op.
+	Unlock(elock LockType) error
+
+	// Check whether any database connection, either in this process or
+	// in some other process, is holding a RESERVED, PENDING, or
+	// EXCLUSIVE lock on the file. It returns true if such a lock exists
+	// and false otherwise.
+	CheckReservedLock() (bool, error)
+
+	// SectorSize returns the sector size of the device that underlies
+	// the file. The sector size is the minimum write that can be
+	// performed without disturbing other bytes in the file.
+	SectorSize() int64
+
+	// DeviceCharacteristics returns a bit vector describing behaviors
+	// of the underlying device.
+	DeviceCharacteristics() DeviceCharacteristic
+
+	// Confirm a commit from a commit_phasetwo fcntl
+	ConfirmCommit() error
+}
+
+// ShmFile is implemented by files that provide the WAL index (xShm* methods). Regions returned by ShmMap must be
+// allocated with ShmAlloc, SQLite reads and writes them directly.
+type ShmFile interface {
+	// ShmMap returns region of the WAL index, each region is size bytes. If the region doesn't exist yet it is
+	// created when extend is set, otherwise nil is returned.
+	ShmMap(region int, size int, extend bool) ([]byte, error)
+
+	// ShmLock acquires or releases n of the WAL index locks starting at offset, returning BusyError on conflict
+	ShmLock(offset int, n int, flags ShmLockFlag) error
+
+	// ShmBarrier orders memory accesses to the WAL index, the bridge issues a full memory barrier before calling it
+	ShmBarrier()
+
+	// ShmUnmap releases the file's locks and regions, deleting the WAL index if deleteFlag is set
+	ShmUnmap(deleteFlag bool) error
+}
+
+// Fetcher is implemented by files that serve memory-mapped reads. Fetch returns nil when the page should be read
+// with ReadAt instead.
+type Fetcher interface {
+	Fetch(off int64, amt int) ([]byte, error)
+}
+
+// PragmaFile is implemented by files with pragmas of their own. Pragma returns NotFoundError for pragmas SQLite
+// should handle, value is "" when the pragma was given no argument.
+type PragmaFile interface {
+	Pragma(name string, value string) (string, error)
+}
+
+type SyncType int
+
+const (
+	SyncNormal   SyncType = 0x00002
+	SyncFull     SyncType = 0x00003
+	SyncDataOnly SyncType = 0x00010
+)
+
+// https://www.sqlite.org/c3ref/c_lock_exclusive.html
+type LockType int
+
+const (
+	LockNone      LockType = 0
+	LockShared    LockType = 1
+	LockReserved  LockType = 2
+	LockPending   LockType = 3
+	LockExclusive LockType = 4
+)
+
+func (lt LockType) String() string {
+	switch lt {
+	case LockNone:
+		return "LockNone"
+	case LockShared:
+		return "LockShared"
+	case LockReserved:
+		return "LockReserved"
+	case LockPending:
+		return "LockPending"
+	case LockExclusive:
+		return "LockExclusive"
+	default:
+		return fmt.Sprintf("LockTypeUnknown<%d>", lt)
+	}
+}
+
+// ShmLockFlag mirrors the SQLITE_SHM_* flags passed to xShmLock
+type ShmLockFlag int
+
+const (
+	ShmUnlock    ShmLockFlag = 1
+	ShmLock      ShmLockFlag = 2
+	ShmShared    ShmLockFlag = 4
+	ShmExclusive ShmLockFlag = 8
+)
+
+// ShmLockSlots is SQLITE_SHM_NLOCK, the number of WAL index locks
+const ShmLockSlots = 8
+
+// https://www.sqlite.org/c3ref/c_iocap_atomic.html
+type DeviceCharacteristic int
+
+const (
+	IocapAtomic              DeviceCharacteristic = 0x00000001
+	IocapAtomic512           DeviceCharacteristic = 0x00000002
+	IocapAtomic1K            DeviceCharacteristic = 0x00000004
+	IocapAtomic2K            DeviceCharacteristic = 0x00000008
+	IocapAtomic4K            DeviceCharacteristic = 0x00000010
+	IocapAtomic8K            DeviceCharacteristic = 0x00000020
+	IocapAtomic16K           DeviceCharacteristic = 0x00000040
+	IocapAtomic32K           DeviceCharacteristic = 0x00000080
+	IocapAtomic64K           DeviceCharacteristic = 0x00000100
+	IocapSafeAppend          DeviceCharacteristic = 0x00000200
+	IocapSequential          DeviceCharacteristic = 0x00000400
+	IocapUndeletableWhenOpen DeviceCharacteristic = 0x00000800
+	IocapPowersafeOverwrite  DeviceCharacteristic = 0x00001000
+	IocapImmutable           DeviceCharacteristic = 0x00002000
+	IocapBatchAtomic         DeviceCharacteristic = 0x00004000
+)
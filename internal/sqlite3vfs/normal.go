@@ -0,0 +1,10 @@
+//go:build !SQLITE3VFS_LOADABLE_EXT
+// +build !SQLITE3VFS_LOADABLE_EXT
+
+package sqlite3vfs
+
+/*
+   #cgo darwin LDFLAGS: -Wl,-undefined,dynamic_lookup
+   #cgo linux LDFLAGS: -lsqlite3
+*/
+import "C"
@@ -0,0 +1,49 @@
+package sqlite3vfs
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// WAL index regions are shared with SQLite, which keeps pointers to them between calls, so they live in C memory.
+
+var (
+	shmMutex  sync.Mutex
+	shmAllocs = make(map[unsafe.Pointer]int)
+)
+
+// ShmAlloc returns size zeroed bytes for a WAL index region. They stay valid until passed to ShmFree.
+func ShmAlloc(size int) []byte {
+	p := C.calloc(1, C.size_t(size))
+	if p == nil {
+		panic("sqlite3vfs: out of memory allocating a WAL index region")
+	}
+	shmMutex.Lock()
+	shmAllocs[p] = size
+	shmMutex.Unlock()
+	return unsafe.Slice((*byte)(p), size)
+}
+
+// ShmFree releases a region returned by ShmAlloc
+func ShmFree(region []byte) {
+	p := unsafe.Pointer(unsafe.SliceData(region))
+	shmMutex.Lock()
+	_, ok := shmAllocs[p]
+	delete(shmAllocs, p)
+	shmMutex.Unlock()
+	if ok {
+		C.free(p)
+	}
+}
+
+func shmAllocated(region []byte) bool {
+	shmMutex.Lock()
+	defer shmMutex.Unlock()
+	size, ok := shmAllocs[unsafe.Pointer(unsafe.SliceData(region))]
+	return ok && len(region) <= size
+}
@@ -0,0 +1,103 @@
+// Package sqlite3vfs lets Go implement SQLite virtual file systems. It is the project's own cgo bridge: the C side
+// implements sqlite3_vfs and version 3 of sqlite3_io_methods and forwards every call to the registered Go VFS and the
+// Files it opens, which are referenced from C through runtime/cgo handles for as long as SQLite keeps them open.
+//
+// Besides the methods of File, the bridge maps these optional interfaces onto SQLite:
+//
+//	ShmFile    xShmMap, xShmLock, xShmBarrier and xShmUnmap, files without it can't be used in WAL mode
+//	Fetcher    xFetch, used for memory-mapped I/O (PRAGMA mmap_size), the returned bytes are copied
+//	PragmaFile SQLITE_FCNTL_PRAGMA, so files can implement their own pragmas
+//
+// Programs link SQLite themselves (for example with CGO_LDFLAGS=-lsqlite3). With the SQLITE3VFS_LOADABLE_EXT build
+// tag every SQLite call goes through the routines handed to a loadable extension's entry point instead.
+package sqlite3vfs
+
+import "time"
+
+// VFS is the interface a Go VFS implements
+type VFS interface {
+	// Open a file. Name is "" for temporary files. The names of main databases, their journals and WAL files carry
+	// the URI parameters they were opened with as a query string ("app.db?dir=/var/lib"). The returned flags are
+	// reported back to SQLite.
+	Open(name string, flags OpenFlag) (File, OpenFlag, error)
+
+	// Delete the named file. If dirSync is true them ensure the file-system modification has been synced to disk
+	// before returning. Like in Access, WAL file names carry URI parameters.
+	Delete(name string, dirSync bool) error
+
+	// Access tests for access permission. Returns true if the requested permission is available.
+	Access(name string, flags AccessFlag) (bool, error)
+
+	// FullPathname returns the canonicalized version of name.
+	FullPathname(name string) string
+}
+
+// ExtendedVFSv1 lets a VFS replace the randomness and time sources, VFSes without it use crypto/rand and the system
+// clock
+type ExtendedVFSv1 interface {
+	VFS
+
+	// Randomness populates n with pseudo-random data. Returns the number of bytes of randomness obtained.
+	Randomness(n []byte) int
+
+	// Sleep for duration
+	Sleep(d time.Duration)
+
+	CurrentTime() time.Time
+}
+
+type OpenFlag int
+
+const (
+	OpenReadOnly      OpenFlag = 0x00000001
+	OpenReadWrite     OpenFlag = 0x00000002
+	OpenCreate        OpenFlag = 0x00000004
+	OpenDeleteOnClose OpenFlag = 0x00000008
+	OpenExclusive     OpenFlag = 0x00000010
+	OpenAutoProxy     OpenFlag = 0x00000020
+	OpenURI           OpenFlag = 0x00000040
+	OpenMemory        OpenFlag = 0x00000080
+	OpenMainDB        OpenFlag = 0x00000100
+	OpenTempDB        OpenFlag = 0x00000200
+	OpenTransientDB   OpenFlag = 0x00000400
+	OpenMainJournal   OpenFlag = 0x00000800
+	OpenTempJournal   OpenFlag = 0x00001000
+	OpenSubJournal    OpenFlag = 0x00002000
+	OpenSuperJournal  OpenFlag = 0x00004000
+	OpenNoMutex       OpenFlag = 0x00008000
+	OpenFullMutex     OpenFlag = 0x00010000
+	OpenSharedCache   OpenFlag = 0x00020000
+	OpenPrivateCache  OpenFlag = 0x00040000
+	OpenWAL           OpenFlag = 0x00080000
+	OpenNoFollow      OpenFlag = 0x01000000
+)
+
+type AccessFlag int
+
+const (
+	AccessExists    AccessFlag = 0 // Does the file exist?
+	AccessReadWrite AccessFlag = 1 // Is the file both readable and writeable?
+	AccessRead      AccessFlag = 2 // Is the file readable?
+)
+
+type options struct {
+	maxPathName int
+}
+
+type Option interface {
+	setOption(*options) error
+}
+
+type maxPathOption struct {
+	maxPath int
+}
+
+func (o maxPathOption) setOption(opts *options) error {
+	opts.maxPathName = o.maxPath
+	return nil
+}
+
+// WithMaxPathName sets the longest path name SQLite will hand to the VFS, 1024 by default
+func WithMaxPathName(n int) Option {
+	return maxPathOption{maxPath: n}
+}
@@ -0,0 +1,267 @@
+package sqlite3vfs
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memVFS keeps files in memory and records the names it was asked to open
+type memVFS struct {
+	mutex  sync.Mutex
+	files  map[string]*memData
+	opened []string
+}
+
+type memData struct {
+	data     []byte
+	reserved bool
+}
+
+type memFile struct {
+	vfs     *memVFS
+	data    *memData
+	lock    LockType
+	fetches int
+}
+
+func newMemVFS() *memVFS {
+	return &memVFS{files: make(map[string]*memData)}
+}
+
+func (v *memVFS) Open(name string, flags OpenFlag) (File, OpenFlag, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.opened = append(v.opened, name)
+	data, ok := v.files[name]
+	if !ok {
+		if flags&OpenCreate == 0 {
+			return nil, 0, CantOpenError
+		}
+		data = &memData{}
+		if name != "" {
+			v.files[name] = data
+		}
+	}
+	return &memFile{vfs: v, data: data}, flags, nil
+}
+
+func (v *memVFS) Delete(name string, dirSync bool) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.files, name)
+	return nil
+}
+
+func (v *memVFS) Access(name string, flags AccessFlag) (bool, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	_, ok := v.files[name]
+	return ok, nil
+}
+
+func (v *memVFS) FullPathname(name string) string {
+	return name
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, f.data.data[off:]), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	return copy(f.data.data[off:], p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	if size < int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+	}
+	return nil
+}
+
+func (f *memFile) Sync(flag SyncType) error {
+	return nil
+}
+
+func (f *memFile) FileSize() (int64, error) {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	return int64(len(f.data.data)), nil
+}
+
+func (f *memFile) Lock(elock LockType) error {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	if elock >= LockReserved {
+		f.data.reserved = true
+	}
+	f.lock = elock
+	return nil
+}
+
+func (f *memFile) Unlock(elock LockType) error {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	if f.lock >= LockReserved && elock < LockReserved {
+		f.data.reserved = false
+	}
+	f.lock = elock
+	return nil
+}
+
+func (f *memFile) CheckReservedLock() (bool, error) {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	return f.data.reserved, nil
+}
+
+func (f *memFile) SectorSize() int64 {
+	return 0
+}
+
+func (f *memFile) DeviceCharacteristics() DeviceCharacteristic {
+	return 0
+}
+
+func (f *memFile) ConfirmCommit() error {
+	return nil
+}
+
+func (f *memFile) Pragma(name string, value string) (string, error) {
+	switch name {
+	case "memvfs_size":
+		size, _ := f.FileSize()
+		return strconv.FormatInt(size, 10), nil
+	case "memvfs_fetches":
+		return strconv.Itoa(f.fetches), nil
+	case "memvfs_fail":
+		return "", fmt.Errorf("failing with %q", value)
+	}
+	return "", NotFoundError
+}
+
+func (f *memFile) Fetch(off int64, amt int) ([]byte, error) {
+	f.vfs.mutex.Lock()
+	defer f.vfs.mutex.Unlock()
+	if off+int64(amt) > int64(len(f.data.data)) {
+		return nil, nil
+	}
+	f.fetches++
+	return f.data.data[off : off+int64(amt)], nil
+}
+
+func registerMemVFS(t *testing.T, name string) *memVFS {
+	vfs := newMemVFS()
+	require.NoError(t, RegisterVFS(name, vfs))
+	t.Cleanup(func() {
+		require.NoError(t, UnregisterVFS(name))
+	})
+	return vfs
+}
+
+func TestRegisterVFS(t *testing.T) {
+	registerMemVFS(t, "memvfs-register")
+	assert.Error(t, RegisterVFS("memvfs-register", newMemVFS()), "Names must be unique")
+	assert.Error(t, UnregisterVFS("memvfs-unknown"))
+}
+
+func TestConn_CRUD(t *testing.T) {
+	vfs := registerMemVFS(t, "memvfs-crud")
+	conn, err := OpenConn("file:crud.db?vfs=memvfs-crud&dir=/var/lib")
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT); INSERT INTO t (v) VALUES ('a'), ('b'), (NULL)"))
+	require.NoError(t, conn.Exec("UPDATE t SET v = 'c' WHERE id = 2; DELETE FROM t WHERE id = 1"))
+	rows, err := conn.Query("SELECT id, v FROM t ORDER BY id")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"2", "c"}, {"3", ""}}, rows)
+
+	_, err = conn.Query("SELECT * FROM missing")
+	assert.ErrorContains(t, err, "no such table")
+	require.NoError(t, conn.Close())
+
+	assert.Contains(t, vfs.opened, "crud.db?dir=%2Fvar%2Flib&vfs=memvfs-crud", "URI parameters should reach the VFS")
+	assert.Contains(t, vfs.opened, "crud.db-journal?dir=%2Fvar%2Flib&vfs=memvfs-crud")
+
+	conn, err = OpenConn("file:crud.db?vfs=memvfs-crud&dir=/var/lib")
+	require.NoError(t, err)
+	defer conn.Close()
+	rows, err = conn.Query("SELECT count(*) FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"2"}}, rows)
+}
+
+func TestConn_Pragma(t *testing.T) {
+	registerMemVFS(t, "memvfs-pragma")
+	conn, err := OpenConn("file:pragma.db?vfs=memvfs-pragma")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.Exec("CREATE TABLE t (v)"))
+
+	rows, err := conn.Query("PRAGMA memvfs_size")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"8192"}}, rows)
+
+	_, err = conn.Query("PRAGMA memvfs_fail = 'now'")
+	assert.ErrorContains(t, err, `failing with "now"`)
+
+	rows, err = conn.Query("PRAGMA user_version")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"0"}}, rows, "Pragmas the file doesn't handle go to SQLite")
+}
+
+func TestConn_Fetch(t *testing.T) {
+	registerMemVFS(t, "memvfs-fetch")
+	conn, err := OpenConn("file:fetch.db?vfs=memvfs-fetch")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.Exec("CREATE TABLE t (v); INSERT INTO t VALUES (1)"))
+
+	require.NoError(t, conn.Exec("PRAGMA mmap_size = 1048576"))
+	rows, err := conn.Query("SELECT v FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"1"}}, rows)
+	rows, err = conn.Query("PRAGMA memvfs_fetches")
+	require.NoError(t, err)
+	assert.NotEqual(t, [][]string{{"0"}}, rows, "Pages should be read through xFetch")
+}
+
+func TestConn_WALNeedsShm(t *testing.T) {
+	registerMemVFS(t, "memvfs-wal")
+	conn, err := OpenConn("file:wal.db?vfs=memvfs-wal")
+	require.NoError(t, err)
+	defer conn.Close()
+	rows, err := conn.Query("PRAGMA journal_mode = WAL")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"delete"}}, rows, "Files without ShmFile can't use WAL")
+}
+
+func TestShmAlloc(t *testing.T) {
+	region := ShmAlloc(32768)
+	assert.Len(t, region, 32768)
+	assert.True(t, shmAllocated(region))
+	assert.False(t, shmAllocated(make([]byte, 32768)))
+	ShmFree(region)
+	assert.False(t, shmAllocated(region))
+}
@@ -0,0 +1,311 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	pageSchema "s3qlite/internal/schema/page"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// The administrative API works on the store of a database directly, whether or not this process has it open. It is
+// what the skylite command line tool is built on. Inspection uses a read-only snapshot, repairs a write transaction.
+
+// DatabaseInfo summarizes the store of a database
+type DatabaseInfo struct {
+	PageSize     int
+	Revision     int64
+	Codec        Codec
+	WAL          bool     // the header selects WAL mode
+	Pages        int      // pages stored
+	Deltas       int      // pages stored as a delta against another page
+	FileSize     int64    // size of the database file SQLite sees
+	Contents     int      // page contents held in the local store
+	ContentBytes int64    // stored (compressed) size of those contents
+	Segments     []string // segments holding compacted contents, newest first
+}
+
+// PageInfo describes the envelope stored for a page
+type PageInfo struct {
+	Offset   int64
+	Revision int64
+	Size     int    // size of the envelope
+	Hash     []byte // hash of the page content, nil when the envelope holds the data itself
+	Base     []byte // hash of the delta base, nil unless the page is stored as a delta
+	Codec    Codec  // codec of the data or delta held by the envelope
+}
+
+// inspect runs fn in a read transaction of the named database, opening its store read-only if needed
+func (v *VFS) inspect(name string, fn func(txn PageTxn) error) error {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadOnly, true)
+	if errors.Is(err, sqlite3vfs.CantOpenError) {
+		return fmt.Errorf("database %s not found", name)
+	} else if err != nil {
+		return err
+	}
+	defer release()
+	txn, err := store.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	return fn(txn)
+}
+
+// storedPage returns the data of the page stored at off, nil if there is none. The first page is returned as stored,
+// without the change counter SQLite is shown.
+func (v *VFS) storedPage(txn PageTxn, name string, off int64) ([]byte, error) {
+	buf := txn.Get(off)
+	if buf == nil {
+		return nil, nil
+	}
+	return v.envelopeData(txn, name, buf)
+}
+
+// envelopeData returns the data held or referred to by a serialized envelope
+func (v *VFS) envelopeData(txn PageTxn, name string, buf []byte) ([]byte, error) {
+	data, ref, err := decodePage(pageSchema.GetRootAsPage(buf, 0))
+	if err != nil || ref == nil {
+		return data, err
+	}
+	data, err = v.resolveRef(txn, name, ref)
+	if err == nil && data == nil {
+		err = fmt.Errorf("content %x not found", ref.hash)
+	}
+	return data, err
+}
+
+// Info summarizes the named database
+func (v *VFS) Info(name string) (DatabaseInfo, error) {
+	var info DatabaseInfo
+	err := v.inspect(name, func(txn PageTxn) error {
+		info.PageSize = storedPageSize(txn)
+		info.Revision = storedRevision(txn)
+		info.Codec = v.databaseCodec(txn)
+		if last, ok := txn.LastOffset(); ok {
+			info.FileSize = last + int64(info.PageSize)
+		}
+		header, err := v.storedPage(txn, name, 0)
+		if err != nil {
+			return fmt.Errorf("reading first page: %w", err)
+		}
+		info.WAL = len(header) > 19 && (header[18] == 2 || header[19] == 2)
+		err = txn.ForEach(func(off int64, page []byte) error {
+			info.Pages++
+			ref, err := decodeRef(page)
+			if err == nil && ref != nil && ref.delta != nil {
+				info.Deltas++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = txn.ForEachContent(func(hash []byte, data []byte) error {
+			info.Contents++
+			info.ContentBytes += int64(len(data))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		info.Segments, err = readManifest(txn)
+		return err
+	})
+	return info, err
+}
+
+// Pages describes every page stored for the named database in offset order
+func (v *VFS) Pages(name string) ([]PageInfo, error) {
+	var pages []PageInfo
+	err := v.inspect(name, func(txn PageTxn) error {
+		return txn.ForEach(func(off int64, buf []byte) error {
+			page := pageSchema.GetRootAsPage(buf, 0)
+			_, ref, err := decodePage(page)
+			if err != nil {
+				return fmt.Errorf("decoding page at %d: %w", off, err)
+			}
+			info := PageInfo{Offset: off, Revision: page.Revision(), Size: len(buf), Codec: page.Codec()}
+			if ref != nil {
+				info.Hash = bytes.Clone(ref.hash)
+				if ref.delta != nil {
+					info.Base = bytes.Clone(ref.base)
+				}
+			}
+			pages = append(pages, info)
+			return nil
+		})
+	})
+	return pages, err
+}
+
+// ReadPage returns the contents of the page at off in the named database
+func (v *VFS) ReadPage(name string, off int64) ([]byte, error) {
+	var data []byte
+	err := v.inspect(name, func(txn PageTxn) error {
+		var err error
+		data, err = v.storedPage(txn, name, off)
+		if err == nil && data == nil {
+			err = fmt.Errorf("no page at offset %d", off)
+		}
+		data = bytes.Clone(data)
+		return err
+	})
+	return data, err
+}
+
+// ReadPageAt returns the contents the page at off in the named database had at revision rev
+func (v *VFS) ReadPageAt(name string, off int64, rev int64) ([]byte, error) {
+	var data []byte
+	err := v.inspect(name, func(txn PageTxn) error {
+		if start, ok := historyStart(txn); !ok || rev < start || rev > storedRevision(txn) {
+			return fmt.Errorf("no history is kept for revision %d", rev)
+		}
+		var err error
+		data, err = v.versionPage(txn, name, off, rev)
+		if err == nil && data == nil {
+			err = fmt.Errorf("no page at offset %d at revision %d", off, rev)
+		}
+		data = bytes.Clone(data)
+		return err
+	})
+	return data, err
+}
+
+// Verify checks that every page of the named database can be read back in full and matches its hash, that no page is
+// missing and that the first page header agrees with the store. It returns the problems found, the error is only set
+// when the check couldn't be run.
+func (v *VFS) Verify(name string) ([]string, error) {
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	err := v.inspect(name, func(txn PageTxn) error {
+		pageSize := int64(storedPageSize(txn))
+		if !validPageSize(int(pageSize)) {
+			report("invalid stored page size %d", pageSize)
+			return nil
+		}
+		revision := storedRevision(txn)
+		next := int64(0)
+		err := txn.ForEach(func(off int64, buf []byte) error {
+			if off%pageSize != 0 {
+				report("page at %d isn't aligned to the page size", off)
+				return nil
+			}
+			for ; next < off; next += pageSize {
+				report("page %d is missing", next/pageSize+1)
+			}
+			next = off + pageSize
+
+			page := pageSchema.GetRootAsPage(buf, 0)
+			if page.Revision() > revision {
+				report("page %d has revision %d, after the database revision %d", off/pageSize+1, page.Revision(), revision)
+			}
+			data, ref, err := decodePage(page)
+			if err == nil && ref != nil {
+				// Past the page cache, which may hold what was read before the stored content went bad
+				data, err = resolveRefWith(ref, func(hash []byte) ([]byte, error) {
+					return v.content(txn, name, hash)
+				})
+				if err == nil && data == nil {
+					err = fmt.Errorf("content %x not found", ref.hash)
+				} else if err == nil && !bytes.Equal(pageHash(data), ref.hash) {
+					err = fmt.Errorf("content doesn't match its hash %x", ref.hash)
+				}
+			}
+			if err != nil {
+				report("page %d: %s", off/pageSize+1, err)
+			} else if int64(len(data)) != pageSize {
+				report("page %d holds %d bytes", off/pageSize+1, len(data))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		header, err := v.storedPage(txn, name, 0)
+		if err != nil || len(header) < 100 {
+			report("first page is unreadable")
+			return nil
+		}
+		if size := headerPageSize(header); int64(size) != pageSize {
+			report("header page size %d doesn't match the stored page size %d", size, pageSize)
+		}
+		if pages := int64(binary.BigEndian.Uint32(header[28:32])); pages*pageSize != next {
+			report("header counts %d pages, the store holds %d", pages, next/pageSize)
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// GC deletes the contents in the local store of the named database that no page or page version refers to, in full
+// or as a delta base, after pruning the history Options.HistoryRetention doesn't keep. It returns the number of
+// contents deleted and the bytes they took up.
+func (v *VFS) GC(name string) (int, int64, error) {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadWrite, true)
+	if errors.Is(err, sqlite3vfs.CantOpenError) {
+		return 0, 0, fmt.Errorf("database %s not found", name)
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	txn, err := store.Begin(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if _, err = v.pruneHistory(txn, name, v.retention); err != nil {
+		return 0, 0, err
+	}
+
+	referenced := make(map[string]struct{})
+	reference := func(off int64, buf []byte) error {
+		if len(buf) == 0 {
+			return nil // a deleted version
+		}
+		ref, err := decodeRef(buf)
+		if err != nil {
+			return fmt.Errorf("decoding page at %d: %w", off, err)
+		}
+		if ref != nil {
+			referenced[string(ref.hash)] = struct{}{}
+			if ref.delta != nil {
+				referenced[string(ref.base)] = struct{}{}
+			}
+		}
+		return nil
+	}
+	if err = txn.ForEach(reference); err != nil {
+		return 0, 0, err
+	}
+	err = txn.ForEachVersion(func(off int64, rev int64, buf []byte) error {
+		return reference(off, buf)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var garbage [][]byte
+	freed := int64(0)
+	err = txn.ForEachContent(func(hash []byte, data []byte) error {
+		if _, ok := referenced[string(hash)]; !ok {
+			garbage = append(garbage, bytes.Clone(hash))
+			freed += int64(len(data))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, hash := range garbage {
+		if err = txn.DeleteContent(hash); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(garbage), freed, txn.Commit()
+}
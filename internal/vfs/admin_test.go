@@ -0,0 +1,151 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// writeDatabase commits pages after the first one along with a header counting them
+func writeDatabase(t *testing.T, vfsInstance *VFS, name string, contents ...string) {
+	file, _, err := vfsInstance.Open(name, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	lockForRead(t, file)
+	lockForWrite(t, file)
+	header := firstPageFor(SectorSize)
+	binary.BigEndian.PutUint32(header[28:32], uint32(len(contents)+1))
+	_, err = file.WriteAt(header, 0)
+	require.NoError(t, err)
+	for i, content := range contents {
+		_, err = file.WriteAt(sector(content), int64(i+1)*SectorSize)
+		require.NoError(t, err)
+	}
+	require.NoError(t, file.(*File).ConfirmCommit())
+	unlockForWrite(t, file)
+	unlockForRead(t, file)
+}
+
+func TestVFS_Info(t *testing.T) {
+	vfsInstance := makeVFS()
+	_, err := vfsInstance.Info("test.db")
+	assert.ErrorContains(t, err, "not found", "Inspecting a database shouldn't create it")
+
+	writeDatabase(t, vfsInstance, "test.db", "one", "two", "one")
+	info, err := vfsInstance.Info("test.db")
+	require.NoError(t, err)
+	assert.Equal(t, SectorSize, info.PageSize)
+	assert.Equal(t, int64(1), info.Revision)
+	assert.Equal(t, 4, info.Pages)
+	assert.Equal(t, int64(4*SectorSize), info.FileSize)
+	assert.Equal(t, 4, info.Contents, "The seeded first page, the header and two distinct pages")
+	assert.False(t, info.WAL)
+	assert.Empty(t, info.Segments)
+}
+
+func TestVFS_Pages(t *testing.T) {
+	vfsInstance := makeVFS()
+	writeDatabase(t, vfsInstance, "test.db", "one", "two")
+
+	pages, err := vfsInstance.Pages("test.db")
+	require.NoError(t, err)
+	require.Len(t, pages, 3)
+	assert.Equal(t, int64(SectorSize), pages[1].Offset)
+	assert.Equal(t, int64(1), pages[1].Revision)
+	assert.Equal(t, pageHash(sector("one")), pages[1].Hash)
+	assert.Nil(t, pages[1].Base)
+
+	page, err := vfsInstance.ReadPage("test.db", 2*SectorSize)
+	require.NoError(t, err)
+	assert.Equal(t, sector("two"), page)
+	_, err = vfsInstance.ReadPage("test.db", 3*SectorSize)
+	assert.Error(t, err)
+}
+
+func TestVFS_Verify(t *testing.T) {
+	stores := NewMemoryStores()
+	vfsInstance := makeVFS()
+	vfsInstance.openStore = stores.Open
+	writeDatabase(t, vfsInstance, "test.db", "one", "two")
+
+	problems, err := vfsInstance.Verify("test.db")
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	store, err := stores.Open("test.db", sqlite3vfs.OpenReadWrite)
+	require.NoError(t, err)
+	txn, err := store.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, txn.DeleteContent(pageHash(sector("two"))))
+	require.NoError(t, txn.Delete(SectorSize))
+	require.NoError(t, txn.Commit())
+
+	problems, err = vfsInstance.Verify("test.db")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"page 2 is missing",
+		fmt.Sprintf("page 3: content %x not found", pageHash(sector("two"))),
+	}, problems)
+}
+
+func TestVFS_Verify_CachedPage(t *testing.T) {
+	stores := NewMemoryStores()
+	vfsInstance := makeVFS()
+	vfsInstance.openStore = stores.Open
+	vfsInstance.pages = newPageCache(DefaultPageCacheSize)
+	writeDatabase(t, vfsInstance, "test.db", "one")
+	page, err := vfsInstance.ReadPage("test.db", SectorSize)
+	require.NoError(t, err)
+	assert.Equal(t, sector("one"), page)
+
+	store, err := stores.Open("test.db", sqlite3vfs.OpenReadWrite)
+	require.NoError(t, err)
+	txn, err := store.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, txn.PutContent(pageHash(sector("one")), encodeContent(CodecNone, sector("bad"))))
+	require.NoError(t, txn.Commit())
+
+	problems, err := vfsInstance.Verify("test.db")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		fmt.Sprintf("page 2: content doesn't match its hash %x", pageHash(sector("one"))),
+	}, problems, "Verify should read the stored content, not the cached page")
+}
+
+func TestVFS_GC(t *testing.T) {
+	stores := NewMemoryStores()
+	vfsInstance := makeVFS()
+	vfsInstance.openStore = stores.Open
+	writeDatabase(t, vfsInstance, "test.db", "one", "two")
+	writeDatabase(t, vfsInstance, "test.db", "uno", "two")
+	store, err := stores.Open("test.db", sqlite3vfs.OpenReadWrite)
+	require.NoError(t, err)
+	txn, err := store.Begin(true)
+	require.NoError(t, err)
+	_, err = storeContent(txn, sector("orphan"), CodecNone)
+	require.NoError(t, err)
+	require.NoError(t, txn.Commit())
+
+	deleted, freed, err := vfsInstance.GC("test.db")
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted, "The replaced page is still referenced by its version")
+	assert.Positive(t, freed)
+	old, err := vfsInstance.ReadPageAt("test.db", SectorSize, 1)
+	require.NoError(t, err)
+	assert.Equal(t, sector("one"), old)
+
+	problems, err := vfsInstance.Verify("test.db")
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	page, err := vfsInstance.ReadPage("test.db", SectorSize)
+	require.NoError(t, err)
+	assert.Equal(t, sector("uno"), page)
+
+	deleted, _, err = vfsInstance.GC("test.db")
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+}
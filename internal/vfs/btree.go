@@ -0,0 +1,465 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf16"
+)
+
+// btreeReader decodes the b-trees of a SQLite database file from its pages, as described in
+// https://www.sqlite.org/fileformat2.html. It only reads rowid tables, which is what change data capture needs.
+
+const (
+	btreeInteriorIndex = 0x02
+	btreeInteriorTable = 0x05
+	btreeLeafIndex     = 0x0a
+	btreeLeafTable     = 0x0d
+)
+
+// btreeMaxDepth bounds descents so a corrupt tree can't loop forever
+const btreeMaxDepth = 64
+
+var errCorruptBtree = errors.New("corrupt b-tree")
+
+type btreeReader struct {
+	read     func(pgno uint32) ([]byte, error) // nil for pages past the end of the database
+	pages    map[uint32][]byte
+	usable   int
+	encoding uint32 // text encoding: 1 UTF-8, 2 UTF-16le, 3 UTF-16be
+	header   []byte
+}
+
+// newBtreeReader reads the database header from the first page read returns, nil when the database has no first page
+func newBtreeReader(read func(pgno uint32) ([]byte, error)) (*btreeReader, error) {
+	r := &btreeReader{read: read, pages: make(map[uint32][]byte)}
+	header, err := r.page(1)
+	if err != nil || header == nil {
+		return nil, err
+	}
+	if len(header) < firstPageHeaderSize {
+		return nil, errCorruptBtree
+	}
+	r.header = header
+	r.usable = len(header) - int(header[20])
+	r.encoding = binary.BigEndian.Uint32(header[56:60])
+	if r.encoding == 0 {
+		r.encoding = 1
+	}
+	return r, nil
+}
+
+func (r *btreeReader) page(pgno uint32) ([]byte, error) {
+	if page, ok := r.pages[pgno]; ok {
+		return page, nil
+	}
+	page, err := r.read(pgno)
+	if err != nil {
+		return nil, err
+	}
+	r.pages[pgno] = page
+	return page, nil
+}
+
+// btreePage is a decoded b-tree page header
+type btreePage struct {
+	pgno  uint32
+	data  []byte
+	kind  byte
+	cells []int  // offsets of the cells in data
+	right uint32 // right-most child of interior pages
+}
+
+func (r *btreeReader) btreePage(pgno uint32) (*btreePage, error) {
+	data, err := r.page(pgno)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: page %d is missing", errCorruptBtree, pgno)
+	}
+	start := 0
+	if pgno == 1 {
+		start = 100
+	}
+	p := &btreePage{pgno: pgno, data: data, kind: data[start]}
+	headerSize := 8
+	switch p.kind {
+	case btreeInteriorIndex, btreeInteriorTable:
+		headerSize = 12
+		p.right = binary.BigEndian.Uint32(data[start+8:])
+	case btreeLeafIndex, btreeLeafTable:
+	default:
+		return nil, fmt.Errorf("%w: page %d has type %d", errCorruptBtree, pgno, p.kind)
+	}
+	count := int(binary.BigEndian.Uint16(data[start+3:]))
+	pointers := start + headerSize
+	if pointers+2*count > len(data) {
+		return nil, fmt.Errorf("%w: page %d has %d cells", errCorruptBtree, pgno, count)
+	}
+	p.cells = make([]int, count)
+	for i := range p.cells {
+		p.cells[i] = int(binary.BigEndian.Uint16(data[pointers+2*i:]))
+		if p.cells[i] >= len(data) {
+			return nil, fmt.Errorf("%w: cell %d of page %d is out of bounds", errCorruptBtree, i, pgno)
+		}
+	}
+	return p, nil
+}
+
+// pageKind returns the b-tree page type of a page, 0 when it isn't one
+func (r *btreeReader) pageKind(pgno uint32, data []byte) byte {
+	start := 0
+	if pgno == 1 {
+		start = 100
+	}
+	switch kind := data[start]; kind {
+	case btreeInteriorIndex, btreeInteriorTable, btreeLeafIndex, btreeLeafTable:
+		return kind
+	}
+	return 0
+}
+
+// interiorCell returns the left child and key of a cell of an interior table page
+func (p *btreePage) interiorCell(i int) (uint32, int64, error) {
+	off := p.cells[i]
+	if off+4 > len(p.data) {
+		return 0, 0, errCorruptBtree
+	}
+	key, n := readVarint(p.data[off+4:])
+	if n == 0 {
+		return 0, 0, errCorruptBtree
+	}
+	return binary.BigEndian.Uint32(p.data[off:]), key, nil
+}
+
+// leafRowID returns the rowid of a cell of a leaf table page
+func (p *btreePage) leafRowID(i int) (int64, error) {
+	data := p.data[p.cells[i]:]
+	_, n := readVarint(data)
+	rowid, m := readVarint(data[n:])
+	if n == 0 || m == 0 {
+		return 0, errCorruptBtree
+	}
+	return rowid, nil
+}
+
+// leafCell returns the rowid and payload of a cell of a leaf table page, and the overflow pages the payload was read from
+func (r *btreeReader) leafCell(p *btreePage, i int) (int64, []byte, []uint32, error) {
+	data := p.data[p.cells[i]:]
+	size, n := readVarint(data)
+	rowid, m := readVarint(data[n:])
+	if n == 0 || m == 0 || size < 0 || size > math.MaxInt32 {
+		return 0, nil, nil, errCorruptBtree
+	}
+	data = data[n+m:]
+
+	local := int(size)
+	maxLocal := r.usable - 35
+	if local > maxLocal {
+		minLocal := (r.usable-12)*32/255 - 23
+		local = minLocal + int((size-int64(minLocal))%int64(r.usable-4))
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if local > len(data) || (int64(local) < size && local+4 > len(data)) {
+		return 0, nil, nil, errCorruptBtree
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, data[:local]...)
+	var overflow []uint32
+	if int64(local) < size {
+		next := binary.BigEndian.Uint32(data[local:])
+		for int64(len(payload)) < size {
+			if next == 0 {
+				return 0, nil, nil, errCorruptBtree
+			}
+			page, err := r.page(next)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			if page == nil {
+				return 0, nil, nil, fmt.Errorf("%w: overflow page %d is missing", errCorruptBtree, next)
+			}
+			overflow = append(overflow, next)
+			chunk := page[4:r.usable]
+			if remaining := size - int64(len(payload)); int64(len(chunk)) > remaining {
+				chunk = chunk[:remaining]
+			}
+			payload = append(payload, chunk...)
+			next = binary.BigEndian.Uint32(page)
+		}
+	}
+	return rowid, payload, overflow, nil
+}
+
+// findLeaf returns the leaf page of the table b-tree at root that holds, or would hold, rowid
+func (r *btreeReader) findLeaf(root uint32, rowid int64) (*btreePage, error) {
+	pgno := root
+	for depth := 0; depth < btreeMaxDepth; depth++ {
+		p, err := r.btreePage(pgno)
+		if err != nil {
+			return nil, err
+		}
+		switch p.kind {
+		case btreeLeafTable:
+			return p, nil
+		case btreeInteriorTable:
+		default:
+			return nil, fmt.Errorf("%w: page %d of a table has type %d", errCorruptBtree, pgno, p.kind)
+		}
+		pgno = p.right
+		// Cells are in key order, and the child of a cell holds the rowids up to its key
+		for i := range p.cells {
+			child, key, err := p.interiorCell(i)
+			if err != nil {
+				return nil, err
+			}
+			if rowid <= key {
+				pgno = child
+				break
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: table at page %d is too deep", errCorruptBtree, root)
+}
+
+// ownsLeaf reports whether the leaf table page p belongs to the table b-tree at root
+func (r *btreeReader) ownsLeaf(root uint32, p *btreePage) (bool, error) {
+	if p.pgno == root {
+		return true, nil
+	}
+	if len(p.cells) == 0 {
+		return false, nil // Only the root of a table may be empty
+	}
+	rowid, err := p.leafRowID(0)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := r.findLeaf(root, rowid)
+	if err != nil {
+		return false, err
+	}
+	return leaf.pgno == p.pgno, nil
+}
+
+// lookup returns the payload of the row of the table at root with the given rowid, nil if there is none
+func (r *btreeReader) lookup(root uint32, rowid int64) ([]byte, error) {
+	leaf, err := r.findLeaf(root, rowid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range leaf.cells {
+		id, err := leaf.leafRowID(i)
+		if err != nil {
+			return nil, err
+		}
+		if id == rowid {
+			_, payload, _, err := r.leafCell(leaf, i)
+			return payload, err
+		}
+	}
+	return nil, nil
+}
+
+// scanTable calls fn with every leaf page of the table b-tree at root, in rowid order
+func (r *btreeReader) scanTable(root uint32, fn func(leaf *btreePage) error) error {
+	var visit func(pgno uint32, depth int) error
+	visit = func(pgno uint32, depth int) error {
+		if depth >= btreeMaxDepth {
+			return fmt.Errorf("%w: table at page %d is too deep", errCorruptBtree, root)
+		}
+		p, err := r.btreePage(pgno)
+		if err != nil {
+			return err
+		}
+		switch p.kind {
+		case btreeLeafTable:
+			return fn(p)
+		case btreeInteriorTable:
+		default:
+			return fmt.Errorf("%w: page %d of a table has type %d", errCorruptBtree, pgno, p.kind)
+		}
+		for i := range p.cells {
+			child, _, err := p.interiorCell(i)
+			if err != nil {
+				return err
+			}
+			if err = visit(child, depth+1); err != nil {
+				return err
+			}
+		}
+		return visit(p.right, depth+1)
+	}
+	return visit(root, 0)
+}
+
+// tables returns the root pages of the rowid tables of the database by name, sqlite_schema included
+func (r *btreeReader) tables() (map[string]uint32, error) {
+	tables := map[string]uint32{"sqlite_schema": 1}
+	err := r.scanTable(1, func(leaf *btreePage) error {
+		for i := range leaf.cells {
+			_, payload, _, err := r.leafCell(leaf, i)
+			if err != nil {
+				return err
+			}
+			values, err := r.decodeRecord(payload)
+			if err != nil {
+				return err
+			}
+			if len(values) < 4 || values[0] != "table" {
+				continue
+			}
+			name, _ := values[1].(string)
+			root, _ := values[3].(int64)
+			if root <= 0 || root > math.MaxUint32 {
+				continue // Virtual tables have no b-tree
+			}
+			data, err := r.page(uint32(root))
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				return fmt.Errorf("%w: root page %d of %s is missing", errCorruptBtree, root, name)
+			}
+			if kind := r.pageKind(uint32(root), data); kind == btreeLeafTable || kind == btreeInteriorTable {
+				tables[name] = uint32(root) // WITHOUT ROWID tables are index b-trees, they're skipped
+			}
+		}
+		return nil
+	})
+	return tables, err
+}
+
+// freePages returns the pages on the freelist
+func (r *btreeReader) freePages() (map[uint32]struct{}, error) {
+	free := make(map[uint32]struct{})
+	trunk := binary.BigEndian.Uint32(r.header[32:36])
+	total := int(binary.BigEndian.Uint32(r.header[36:40]))
+	for trunk != 0 && len(free) < total {
+		if _, ok := free[trunk]; ok {
+			return nil, fmt.Errorf("%w: freelist loops at page %d", errCorruptBtree, trunk)
+		}
+		page, err := r.page(trunk)
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			return nil, fmt.Errorf("%w: freelist page %d is missing", errCorruptBtree, trunk)
+		}
+		free[trunk] = struct{}{}
+		count := int(binary.BigEndian.Uint32(page[4:8]))
+		if 8+4*count > len(page) {
+			return nil, fmt.Errorf("%w: freelist page %d has %d leaves", errCorruptBtree, trunk, count)
+		}
+		for i := 0; i < count; i++ {
+			free[binary.BigEndian.Uint32(page[8+4*i:])] = struct{}{}
+		}
+		trunk = binary.BigEndian.Uint32(page)
+	}
+	return free, nil
+}
+
+// isPointerMap reports whether pgno is a pointer map page of an auto-vacuum database
+func (r *btreeReader) isPointerMap(pgno uint32) bool {
+	if binary.BigEndian.Uint32(r.header[52:56]) == 0 || pgno < 2 {
+		return false
+	}
+	perMap := uint32(r.usable/5 + 1)
+	return (pgno-2)%perMap == 0
+}
+
+// decodeRecord decodes a record into its column values: nil, int64, float64, string or []byte
+func (r *btreeReader) decodeRecord(payload []byte) ([]any, error) {
+	headerSize, n := readVarint(payload)
+	if n == 0 || headerSize < int64(n) || headerSize > int64(len(payload)) {
+		return nil, fmt.Errorf("%w: invalid record header", errCorruptBtree)
+	}
+	header := payload[n:headerSize]
+	body := payload[headerSize:]
+	var values []any
+	for len(header) > 0 {
+		serial, n := readVarint(header)
+		if n == 0 {
+			return nil, fmt.Errorf("%w: invalid record header", errCorruptBtree)
+		}
+		header = header[n:]
+		size := serialSize(serial)
+		if size > int64(len(body)) {
+			return nil, fmt.Errorf("%w: record is truncated", errCorruptBtree)
+		}
+		data := body[:size]
+		body = body[size:]
+		switch {
+		case serial == 0:
+			values = append(values, nil)
+		case serial >= 1 && serial <= 6:
+			// Big endian two's complement integers of 1, 2, 3, 4, 6 and 8 bytes
+			v := int64(int8(data[0]))
+			for _, b := range data[1:] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serial == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case serial == 8 || serial == 9:
+			values = append(values, serial-8)
+		case serial >= 12 && serial%2 == 0:
+			values = append(values, append([]byte{}, data...))
+		case serial >= 13:
+			values = append(values, r.decodeText(data))
+		default:
+			return nil, fmt.Errorf("%w: reserved serial type %d", errCorruptBtree, serial)
+		}
+	}
+	return values, nil
+}
+
+func serialSize(serial int64) int64 {
+	switch {
+	case serial >= 12:
+		return (serial - 12) / 2
+	case serial == 5:
+		return 6
+	case serial == 6 || serial == 7:
+		return 8
+	case serial >= 1 && serial <= 4:
+		return serial
+	}
+	return 0
+}
+
+func (r *btreeReader) decodeText(data []byte) string {
+	if r.encoding == 1 {
+		return string(data)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if r.encoding == 3 {
+		order = binary.BigEndian
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// readVarint decodes a SQLite variable length integer, n is 0 when buf is too short
+func readVarint(buf []byte) (v int64, n int) {
+	var u uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(buf) {
+			return 0, 0
+		}
+		if i == 8 {
+			return int64(u<<8 | uint64(buf[i])), 9
+		}
+		u = u<<7 | uint64(buf[i]&0x7f)
+		if buf[i]&0x80 == 0 {
+			return int64(u), i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,345 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Change data capture turns the commits of a database into row changes. A commit only records the pages it wrote (see
+// changelog.go), the rows it changed are found by decoding those pages at the revision before the commit and at its
+// revision, which history keeps (see history.go):
+//
+//   - written table leaf pages are matched to their table by looking up their first rowid from each table's root
+//   - the rows of those leaves are compared, by rowid, with the row of the same rowid in the other revision
+//   - rows overwritten in place can change only their overflow pages, when the commit wrote overflow pages no row on
+//     its leaves reads, every row with overflow pages is scanned to find them
+//
+// Changes are reported for rowid tables, sqlite_schema included, while WITHOUT ROWID tables and indexes are skipped.
+// Rows of a dropped table aren't reported. Column values are as stored in the record: a column aliasing the rowid is
+// NULL, use RowID, and a record written before a column was added lacks it.
+//
+// A Capture delivers the changes of each commit to its sink after the commit, in revision order. A commit is delivered
+// again when its sink returns an error, so sinks get every commit at least once and can deduplicate by revision.
+
+// ChangeOp is the kind of change made to a row
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "insert"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// RowChange describes a change a commit made to a row. Values are nil, int64, float64, string or []byte.
+type RowChange struct {
+	Database string    `json:"database"`
+	Revision int64     `json:"revision"`
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id,omitempty"`
+	Table    string    `json:"table"`
+	Op       ChangeOp  `json:"op"`
+	RowID    int64     `json:"rowid"`
+	Before   []any     `json:"before,omitempty"` // column values before an update or a delete
+	After    []any     `json:"after,omitempty"`  // column values after an insert or an update
+}
+
+// ChangeSink receives the row changes of each commit
+type ChangeSink interface {
+	// Send delivers the changes of one commit, ctx is cancelled when the Capture is closed
+	Send(ctx context.Context, changes []RowChange) error
+	Close() error
+}
+
+// errHistoryMissing is returned for commits whose previous revision isn't kept
+var errHistoryMissing = errors.New("history isn't kept")
+
+// Capture delivers the row changes of a database to a sink until it is closed
+type Capture struct {
+	follower *follower
+	sink     ChangeSink
+}
+
+// CaptureChanges starts delivering the row changes of every commit to the named database after revision from to sink.
+// The Capture keeps the database's store open until it is closed, which closes the sink.
+func (v *VFS) CaptureChanges(name string, from int64, sink ChangeSink) (*Capture, error) {
+	c := &Capture{sink: sink}
+	var err error
+	c.follower, err = v.follow(name, from, c.deliver)
+	if err != nil {
+		return nil, err
+	}
+	c.follower.start()
+	return c, nil
+}
+
+// Revision returns the revision of the last commit delivered
+func (c *Capture) Revision() int64 {
+	return c.follower.revision.Load()
+}
+
+// Close stops the Capture, waiting for a delivery in progress to be cancelled, and closes its sink
+func (c *Capture) Close() error {
+	c.follower.close()
+	return c.sink.Close()
+}
+
+// deliver sends the changes of a commit to the sink
+func (c *Capture) deliver(ctx context.Context, entry ChangelogEntry) error {
+	changes, err := c.changes(entry)
+	if errors.Is(err, errCorruptBtree) || errors.Is(err, errHistoryMissing) {
+		// Retrying won't help, skip the commit rather than stopping the capture
+		c.follower.vfs.logger.Error().Err(err).Str("db", c.follower.name).Int64("revision", entry.Revision).Msg("skipping the changes of a commit")
+		return nil
+	} else if err != nil || len(changes) == 0 {
+		return err
+	}
+	return c.sink.Send(ctx, changes)
+}
+
+func (c *Capture) changes(entry ChangelogEntry) ([]RowChange, error) {
+	txn, err := c.follower.store.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if start, ok := historyStart(txn); !ok || entry.Revision <= start {
+		return nil, fmt.Errorf("%w before revision %d", errHistoryMissing, entry.Revision)
+	}
+	return c.follower.vfs.commitChanges(txn, c.follower.name, entry)
+}
+
+// btreeReaderAt returns a reader of the database as it was at revision rev, nil if it had no first page
+func (v *VFS) btreeReaderAt(txn PageTxn, name string, rev int64) (*btreeReader, error) {
+	first, err := v.versionPage(txn, name, 0, rev)
+	if err != nil || first == nil {
+		return nil, err
+	}
+	pageSize := int64(len(first))
+	return newBtreeReader(func(pgno uint32) ([]byte, error) {
+		if pgno == 1 {
+			return first, nil
+		}
+		return v.versionPage(txn, name, int64(pgno-1)*pageSize, rev)
+	})
+}
+
+type rowKey struct {
+	table string
+	rowid int64
+}
+
+// commitState is the database at one side of a commit
+type commitState struct {
+	reader   *btreeReader
+	tables   map[string]uint32
+	written  []uint32            // pages the commit wrote
+	rows     map[rowKey][]byte   // payloads of the rows on the written table leaves
+	overflow map[uint32]struct{} // overflow pages of those rows
+}
+
+func (v *VFS) commitState(txn PageTxn, name string, rev int64, offsets []int64) (*commitState, error) {
+	s := &commitState{
+		tables:   make(map[string]uint32),
+		rows:     make(map[rowKey][]byte),
+		overflow: make(map[uint32]struct{}),
+	}
+	var err error
+	if s.reader, err = v.btreeReaderAt(txn, name, rev); err != nil || s.reader == nil {
+		return s, err
+	}
+	if s.tables, err = s.reader.tables(); err != nil {
+		return nil, err
+	}
+	pageSize := int64(len(s.reader.header))
+	for _, off := range offsets {
+		if off%pageSize == 0 {
+			s.written = append(s.written, uint32(off/pageSize+1))
+		}
+	}
+	for _, pgno := range s.written {
+		data, err := s.reader.page(pgno)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil || s.reader.pageKind(pgno, data) != btreeLeafTable {
+			continue
+		}
+		leaf, err := s.reader.btreePage(pgno)
+		if err != nil {
+			return nil, err
+		}
+		for table, root := range s.tables {
+			owns, err := s.reader.ownsLeaf(root, leaf)
+			if err != nil {
+				return nil, err
+			}
+			if owns {
+				err = s.addRows(table, leaf, nil)
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	return s, nil
+}
+
+// addRows adds the rows of a leaf, or only those with an overflow page in only when it is set
+func (s *commitState) addRows(table string, leaf *btreePage, only map[uint32]struct{}) error {
+	for i := range leaf.cells {
+		rowid, payload, overflow, err := s.reader.leafCell(leaf, i)
+		if err != nil {
+			return err
+		}
+		if only != nil && !anyPage(overflow, only) {
+			continue
+		}
+		s.rows[rowKey{table, rowid}] = payload
+		for _, pgno := range overflow {
+			s.overflow[pgno] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func anyPage(pages []uint32, set map[uint32]struct{}) bool {
+	for _, pgno := range pages {
+		if _, ok := set[pgno]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addOverwritten adds the rows whose overflow pages were written while their leaf wasn't
+func (s *commitState) addOverwritten() error {
+	if s.reader == nil {
+		return nil
+	}
+	free, err := s.reader.freePages()
+	if err != nil {
+		return err
+	}
+	unexplained := make(map[uint32]struct{})
+	for _, pgno := range s.written {
+		data, err := s.reader.page(pgno)
+		if err != nil {
+			return err
+		}
+		if data == nil || pgno == 1 || s.reader.pageKind(pgno, data) != 0 || s.reader.isPointerMap(pgno) {
+			continue
+		}
+		_, overflow := s.overflow[pgno]
+		_, freed := free[pgno]
+		if !overflow && !freed {
+			unexplained[pgno] = struct{}{}
+		}
+	}
+	if len(unexplained) == 0 {
+		return nil
+	}
+	for table, root := range s.tables {
+		err = s.reader.scanTable(root, func(leaf *btreePage) error {
+			return s.addRows(table, leaf, unexplained)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// row returns the payload of a row, looking it up when it isn't on a written leaf, nil if there is none
+func (s *commitState) row(key rowKey) ([]byte, error) {
+	if payload, ok := s.rows[key]; ok {
+		return payload, nil
+	}
+	root, ok := s.tables[key.table]
+	if !ok || s.reader == nil {
+		return nil, nil
+	}
+	return s.reader.lookup(root, key.rowid)
+}
+
+// commitChanges decodes the row changes of a commit from the versions of the pages it wrote
+func (v *VFS) commitChanges(txn PageTxn, name string, entry ChangelogEntry) ([]RowChange, error) {
+	before, err := v.commitState(txn, name, entry.Revision-1, entry.Offsets)
+	if err != nil {
+		return nil, err
+	}
+	after, err := v.commitState(txn, name, entry.Revision, entry.Offsets)
+	if err != nil {
+		return nil, err
+	}
+	if err = after.addOverwritten(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]rowKey, 0, len(before.rows)+len(after.rows))
+	for key := range before.rows {
+		keys = append(keys, key)
+	}
+	for key := range after.rows {
+		if _, ok := before.rows[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].table != keys[j].table {
+			return keys[i].table < keys[j].table
+		}
+		return keys[i].rowid < keys[j].rowid
+	})
+
+	var changes []RowChange
+	for _, key := range keys {
+		if _, ok := after.tables[key.table]; !ok {
+			continue // Dropped tables only report their schema row
+		}
+		old, err := before.row(key)
+		if err != nil {
+			return nil, err
+		}
+		current, err := after.row(key)
+		if err != nil {
+			return nil, err
+		}
+		change := RowChange{
+			Database: name,
+			Revision: entry.Revision,
+			Time:     entry.Time,
+			ClientID: entry.ClientID,
+			Table:    key.table,
+			RowID:    key.rowid,
+		}
+		switch {
+		case old == nil && current == nil:
+			continue
+		case old == nil:
+			change.Op = ChangeInsert
+		case current == nil:
+			change.Op = ChangeDelete
+		case bytes.Equal(old, current):
+			continue
+		default:
+			change.Op = ChangeUpdate
+		}
+		if old != nil {
+			if change.Before, err = before.reader.decodeRecord(old); err != nil {
+				return nil, err
+			}
+		}
+		if current != nil {
+			if change.After, err = after.reader.decodeRecord(current); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
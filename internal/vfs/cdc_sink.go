@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// ChannelSink delivers row changes on a channel, which is closed with the sink. Sends block until the changes are
+// received, so a slow reader holds back the capture rather than losing changes.
+type ChannelSink struct {
+	changes chan RowChange
+}
+
+// NewChannelSink returns a ChannelSink whose channel buffers size changes
+func NewChannelSink(size int) *ChannelSink {
+	return &ChannelSink{changes: make(chan RowChange, size)}
+}
+
+// Changes returns the channel the changes are delivered on
+func (s *ChannelSink) Changes() <-chan RowChange {
+	return s.changes
+}
+
+func (s *ChannelSink) Send(ctx context.Context, changes []RowChange) error {
+	for _, change := range changes {
+		select {
+		case s.changes <- change:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *ChannelSink) Close() error {
+	close(s.changes)
+	return nil
+}
+
+// JSONLSink appends row changes to a file as JSON, one change per line. Blobs are base64 encoded. The file is synced
+// after each commit, a commit delivered again after a failure may be written twice.
+type JSONLSink struct {
+	file *os.File
+}
+
+// OpenJSONLSink opens the file at path for appending, creating it if needed
+func OpenJSONLSink(path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{file: file}, nil
+}
+
+func (s *JSONLSink) Send(ctx context.Context, changes []RowChange) error {
+	w := bufio.NewWriter(s.file)
+	encoder := json.NewEncoder(w)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *JSONLSink) Close() error {
+	return s.file.Close()
+}
+
+// WebhookSink posts the row changes of each commit to a URL as a JSON array. Any response status other than 2xx is an
+// error, and the commit is posted again later.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink posting to url with client, http.DefaultClient when nil
+func NewWebhookSink(url string, client *http.Client) *WebhookSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebhookSink{url: url, client: client}
+}
+
+func (s *WebhookSink) Send(ctx context.Context, changes []RowChange) error {
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,197 @@
+package vfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// openCaptureDatabase registers a VFS keeping history under vfsName and opens a connection to test.db through it
+func openCaptureDatabase(t *testing.T, vfsName string) (*VFS, *sqlite3vfs.Conn) {
+	logger := zerolog.Nop()
+	vfsInstance, err := NewVFS(Options{DataDir: t.TempDir(), TmpDir: t.TempDir(), Logger: &logger})
+	require.NoError(t, err)
+	require.NoError(t, sqlite3vfs.RegisterVFS(vfsName, vfsInstance))
+	t.Cleanup(func() {
+		require.NoError(t, sqlite3vfs.UnregisterVFS(vfsName))
+	})
+	conn, err := sqlite3vfs.OpenConn("file:test.db?client_id=app&vfs=" + vfsName)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return vfsInstance, conn
+}
+
+func receive(t *testing.T, sink *ChannelSink, n int) []RowChange {
+	var changes []RowChange
+	timeout := time.After(10 * time.Second)
+	for len(changes) < n {
+		select {
+		case change := <-sink.Changes():
+			changes = append(changes, change)
+		case <-timeout:
+			require.Fail(t, "timed out waiting for changes", "got %d of %d", len(changes), n)
+		}
+	}
+	return changes
+}
+
+func TestCaptureChanges(t *testing.T) {
+	vfsInstance, conn := openCaptureDatabase(t, "skylite-cdc")
+	sink := NewChannelSink(16)
+	capture, err := vfsInstance.CaptureChanges("test.db", 0, sink)
+	require.NoError(t, err)
+	defer capture.Close()
+
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT, score REAL, data BLOB)"))
+	changes := receive(t, sink, 1)
+	assert.Equal(t, "sqlite_schema", changes[0].Table)
+	assert.Equal(t, ChangeInsert, changes[0].Op)
+	assert.Equal(t, "t", changes[0].After[1])
+	assert.Equal(t, "app", changes[0].ClientID)
+	assert.Equal(t, "test.db", changes[0].Database)
+
+	require.NoError(t, conn.Exec("INSERT INTO t VALUES (1, 'ann', 1.5, x'0102'), (2, 'bob', NULL, NULL), (3, 'cy', -7, 'text')"))
+	changes = receive(t, sink, 3)
+	assert.Equal(t, RowChange{
+		Database: "test.db", Revision: changes[0].Revision, Time: changes[0].Time, ClientID: "app",
+		Table: "t", Op: ChangeInsert, RowID: 1, After: []any{nil, "ann", 1.5, []byte{1, 2}},
+	}, changes[0])
+	assert.Equal(t, []any{nil, "bob", nil, nil}, changes[1].After)
+	assert.Equal(t, []any{nil, "cy", int64(-7), "text"}, changes[2].After, "Values keep the type they're stored with")
+
+	require.NoError(t, conn.Exec("UPDATE t SET name = 'bobby' WHERE id = 2; DELETE FROM t WHERE id = 3"))
+	changes = receive(t, sink, 2)
+	assert.Equal(t, ChangeUpdate, changes[0].Op)
+	assert.Equal(t, int64(2), changes[0].RowID)
+	assert.Equal(t, []any{nil, "bob", nil, nil}, changes[0].Before)
+	assert.Equal(t, []any{nil, "bobby", nil, nil}, changes[0].After)
+	assert.Equal(t, RowChange{
+		Database: "test.db", Revision: changes[1].Revision, Time: changes[1].Time, ClientID: "app",
+		Table: "t", Op: ChangeDelete, RowID: 3, Before: []any{nil, "cy", int64(-7), "text"},
+	}, changes[1])
+
+	// Splitting leaves moves rows between pages, which must not look like changes to them
+	require.NoError(t, conn.Exec("WITH RECURSIVE n(i) AS (SELECT 10 UNION ALL SELECT i + 1 FROM n WHERE i < 509) INSERT INTO t (id, name) SELECT i, printf('row %d', i) FROM n"))
+	changes = receive(t, sink, 500)
+	for i, change := range changes {
+		assert.Equal(t, ChangeInsert, change.Op)
+		assert.Equal(t, int64(10+i), change.RowID)
+	}
+
+	// A row overwritten with a value of the same size only writes the overflow page that changed
+	require.NoError(t, conn.Exec("INSERT INTO t (id, name) VALUES (1000, printf('%.*c', 20000, 'x'))"))
+	changes = receive(t, sink, 1)
+	assert.Equal(t, int64(1000), changes[0].RowID)
+	require.NoError(t, conn.Exec("UPDATE t SET name = printf('%.*c', 19999, 'x') || 'y' WHERE id = 1000"))
+	changes = receive(t, sink, 1)
+	assert.Equal(t, ChangeUpdate, changes[0].Op)
+	assert.Equal(t, int64(1000), changes[0].RowID)
+	assert.True(t, strings.HasSuffix(changes[0].After[1].(string), "xy"))
+
+	require.NoError(t, conn.Exec("DROP TABLE t"))
+	changes = receive(t, sink, 1)
+	assert.Equal(t, "sqlite_schema", changes[0].Table, "Rows of dropped tables aren't reported")
+	assert.Equal(t, ChangeDelete, changes[0].Op)
+
+	info, err := vfsInstance.Info("test.db")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return capture.Revision() == info.Revision }, 5*time.Second, 10*time.Millisecond)
+	select {
+	case change := <-sink.Changes():
+		assert.Fail(t, "unexpected change", "%+v", change)
+	default:
+	}
+}
+
+func TestCaptureChanges_JSONL(t *testing.T) {
+	vfsInstance, conn := openCaptureDatabase(t, "skylite-cdc-jsonl")
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)"))
+	info, err := vfsInstance.Info("test.db")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "changes.jsonl")
+	sink, err := OpenJSONLSink(path)
+	require.NoError(t, err)
+	capture, err := vfsInstance.CaptureChanges("test.db", info.Revision, sink)
+	require.NoError(t, err)
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('one'), ('two')"))
+	require.NoError(t, conn.Exec("UPDATE t SET v = 'uno' WHERE id = 1"))
+	assert.Eventually(t, func() bool { return capture.Revision() == info.Revision+2 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, capture.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var lines []map[string]any
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "insert", lines[0]["op"])
+	assert.Equal(t, []any{nil, "two"}, lines[1]["after"])
+	assert.Equal(t, "update", lines[2]["op"])
+	assert.Equal(t, []any{nil, "one"}, lines[2]["before"])
+	assert.Equal(t, float64(info.Revision+2), lines[2]["revision"])
+}
+
+func TestCaptureChanges_Webhook(t *testing.T) {
+	var mutex sync.Mutex
+	var posts [][]RowChange
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var changes []RowChange
+		require.NoError(t, json.Unmarshal(body, &changes))
+		posts = append(posts, changes)
+	}))
+	defer server.Close()
+
+	vfsInstance, conn := openCaptureDatabase(t, "skylite-cdc-webhook")
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)"))
+	info, err := vfsInstance.Info("test.db")
+	require.NoError(t, err)
+	capture, err := vfsInstance.CaptureChanges("test.db", info.Revision, NewWebhookSink(server.URL, nil))
+	require.NoError(t, err)
+	defer capture.Close()
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('one'), ('two')"))
+	require.NoError(t, conn.Exec("DELETE FROM t WHERE id = 2"))
+
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(posts) == 2
+	}, 10*time.Second, 10*time.Millisecond, "A failed post should be retried")
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, posts[0], 2, "The changes of a commit are posted together")
+	assert.Equal(t, info.Revision+1, posts[0][0].Revision)
+	assert.Equal(t, ChangeInsert, posts[0][1].Op)
+	require.Len(t, posts[1], 1)
+	assert.Equal(t, ChangeDelete, posts[1][0].Op)
+	assert.Equal(t, int64(2), posts[1][0].RowID)
+}
@@ -0,0 +1,252 @@
+package vfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// Every commit appends an entry to the changelog of its database, kept in the store as the commit record of its
+// revision (see PageTxn.PutCommit). The entry holds the time of the commit, the offsets of the pages it wrote or
+// deleted and the client id of the connection that made it, given with the client_id URI parameter or
+// Options.ClientID. Commits to the WAL are recorded when they're checkpointed, by the connection checkpointing them.
+//
+// With a coordinator, commits made by other processes are recorded as the store catches up, with the time and client
+// id the coordinator holds for them. A store that caught up without the coordinator's commit history records a single
+// entry for the revision it caught up to, listing every page it read.
+
+// ChangelogEntry describes a commit to a database
+type ChangelogEntry struct {
+	Revision int64
+	Time     time.Time // when the commit was made
+	Offsets  []int64   // offsets of the pages written or deleted, in ascending order
+	ClientID string    // empty when the connection had none
+}
+
+// commit record layout, big endian: [unix nanoseconds uint64][offset count uint32][offsets uint64...][client id]
+const commitRecordSize = 12
+
+func encodeCommitRecord(entry ChangelogEntry) []byte {
+	buf := make([]byte, 0, commitRecordSize+8*len(entry.Offsets)+len(entry.ClientID))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(entry.Time.UnixNano()))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(entry.Offsets)))
+	for _, off := range entry.Offsets {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(off))
+	}
+	return append(buf, entry.ClientID...)
+}
+
+func decodeCommitRecord(rev int64, record []byte) ChangelogEntry {
+	entry := ChangelogEntry{Revision: rev, Time: commitTime(record)}
+	if len(record) < commitRecordSize {
+		return entry
+	}
+	count := int(binary.BigEndian.Uint32(record[8:]))
+	end := commitRecordSize + 8*count
+	if end > len(record) {
+		return entry
+	}
+	entry.Offsets = make([]int64, count)
+	for i := range entry.Offsets {
+		entry.Offsets[i] = int64(binary.BigEndian.Uint64(record[commitRecordSize+8*i:]))
+	}
+	entry.ClientID = string(record[end:])
+	return entry
+}
+
+func commitTime(record []byte) time.Time {
+	if len(record) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(record)))
+}
+
+// sortedOffsets returns the offsets of a write set in ascending order
+func sortedOffsets(written map[int64]struct{}) []int64 {
+	offsets := make([]int64, 0, len(written))
+	for off := range written {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+// pointerOffsets returns the offsets of pointers in ascending order
+func pointerOffsets(pointers []coordinator.Pointer) []int64 {
+	offsets := make([]int64, len(pointers))
+	for i, p := range pointers {
+		offsets[i] = p.Offset
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+// Changelog calls fn with every commit to the named database with a revision >= from, in revision order, stopping at
+// the first error fn returns. Commits that predate history (see history.go) have no entry. With a coordinator, commits
+// made by other processes are listed once this process has caught up with them.
+func (v *VFS) Changelog(name string, from int64, fn func(ChangelogEntry) error) error {
+	return v.inspect(name, func(txn PageTxn) error {
+		return txn.ForEachCommit(from, func(rev int64, record []byte) error {
+			return fn(decodeCommitRecord(rev, record))
+		})
+	})
+}
+
+// followPollInterval is how often a follower looks for commits it wasn't notified of, made by other VFS instances or
+// other processes, and retries a failed entry
+const followPollInterval = time.Second
+
+// followBatchSize bounds the changelog entries a follower reads at once
+const followBatchSize = 64
+
+// follower calls handle with every changelog entry of a database after a revision, in revision order, as commits are
+// recorded. An entry handle fails for is handled again later, revision is the last one handled.
+type follower struct {
+	vfs      *VFS
+	name     string
+	store    PageStore
+	release  func()
+	handle   func(ctx context.Context, entry ChangelogEntry) error
+	wake     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+	revision atomic.Int64
+}
+
+// follow returns a follower of the changelog of the named database after revision from, keeping its store open. It
+// handles entries once started.
+func (v *VFS) follow(name string, from int64, handle func(ctx context.Context, entry ChangelogEntry) error) (*follower, error) {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadWrite, true)
+	if errors.Is(err, sqlite3vfs.CantOpenError) {
+		return nil, fmt.Errorf("database %s not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		vfs:     v,
+		name:    name,
+		store:   store,
+		release: release,
+		handle:  handle,
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+	f.revision.Store(from)
+
+	v.followMutex.Lock()
+	if v.followers == nil {
+		v.followers = make(map[string]map[*follower]struct{})
+	}
+	if v.followers[name] == nil {
+		v.followers[name] = make(map[*follower]struct{})
+	}
+	v.followers[name][f] = struct{}{}
+	v.followMutex.Unlock()
+	return f, nil
+}
+
+func (f *follower) start() {
+	go f.run()
+}
+
+// close stops the follower, cancelling the entry being handled, and releases the store
+func (f *follower) close() {
+	f.cancel()
+	<-f.stopped
+	f.vfs.followMutex.Lock()
+	delete(f.vfs.followers[f.name], f)
+	if len(f.vfs.followers[f.name]) == 0 {
+		delete(f.vfs.followers, f.name)
+	}
+	f.vfs.followMutex.Unlock()
+	f.release()
+}
+
+// notifyCommit wakes the followers of a database, and those waiting for a revision of it, after a commit to it
+func (v *VFS) notifyCommit(name string) {
+	v.followMutex.Lock()
+	defer v.followMutex.Unlock()
+	if signal, ok := v.commitSignals[name]; ok {
+		close(signal)
+		delete(v.commitSignals, name)
+	}
+	for f := range v.followers[name] {
+		select {
+		case f.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (f *follower) run() {
+	defer close(f.stopped)
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := f.handleNew(); err != nil && f.ctx.Err() == nil {
+			f.vfs.logger.Warn().Err(err).Str("db", f.name).Int64("revision", f.revision.Load()).Msg("error following changelog, retrying")
+		}
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-f.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleNew handles every entry after the last one handled
+func (f *follower) handleNew() error {
+	if f.vfs.coordinator != nil {
+		if err := f.vfs.catchUp(f.store, f.name); err != nil {
+			return err
+		}
+	}
+	for {
+		entries, err := f.pending()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = f.handle(f.ctx, entry); err != nil {
+				return err
+			}
+			f.revision.Store(entry.Revision)
+		}
+		if len(entries) < followBatchSize {
+			return nil
+		}
+	}
+}
+
+// pending returns the changelog entries after the last one handled
+func (f *follower) pending() ([]ChangelogEntry, error) {
+	txn, err := f.store.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	var entries []ChangelogEntry
+	err = txn.ForEachCommit(f.revision.Load()+1, func(rev int64, record []byte) error {
+		entries = append(entries, decodeCommitRecord(rev, record))
+		if len(entries) == followBatchSize {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return nil, err
+	}
+	return entries, nil
+}
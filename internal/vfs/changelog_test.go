@@ -0,0 +1,92 @@
+package vfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func changelog(t *testing.T, vfsInstance *VFS, name string, from int64) []ChangelogEntry {
+	var entries []ChangelogEntry
+	require.NoError(t, vfsInstance.Changelog(name, from, func(entry ChangelogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}))
+	return entries
+}
+
+func TestVFS_Changelog(t *testing.T) {
+	vfsInstance := makeVFS()
+	vfsInstance.clientID = "admin"
+	before := time.Now()
+	writeDatabase(t, vfsInstance, "test.db", "one", "two")
+
+	file, _, err := vfsInstance.Open("test.db?client_id=worker", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{3 * SectorSize: "four", SectorSize: "uno"})
+	unlockForRead(t, file)
+
+	entries := changelog(t, vfsInstance, "test.db", 0)
+	require.Len(t, entries, 2)
+	assert.Equal(t, int64(1), entries[0].Revision)
+	assert.Equal(t, []int64{0, SectorSize, 2 * SectorSize}, entries[0].Offsets)
+	assert.Equal(t, "admin", entries[0].ClientID, "Commits should default to the VFS's client id")
+	assert.False(t, entries[0].Time.Before(before.Truncate(time.Second)))
+	assert.Equal(t, int64(2), entries[1].Revision)
+	assert.Equal(t, []int64{SectorSize, 3 * SectorSize}, entries[1].Offsets)
+	assert.Equal(t, "worker", entries[1].ClientID)
+	assert.False(t, entries[1].Time.Before(entries[0].Time))
+
+	assert.Equal(t, entries[1:], changelog(t, vfsInstance, "test.db", 2))
+	assert.Empty(t, changelog(t, vfsInstance, "test.db", 3))
+	stop := errors.New("stop")
+	calls := 0
+	err = vfsInstance.Changelog("test.db", 0, func(ChangelogEntry) error {
+		calls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+	assert.ErrorContains(t, vfsInstance.Changelog("missing.db", 0, nil), "not found")
+}
+
+func TestVFS_Changelog_Coordinator(t *testing.T) {
+	c := coordinator.NewEmbedded()
+	writer := makeCoordinatedVFS(c)
+	writerFile, _, err := writer.Open("test.db?client_id=writer", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(writerFile)
+	reader := makeCoordinatedVFS(c)
+	reader.clientID = "reader"
+	readerFile, _, err := reader.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(readerFile)
+
+	lockForRead(t, writerFile)
+	writePages(t, writerFile, map[int64]string{SectorSize: "one", 2 * SectorSize: "two"})
+	unlockForRead(t, writerFile)
+	lockForRead(t, readerFile)
+	writePages(t, readerFile, map[int64]string{2 * SectorSize: "dos"})
+	unlockForRead(t, readerFile)
+	lockForRead(t, writerFile)
+	unlockForRead(t, writerFile)
+
+	entries := changelog(t, writer, "test.db", 0)
+	require.NotEmpty(t, entries)
+	last := entries[len(entries)-1]
+	assert.Equal(t, []int64{2 * SectorSize}, last.Offsets)
+	assert.Equal(t, "reader", last.ClientID, "Commits by other processes should keep their client id")
+	written := entries[len(entries)-2]
+	assert.Equal(t, []int64{SectorSize, 2 * SectorSize}, written.Offsets)
+	assert.Equal(t, "writer", written.ClientID)
+
+	replicated := changelog(t, reader, "test.db", written.Revision)
+	assert.Equal(t, entries[len(entries)-2:], replicated, "Every store should record the same changelog")
+}
@@ -0,0 +1,134 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	pageSchema "s3qlite/internal/schema/page"
+)
+
+// Page bodies can be compressed with any of the codecs below. The codec of the bodies held in an envelope (Real data
+// and Ref deltas) is recorded in the envelope, while content is shared by every envelope with the same hash and so
+// records its own codec in its first byte:
+//
+//	[codec uint8][body]
+//
+// Readers therefore handle databases written with a mix of codecs, and changing a database's codec only affects
+// pages written afterwards.
+
+type Codec = pageSchema.Codec
+
+const (
+	CodecNone   = pageSchema.CodecNone
+	CodecZstd   = pageSchema.CodecZstd
+	CodecSnappy = pageSchema.CodecSnappy
+)
+
+var codecMetaKey = "codec"
+
+// ParseCodec returns the codec with the given name, ignoring case
+func ParseCodec(name string) (Codec, error) {
+	for codecName, codec := range pageSchema.EnumValuesCodec {
+		if strings.EqualFold(codecName, name) {
+			return codec, nil
+		}
+	}
+	return CodecNone, fmt.Errorf("unknown codec %q", name)
+}
+
+// The zstd encoder and decoder are safe for concurrent use through EncodeAll and DecodeAll
+var zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	return encoder
+})
+
+var zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	return decoder
+})
+
+// compress returns data encoded with codec, falling back to CodecNone when compression doesn't make it smaller
+func compress(codec Codec, data []byte) (Codec, []byte) {
+	var body []byte
+	switch codec {
+	case CodecZstd:
+		body = zstdEncoder().EncodeAll(data, nil)
+	case CodecSnappy:
+		body = snappy.Encode(nil, data)
+	default:
+		return CodecNone, data
+	}
+	if len(body) >= len(data) {
+		return CodecNone, data
+	}
+	return codec, body
+}
+
+func decompress(codec Codec, body []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return body, nil
+	case CodecZstd:
+		return zstdDecoder().DecodeAll(body, nil)
+	case CodecSnappy:
+		return snappy.Decode(nil, body)
+	default:
+		return nil, fmt.Errorf("unknown codec %s", codec)
+	}
+}
+
+func encodeContent(codec Codec, data []byte) []byte {
+	codec, body := compress(codec, data)
+	return append([]byte{byte(codec)}, body...)
+}
+
+func decodeContent(blob []byte) ([]byte, error) {
+	if len(blob) == 0 {
+		return nil, errors.New("empty content")
+	}
+	return decompress(Codec(blob[0]), blob[1:])
+}
+
+// UseCompression sets the codec used for databases that haven't been given one with SetCompression.
+func (v *VFS) UseCompression(codec Codec) {
+	v.codec = codec
+}
+
+// SetCompression records the codec used for pages subsequently written to the named database in its local store.
+func (v *VFS) SetCompression(name string, codec Codec) error {
+	if _, ok := pageSchema.EnumNamesCodec[codec]; !ok {
+		return fmt.Errorf("unknown codec %s", codec)
+	}
+	store, release, err := v.acquireStore(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	txn, err := store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if err = txn.PutMeta(codecMetaKey, []byte{byte(codec)}); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// databaseCodec returns the codec for pages written in txn
+func (v *VFS) databaseCodec(txn PageTxn) Codec {
+	if buf := txn.GetMeta(codecMetaKey); len(buf) == 1 {
+		return Codec(buf[0])
+	}
+	return v.codec
+}
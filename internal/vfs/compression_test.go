@@ -0,0 +1,66 @@
+package vfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestCompression_RoundTrip(t *testing.T) {
+	data := sector(strings.Repeat("compressible text ", 100))
+	for _, codec := range []Codec{CodecNone, CodecZstd, CodecSnappy} {
+		t.Run(codec.String(), func(t *testing.T) {
+			blob := encodeContent(codec, data)
+			assert.Equal(t, byte(codec), blob[0])
+			if codec != CodecNone {
+				assert.Less(t, len(blob), len(data)/4)
+			}
+			result, err := decodeContent(blob)
+			require.NoError(t, err)
+			assert.Equal(t, data, result)
+		})
+	}
+
+	// Incompressible data is kept as is
+	random := make([]byte, 64)
+	for i := range random {
+		random[i] = byte(i * 151)
+	}
+	assert.Equal(t, byte(CodecNone), encodeContent(CodecZstd, random)[0])
+}
+
+func TestParseCodec(t *testing.T) {
+	codec, err := ParseCodec("zstd")
+	require.NoError(t, err)
+	assert.Equal(t, CodecZstd, codec)
+	_, err = ParseCodec("lz4")
+	assert.Error(t, err)
+}
+
+func TestFile_MixedCodecs(t *testing.T) {
+	vfsInstance := makeVFS()
+	vfsInstance.UseCompression(CodecSnappy)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+
+	snappyPage := strings.Repeat("snappy ", 100)
+	zstdPage := strings.Repeat("zstd ", 100)
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{SectorSize: snappyPage})
+	unlockForRead(t, file)
+
+	require.NoError(t, vfsInstance.SetCompression("test.db", CodecZstd))
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{2 * SectorSize: zstdPage})
+
+	txn := file.(*File).txn
+	assert.Equal(t, byte(CodecSnappy), txn.GetContent(pageHash(sector(snappyPage)))[0])
+	assert.Equal(t, byte(CodecZstd), txn.GetContent(pageHash(sector(zstdPage)))[0])
+	assertPage(t, file, SectorSize, snappyPage)
+	assertPage(t, file, 2*SectorSize, zstdPage)
+	unlockForRead(t, file)
+}
@@ -0,0 +1,139 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	pageSchema "s3qlite/internal/schema/page"
+)
+
+// Page contents are stored once per database under their SHA-256 hash, the envelope kept for each offset is a Ref
+// naming the content it holds. Identical pages at different offsets or revisions share one copy, and content that has
+// been compacted or was written by another process is found by hash (local store, then segments, then coordinator).
+
+const hashSize = sha256.Size
+
+// pageRef is the decoded form of a Ref envelope
+type pageRef struct {
+	hash  []byte
+	base  []byte
+	delta []byte // compressed with codec
+	codec Codec
+}
+
+func pageHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// newRefPage serializes a page envelope pointing at content by hash
+func newRefPage(revision int64, ref pageRef) []byte {
+	builder := flatbuffers.NewBuilder(0)
+	hash := builder.CreateByteVector(ref.hash)
+	var base, delta flatbuffers.UOffsetT
+	if ref.base != nil {
+		base = builder.CreateByteVector(ref.base)
+	}
+	if ref.delta != nil {
+		delta = builder.CreateByteVector(ref.delta)
+	}
+	pageSchema.RefStart(builder)
+	pageSchema.RefAddHash(builder, hash)
+	if ref.base != nil {
+		pageSchema.RefAddBase(builder, base)
+	}
+	if ref.delta != nil {
+		pageSchema.RefAddDelta(builder, delta)
+	}
+	refPtr := pageSchema.RefEnd(builder)
+	pageSchema.PageStart(builder)
+	pageSchema.PageAddRevision(builder, revision)
+	pageSchema.PageAddDataType(builder, pageSchema.DataRef)
+	pageSchema.PageAddData(builder, refPtr)
+	pageSchema.PageAddCodec(builder, ref.codec)
+	root := pageSchema.PageEnd(builder)
+	builder.Finish(root)
+	return builder.FinishedBytes()
+}
+
+// decodePage returns either the data of a Real envelope or the reference of a Ref envelope
+func decodePage(page *pageSchema.Page) ([]byte, *pageRef, error) {
+	unionTable := new(flatbuffers.Table)
+	if !page.Data(unionTable) {
+		return nil, nil, errors.New("page data not found")
+	}
+	switch page.DataType() {
+	case pageSchema.DataReal:
+		realData := new(pageSchema.Real)
+		realData.Init(unionTable.Bytes, unionTable.Pos)
+		data, err := decompress(page.Codec(), realData.DataBytes())
+		return data, nil, err
+	case pageSchema.DataRef:
+		refData := new(pageSchema.Ref)
+		refData.Init(unionTable.Bytes, unionTable.Pos)
+		return nil, &pageRef{
+			hash:  refData.HashBytes(),
+			base:  refData.BaseBytes(),
+			delta: refData.DeltaBytes(),
+			codec: page.Codec(),
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unexpected page data type %s", page.DataType())
+	}
+}
+
+// decodeRef returns the reference held by a serialized envelope, or nil if it holds its data directly
+func decodeRef(buf []byte) (*pageRef, error) {
+	_, ref, err := decodePage(pageSchema.GetRootAsPage(buf, 0))
+	return ref, err
+}
+
+// storeContent saves data compressed with codec under its hash unless the store already has it and returns the hash
+func storeContent(txn PageTxn, data []byte, codec Codec) ([]byte, error) {
+	hash := pageHash(data)
+	if txn.GetContent(hash) != nil {
+		return hash, nil
+	}
+	return hash, txn.PutContent(hash, encodeContent(codec, data))
+}
+
+// content resolves a hash to page data, returning nil if nothing holds it
+func (v *VFS) content(txn PageTxn, name string, hash []byte) ([]byte, error) {
+	blob, err := v.contentBlob(txn, name, hash)
+	if err != nil || blob == nil {
+		return nil, err
+	}
+	return decodeContent(blob)
+}
+
+// contentBlob returns the stored, still compressed, form of the content
+func (v *VFS) contentBlob(txn PageTxn, name string, hash []byte) ([]byte, error) {
+	if blob := txn.GetContent(hash); blob != nil {
+		return blob, nil
+	}
+	if blob := v.disk.get(hash); blob != nil {
+		return blob, nil
+	}
+	blob, err := v.remoteContent(txn, name, hash)
+	if err == nil && blob != nil {
+		v.disk.put(hash, blob)
+	}
+	return blob, err
+}
+
+// remoteContent fetches the stored form of the content from a segment or the coordinator
+func (v *VFS) remoteContent(txn PageTxn, name string, hash []byte) ([]byte, error) {
+	blob, err := v.segmentContent(txn, hash)
+	if err != nil || blob != nil {
+		return blob, err
+	}
+	if v.coordinator == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), coordinatorTimeout)
+	defer cancel()
+	return v.coordinator.GetContent(ctx, name, hash)
+}
@@ -0,0 +1,287 @@
+package vfs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"s3qlite/internal/coordinator"
+	pageSchema "s3qlite/internal/schema/page"
+)
+
+// When a coordinator is configured the local PageStore is a replica of the pointers it holds. Before each read
+// transaction the store is brought up to the coordinator's revision, and commits are validated against the
+// coordinator by comparing the pages the transaction read with the revision it read them at (see File.ConfirmCommit).
+
+const coordinatorTimeout = 10 * time.Second
+
+var revisionMetaKey = "revision"
+
+// storedRevision returns the revision of the last commit applied to the store
+func storedRevision(txn PageTxn) int64 {
+	buf := txn.GetMeta(revisionMetaKey)
+	if len(buf) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+func putStoredRevision(txn PageTxn, rev int64) error {
+	return txn.PutMeta(revisionMetaKey, binary.BigEndian.AppendUint64(nil, uint64(rev)))
+}
+
+// setPageRevision returns the page envelope stamped with rev
+func setPageRevision(buf []byte, rev int64) ([]byte, error) {
+	page := pageSchema.GetRootAsPage(buf, 0)
+	if page.Revision() == rev {
+		return buf, nil
+	}
+	data, ref, err := decodePage(page)
+	if err != nil {
+		return nil, err
+	}
+	if ref != nil {
+		return newRefPage(rev, *ref), nil
+	}
+	return newRealPage(rev, data), nil
+}
+
+// UseCoordinator shares the databases of this VFS with every other process using the same coordinator.
+func (v *VFS) UseCoordinator(c coordinator.Coordinator) {
+	v.coordinator = c
+}
+
+// catchUp applies the commits other processes made to the coordinator to the local store
+func (v *VFS) catchUp(store PageStore, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), coordinatorTimeout)
+	defer cancel()
+	target, err := v.coordinator.Revision(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	txn, err := store.Begin(false)
+	if err != nil {
+		return err
+	}
+	applied := storedRevision(txn)
+	_ = txn.Rollback()
+	if applied >= target {
+		return nil
+	}
+
+	txn, err = store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	applied = storedRevision(txn) // Another file may have caught up while we waited for the write transaction
+	if applied >= target {
+		return nil
+	}
+	err = v.applyCommits(ctx, txn, name, applied, target)
+	if err != nil {
+		return err
+	}
+	err = putStoredRevision(txn, target)
+	if err != nil {
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	v.notifyCommit(name)
+	return nil
+}
+
+// applyCommits copies the pointers of the commits after revision from, up to and including revision to, into txn.
+// It replays the commit history when the coordinator still has it and falls back to reading every pointer.
+func (v *VFS) applyCommits(ctx context.Context, txn PageTxn, name string, from int64, to int64) error {
+	if from >= to {
+		return nil
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, err := v.coordinator.Watch(watchCtx, name, from+1)
+	if err != nil {
+		return err
+	}
+	for event := range events {
+		if event.Revision > to {
+			return nil
+		}
+		if err = v.applyPointers(ctx, txn, name, event.Pointers); err != nil {
+			return err
+		}
+		entry := ChangelogEntry{
+			Revision: event.Revision,
+			Time:     event.Time,
+			Offsets:  pointerOffsets(event.Pointers),
+			ClientID: event.ClientID,
+		}
+		if entry.Time.IsZero() {
+			entry.Time = time.Now() // The coordinator didn't record it, use the time the commit reached this store
+		}
+		if err = txn.PutCommit(event.Revision, encodeCommitRecord(entry)); err != nil {
+			return err
+		}
+		if event.Revision == to {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	v.logger.Warn().Str("db", name).Int64("from", from).Msg("commit history unavailable, reading all pointers")
+	pointers, err := v.coordinator.Range(ctx, name, to, 0, 0)
+	if err != nil {
+		return err
+	}
+	if err = v.applyPointers(ctx, txn, name, pointers); err != nil {
+		return err
+	}
+	// Versions written by the commits we skipped are missing, history is only accurate from here on
+	if err = putHistoryStart(txn, to); err != nil {
+		return err
+	}
+	entry := ChangelogEntry{Revision: to, Time: time.Now(), Offsets: pointerOffsets(pointers)}
+	return txn.PutCommit(to, encodeCommitRecord(entry))
+}
+
+// applyPointers stores each pointer's envelope at its revision, and as the version of that revision, fetching content
+// the store doesn't have yet
+func (v *VFS) applyPointers(ctx context.Context, txn PageTxn, name string, pointers []coordinator.Pointer) error {
+	for _, p := range pointers {
+		if len(p.Value) == 0 {
+			if err := txn.Delete(p.Offset); err != nil {
+				return err
+			}
+			if err := txn.PutVersion(p.Offset, p.Revision, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		page, err := setPageRevision(p.Value, p.Revision)
+		if err != nil {
+			return err
+		}
+		ref, err := decodeRef(page)
+		if err != nil {
+			return err
+		}
+		if ref != nil {
+			needed := ref.hash
+			if ref.delta != nil {
+				needed = ref.base
+			}
+			if txn.GetContent(needed) == nil {
+				if err = v.fetchContent(ctx, txn, name, needed); err != nil {
+					return err
+				}
+			}
+		}
+		if err = txn.Put(p.Offset, page); err != nil {
+			return err
+		}
+		if err = txn.PutVersion(p.Offset, p.Revision, page); err != nil {
+			return err
+		}
+		if p.Offset == 0 && ref != nil {
+			// The database may have been created elsewhere with a different page size than our empty template
+			data, err := v.resolveRef(txn, name, ref)
+			if err != nil {
+				return err
+			}
+			if err = putStoredPageSize(txn, headerPageSize(data)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commitToCoordinator validates the transaction's read set and publishes its writes, returning the new revision.
+// On success the local write transaction is brought up to that revision, including commits by other processes that
+// didn't conflict. If that fails the commit still stands and the local store catches up on the next transaction.
+func (f *File) commitToCoordinator() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), coordinatorTimeout)
+	defer cancel()
+
+	req := coordinator.CommitRequest{
+		ReadRevision: f.readRevision,
+		Reads:        make([]int64, 0, f.revisions.Len()),
+		Writes:       make([]coordinator.Pointer, 0, len(f.written)),
+		Time:         time.Now(),
+		ClientID:     f.clientID,
+	}
+	for elem := f.revisions.Front(); elem != nil; elem = elem.Next() {
+		req.Reads = append(req.Reads, elem.Key().(PageRevision).Offset)
+	}
+	for off := range f.written {
+		page := f.txn.Get(off)
+		if page == nil {
+			if _, ok := f.truncated[off]; !ok {
+				return 0, fmt.Errorf("written page %d is missing", off)
+			}
+			req.Writes = append(req.Writes, coordinator.Pointer{Offset: off}) // tombstone
+			continue
+		}
+		req.Writes = append(req.Writes, coordinator.Pointer{Offset: off, Value: append([]byte(nil), page...)})
+		if err := f.publishContent(ctx, page); err != nil {
+			return 0, err
+		}
+	}
+
+	rev, err := f.vfs.coordinator.Commit(ctx, f.name, req)
+	if err != nil {
+		return 0, err
+	}
+
+	err = f.vfs.applyCommits(ctx, f.txn, f.name, storedRevision(f.txn), rev-1)
+	if err == nil {
+		for i := range req.Writes {
+			req.Writes[i].Revision = rev
+		}
+		err = f.vfs.applyPointers(ctx, f.txn, f.name, req.Writes)
+	}
+	if err == nil {
+		entry := ChangelogEntry{Revision: rev, Time: req.Time, Offsets: sortedOffsets(f.written), ClientID: f.clientID}
+		err = f.txn.PutCommit(rev, encodeCommitRecord(entry))
+	}
+	if err == nil {
+		err = putStoredRevision(f.txn, rev)
+	}
+	if err != nil {
+		f.vfs.logger.Warn().Err(err).Int64("revision", rev).Msg("error applying commit locally, discarding local transaction")
+		f.localStale = true
+	}
+	return rev, nil
+}
+
+// fetchContent copies content from the coordinator into txn
+func (v *VFS) fetchContent(ctx context.Context, txn PageTxn, name string, hash []byte) error {
+	data, err := v.coordinator.GetContent(ctx, name, hash)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("content %x is missing from the coordinator", hash)
+	}
+	return txn.PutContent(hash, data)
+}
+
+// publishContent makes the content a written envelope refers to available to other processes before it is committed.
+// Delta encoded pages have no content of their own, their base was published when it was committed.
+func (f *File) publishContent(ctx context.Context, page []byte) error {
+	ref, err := decodeRef(page)
+	if err != nil || ref == nil || ref.delta != nil {
+		return err
+	}
+	data := f.txn.GetContent(ref.hash)
+	if data == nil {
+		return fmt.Errorf("content %x is missing", ref.hash)
+	}
+	return f.vfs.coordinator.PutContent(ctx, f.name, ref.hash, data)
+}
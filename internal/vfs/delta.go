@@ -0,0 +1,166 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// When delta encoding is enabled a rewritten page whose changes are small is stored as the XOR of the new contents
+// with a base page, rather than as content of its own. The Ref keeps the hash of the full page alongside the base
+// hash and the encoded delta, so the page keeps its identity and dedupes like any other.
+//
+// Bases are always pages stored in full, so reconstructing a page never needs more than one base. The XOR of two
+// versions of a page is mostly zeros, the delta records only the runs that aren't:
+//
+//	[skip uvarint][length uvarint][length bytes]...
+//
+// where skip is the number of zero bytes since the end of the previous run.
+
+// maxDeltaFraction is the fraction of the page size beyond which a delta isn't worth keeping instead of the full page
+const maxDeltaFraction = 4
+
+// UseDeltaEncoding makes writes store small modifications of a page as deltas against its previous version.
+func (v *VFS) UseDeltaEncoding() {
+	v.deltas = true
+}
+
+func encodeDelta(base []byte, data []byte) ([]byte, error) {
+	if len(base) != len(data) {
+		return nil, errors.New("delta base has a different size")
+	}
+	var buf []byte
+	last := 0
+	for i := 0; i < len(data); {
+		if base[i] == data[i] {
+			i++
+			continue
+		}
+		start := i
+		for i < len(data) && base[i] != data[i] {
+			i++
+		}
+		buf = binary.AppendUvarint(buf, uint64(start-last))
+		buf = binary.AppendUvarint(buf, uint64(i-start))
+		for j := start; j < i; j++ {
+			buf = append(buf, base[j]^data[j])
+		}
+		last = i
+	}
+	return buf, nil
+}
+
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	data := bytes.Clone(base)
+	r := bytes.NewReader(delta)
+	pos := uint64(0)
+	for r.Len() > 0 {
+		skip, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt delta: %w", err)
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt delta: %w", err)
+		}
+		pos += skip
+		if pos+length > uint64(len(data)) || length > uint64(r.Len()) {
+			return nil, errors.New("corrupt delta: run out of bounds")
+		}
+		for end := pos + length; pos < end; pos++ {
+			b, _ := r.ReadByte()
+			data[pos] ^= b
+		}
+	}
+	return data, nil
+}
+
+// deltaBase returns the hash of the full page a write to off would be encoded against, or nil if there is none.
+// It must be called before the write replaces the committed version of the page.
+func deltaBase(txn PageTxn, off int64) []byte {
+	buf := txn.Get(off)
+	if buf == nil {
+		return nil
+	}
+	ref, err := decodeRef(buf)
+	if err != nil || ref == nil {
+		return nil
+	}
+	if ref.delta != nil {
+		return ref.base
+	}
+	return ref.hash
+}
+
+// encodePage stores data in the write transaction and returns the Ref to record for it
+func (f *File) encodePage(off int64, data []byte) (pageRef, error) {
+	hash := pageHash(data)
+	ref := pageRef{hash: hash}
+	base := f.bases[off]
+	if !f.vfs.deltas || base == nil || f.txn.GetContent(hash) != nil {
+		_, err := storeContent(f.txn, data, f.codec)
+		return ref, err
+	}
+
+	baseData, err := f.vfs.content(f.txn, f.name, base)
+	if err != nil {
+		return ref, err
+	}
+	if baseData != nil {
+		delta, err := encodeDelta(baseData, data)
+		if err == nil {
+			codec, compressed := compress(f.codec, delta)
+			if len(compressed) <= len(data)/maxDeltaFraction {
+				ref.base = base
+				ref.delta = compressed
+				ref.codec = codec
+				return ref, nil
+			}
+		}
+	}
+	_, err = storeContent(f.txn, data, f.codec)
+	return ref, err
+}
+
+// resolveRef returns the data a Ref points at, rebuilding it from its base when it was delta encoded. The data may be
+// shared through the page cache (see pagecache.go) and must not be modified.
+func (v *VFS) resolveRef(txn PageTxn, name string, ref *pageRef) ([]byte, error) {
+	if data, ok := v.pages.get(ref.hash); ok {
+		return data, nil
+	}
+	data, err := resolveRefWith(ref, func(hash []byte) ([]byte, error) {
+		return v.content(txn, name, hash)
+	})
+	if err != nil || data == nil {
+		return data, err
+	}
+	return v.pages.put(ref.hash, data), nil
+}
+
+// resolveRefWith resolves a Ref with content, which returns nil for hashes it doesn't hold
+func resolveRefWith(ref *pageRef, content func(hash []byte) ([]byte, error)) ([]byte, error) {
+	if ref.delta == nil {
+		return content(ref.hash)
+	}
+	base, err := content(ref.base)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		// The page may still have been stored in full elsewhere
+		return content(ref.hash)
+	}
+	delta, err := decompress(ref.codec, ref.delta)
+	if err != nil {
+		return nil, err
+	}
+	data, err := applyDelta(base, delta)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pageHash(data), ref.hash) {
+		return nil, fmt.Errorf("delta against %x doesn't reproduce %x", ref.base, ref.hash)
+	}
+	return data, nil
+}
@@ -0,0 +1,89 @@
+package vfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestDelta_RoundTrip(t *testing.T) {
+	base := sector("Hello, World!")
+	data := sector("Hello, Delta!")
+	data[SectorSize-1] = 0xff
+
+	delta, err := encodeDelta(base, data)
+	require.NoError(t, err)
+	assert.Less(t, len(delta), 16)
+
+	result, err := applyDelta(base, delta)
+	require.NoError(t, err)
+	assert.Equal(t, data, result)
+
+	_, err = applyDelta(base[:10], delta)
+	assert.Error(t, err)
+}
+
+func countContents(t *testing.T, file sqlite3vfs.File) int {
+	contents := 0
+	require.NoError(t, file.(*File).txn.ForEachContent(func(hash []byte, data []byte) error {
+		contents++
+		return nil
+	}))
+	return contents
+}
+
+func TestFile_DeltaEncoding(t *testing.T) {
+	vfsInstance := makeVFS()
+	vfsInstance.UseDeltaEncoding()
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{SectorSize: "Hello, World!"})
+	before := countContents(t, file)
+
+	writePages(t, file, map[int64]string{SectorSize: "Hello, Delta!"})
+	assertPage(t, file, SectorSize, "Hello, Delta!")
+	writePages(t, file, map[int64]string{SectorSize: "Hello, Again!"})
+	assertPage(t, file, SectorSize, "Hello, Again!")
+	assert.Equal(t, before, countContents(t, file), "Small modifications shouldn't store new content")
+
+	ref, err := decodeRef(file.(*File).txn.Get(SectorSize))
+	require.NoError(t, err)
+	assert.Equal(t, pageHash(sector("Hello, World!")), ref.base, "Deltas should be taken against the full page")
+
+	// A page that changed too much is stored in full
+	large := make([]byte, SectorSize)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	writePages(t, file, map[int64]string{SectorSize: string(large)})
+	assertPage(t, file, SectorSize, string(large))
+	assert.Equal(t, before+1, countContents(t, file))
+	unlockForRead(t, file)
+}
+
+func TestFile_DeltaEncoding_Replicates(t *testing.T) {
+	c := coordinator.NewEmbedded()
+	writerVFS := makeCoordinatedVFS(c)
+	writerVFS.UseDeltaEncoding()
+	writerFile, _, err := writerVFS.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(writerFile)
+	readerFile, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(readerFile)
+
+	lockForRead(t, writerFile)
+	writePages(t, writerFile, map[int64]string{SectorSize: "Hello, World!"})
+	writePages(t, writerFile, map[int64]string{SectorSize: "Hello, Delta!"})
+	unlockForRead(t, writerFile)
+
+	lockForRead(t, readerFile)
+	assertPage(t, readerFile, SectorSize, "Hello, Delta!")
+	unlockForRead(t, readerFile)
+}
@@ -0,0 +1,316 @@
+package vfs
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// The disk cache keeps the contents read from remote sources, compacted segments in the object store and the
+// coordinator, in files under Options.DiskCacheDir, so they're read from the object store or the coordinator once even
+// across restarts. Contents held by the local store are never cached. A content is stored compressed as it was fetched,
+// in a file named after its hash:
+//
+//	[crc32c of the blob uint32][blob]
+//
+// A file whose checksum doesn't match is deleted and the content fetched again. Files are written to a temporary name
+// and renamed, so a crash never leaves a partial one behind. Once the files take up more than Options.DiskCacheSize
+// bytes the least recently used are deleted, recency survives restarts as the time the files were written.
+//
+// VFS.WarmDiskCache fetches the current contents of the pages the changelog lists as written after a revision, and of
+// those each new commit writes, so the pages a database was recently written at are on disk before they're read.
+
+// DefaultDiskCacheSize is the disk cache budget when Options.DiskCacheSize is zero
+const DefaultDiskCacheSize = 1 << 30
+
+const diskCacheHeaderSize = 4
+
+// DiskCacheStats counts the disk cache's lookups since the VFS was created
+type DiskCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Corrupt   int64 // files deleted because their checksum didn't match
+	Evictions int64
+	Entries   int
+	Bytes     int64 // size of the cached files
+}
+
+type diskCache struct {
+	dir      string
+	capacity int64
+	logger   zerolog.Logger
+	mutex    sync.Mutex
+	files    map[string]*list.Element
+	lru      *list.List // of *cachedFile, most recently used first
+	stats    DiskCacheStats
+}
+
+type cachedFile struct {
+	key  string // hex encoded hash
+	size int64
+}
+
+// openDiskCache opens the cache in dir, creating it if needed, and indexes the files a previous process left there
+func openDiskCache(dir string, capacity int64, logger zerolog.Logger) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{
+		dir:      dir,
+		capacity: capacity,
+		logger:   logger,
+		files:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	type found struct {
+		file     *cachedFile
+		modified time.Time
+	}
+	var existing []found
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		name := entry.Name()
+		if filepath.Ext(name) == ".tmp" {
+			return os.Remove(path) // Left by a process that crashed while writing it
+		}
+		if hash, err := hex.DecodeString(name); err != nil || len(hash) != hashSize || path != c.path(name) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		existing = append(existing, found{file: &cachedFile{key: name, size: info.Size()}, modified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].modified.Before(existing[j].modified) })
+	for _, f := range existing {
+		c.files[f.file.key] = c.lru.PushFront(f.file)
+		c.stats.Bytes += f.file.size
+	}
+	c.mutex.Lock()
+	c.evict()
+	c.mutex.Unlock()
+	return c, nil
+}
+
+// path returns the path of the file holding a content, spread over directories by the first byte of its hash
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get returns the blob of a content, nil if it isn't cached or its file is corrupt
+func (c *diskCache) get(hash []byte) []byte {
+	if c == nil {
+		return nil
+	}
+	key := hex.EncodeToString(hash)
+	c.mutex.Lock()
+	_, ok := c.files[key]
+	if !ok {
+		c.stats.Misses++
+	}
+	c.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	buf, err := os.ReadFile(c.path(key))
+	if err == nil && (len(buf) < diskCacheHeaderSize ||
+		crc32.Checksum(buf[diskCacheHeaderSize:], crc32cTable) != binary.BigEndian.Uint32(buf)) {
+		err = errors.New("checksum mismatch")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.files[key]
+	if err != nil {
+		c.stats.Misses++
+		if ok {
+			c.logger.Warn().Err(err).Str("hash", key).Msg("dropping unreadable disk cache file")
+			c.stats.Corrupt++
+			c.remove(elem)
+		}
+		return nil
+	}
+	c.stats.Hits++
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	return buf[diskCacheHeaderSize:]
+}
+
+// has reports whether a content is cached, without counting a lookup
+func (c *diskCache) has(hash []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.files[hex.EncodeToString(hash)]
+	return ok
+}
+
+// put writes the blob of a content to the cache, failures are only logged as the content can be fetched again
+func (c *diskCache) put(hash []byte, blob []byte) {
+	if c == nil || int64(len(blob)+diskCacheHeaderSize) > c.capacity {
+		return
+	}
+	key := hex.EncodeToString(hash)
+	c.mutex.Lock()
+	_, ok := c.files[key]
+	c.mutex.Unlock()
+	if ok {
+		return
+	}
+	if err := c.write(key, blob); err != nil {
+		c.logger.Warn().Err(err).Str("hash", key).Msg("error writing disk cache file")
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.files[key]; ok {
+		return
+	}
+	file := &cachedFile{key: key, size: int64(len(blob) + diskCacheHeaderSize)}
+	c.files[key] = c.lru.PushFront(file)
+	c.stats.Bytes += file.size
+	c.evict()
+}
+
+func (c *diskCache) write(key string, blob []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, diskCacheHeaderSize), crc32.Checksum(blob, crc32cTable))
+	_, err = tmp.Write(append(buf, blob...))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// evict deletes the least recently used files until the cache fits its capacity, the mutex must be held
+func (c *diskCache) evict() {
+	for c.stats.Bytes > c.capacity && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove deletes a file from the cache, the mutex must be held
+func (c *diskCache) remove(elem *list.Element) {
+	file := c.lru.Remove(elem).(*cachedFile)
+	delete(c.files, file.key)
+	c.stats.Bytes -= file.size
+	if err := os.Remove(c.path(file.key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.logger.Warn().Err(err).Str("hash", file.key).Msg("error deleting disk cache file")
+	}
+}
+
+func (c *diskCache) snapshot() DiskCacheStats {
+	if c == nil {
+		return DiskCacheStats{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// DiskCacheStats returns the disk cache's counters, all zero without a disk cache
+func (v *VFS) DiskCacheStats() DiskCacheStats {
+	return v.disk.snapshot()
+}
+
+// CacheWarmer fetches the contents of the pages written to a database into the disk cache until it is closed
+type CacheWarmer struct {
+	follower *follower
+}
+
+// WarmDiskCache starts fetching the current contents of the pages written by every commit to the named database after
+// revision from into the disk cache. Contents the local store or the disk cache hold are skipped.
+func (v *VFS) WarmDiskCache(name string, from int64) (*CacheWarmer, error) {
+	if v.disk == nil {
+		return nil, errors.New("no disk cache configured")
+	}
+	w := &CacheWarmer{}
+	var err error
+	w.follower, err = v.follow(name, from, w.warm)
+	if err != nil {
+		return nil, err
+	}
+	w.follower.start()
+	return w, nil
+}
+
+// Revision returns the revision of the last commit whose pages were warmed
+func (w *CacheWarmer) Revision() int64 {
+	return w.follower.revision.Load()
+}
+
+func (w *CacheWarmer) Close() error {
+	w.follower.close()
+	return nil
+}
+
+func (w *CacheWarmer) warm(ctx context.Context, entry ChangelogEntry) error {
+	f := w.follower
+	txn, err := f.store.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	for _, off := range entry.Offsets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		buf := txn.Get(off)
+		if len(buf) == 0 {
+			continue
+		}
+		ref, err := decodeRef(buf)
+		if err != nil || ref == nil {
+			continue // Pages held in their envelope have no content to fetch
+		}
+		hash := ref.hash
+		if ref.delta != nil {
+			hash = ref.base // The delta is in the envelope
+		}
+		if txn.GetContent(hash) != nil || f.vfs.disk.has(hash) {
+			continue
+		}
+		blob, err := f.vfs.remoteContent(txn, f.name, hash)
+		if err != nil {
+			return err
+		}
+		if blob != nil {
+			f.vfs.disk.put(hash, blob)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package vfs
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/objectstore"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := openDiskCache(dir, 100, zerolog.Nop())
+	require.NoError(t, err)
+	one, two, three := pageHash([]byte("one")), pageHash([]byte("two")), pageHash([]byte("three"))
+	assert.Nil(t, cache.get(one))
+	cache.put(one, []byte("blob one"))
+	cache.put(two, []byte("blob two"))
+	assert.Equal(t, []byte("blob one"), cache.get(one))
+	assert.Equal(t, DiskCacheStats{Hits: 1, Misses: 1, Entries: 2, Bytes: 24}, cache.snapshot())
+
+	// Contents survive restarts, partial writes don't
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "partial.tmp"), []byte("torn"), 0o644))
+	cache, err = openDiskCache(dir, 100, zerolog.Nop())
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "partial.tmp"))
+	assert.Equal(t, []byte("blob two"), cache.get(two))
+	assert.Equal(t, 2, cache.snapshot().Entries)
+
+	path := cache.path(hex.EncodeToString(one))
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	buf[len(buf)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, buf, 0o644))
+	assert.Nil(t, cache.get(one), "Corrupt files should be dropped")
+	assert.NoFileExists(t, path)
+	assert.Equal(t, int64(1), cache.snapshot().Corrupt)
+
+	cache.put(one, make([]byte, 60))
+	cache.put(three, make([]byte, 30))
+	assert.Nil(t, cache.get(two), "The least recently used content should be evicted")
+	assert.NotNil(t, cache.get(three))
+	stats := cache.snapshot()
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, int64(98), stats.Bytes)
+
+	cache, err = openDiskCache(dir, 70, zerolog.Nop())
+	require.NoError(t, err)
+	assert.Equal(t, 1, cache.snapshot().Entries, "Reopening with a smaller size should evict")
+}
+
+func TestDiskCache_Segments(t *testing.T) {
+	objects, err := objectstore.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	dir := t.TempDir()
+	vfsInstance := makeVFS()
+	vfsInstance.UseObjectStore(objects)
+	vfsInstance.disk, err = openDiskCache(dir, DefaultDiskCacheSize, zerolog.Nop())
+	require.NoError(t, err)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{SectorSize: "one", 2 * SectorSize: "two"})
+	unlockForRead(t, file)
+	_, err = vfsInstance.Compact("test.db")
+	require.NoError(t, err)
+	lockForRead(t, file)
+	assertPage(t, file, SectorSize, "one")
+	unlockForRead(t, file)
+	assert.Equal(t, 1, vfsInstance.DiskCacheStats().Entries, "Contents read from a segment should be cached")
+
+	// Cached contents are read from disk, before and after a restart
+	keys, err := objects.List("test.db/")
+	require.NoError(t, err)
+	for _, key := range keys {
+		require.NoError(t, objects.Delete(key))
+	}
+	vfsInstance.segments = newSegmentCache(DefaultCacheSize)
+	vfsInstance.disk, err = openDiskCache(dir, DefaultDiskCacheSize, zerolog.Nop())
+	require.NoError(t, err)
+	lockForRead(t, file)
+	assertPage(t, file, SectorSize, "one")
+	unlockForRead(t, file)
+	assert.Equal(t, int64(1), vfsInstance.DiskCacheStats().Hits)
+}
+
+func TestDiskCache_Warm(t *testing.T) {
+	objects, err := objectstore.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	vfsInstance := makeVFS()
+	vfsInstance.UseObjectStore(objects)
+	vfsInstance.disk, err = openDiskCache(t.TempDir(), DefaultDiskCacheSize, zerolog.Nop())
+	require.NoError(t, err)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{SectorSize: "one", 2 * SectorSize: "two"})
+	writePages(t, file, map[int64]string{SectorSize: "uno"})
+	unlockForRead(t, file)
+	_, err = vfsInstance.Compact("test.db")
+	require.NoError(t, err)
+
+	warmer, err := vfsInstance.WarmDiskCache("test.db", 0)
+	require.NoError(t, err)
+	defer warmer.Close()
+	assert.Eventually(t, func() bool { return vfsInstance.DiskCacheStats().Entries == 2 }, 5*time.Second, 10*time.Millisecond,
+		"The current contents of written pages should be fetched")
+
+	lockForRead(t, file)
+	assertPage(t, file, SectorSize, "uno")
+	assertPage(t, file, 2*SectorSize, "two")
+	unlockForRead(t, file)
+	stats := vfsInstance.DiskCacheStats()
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Zero(t, stats.Misses)
+
+	_, err = makeVFS().WarmDiskCache("test.db", 0)
+	assert.Error(t, err, "Warming needs a disk cache")
+}
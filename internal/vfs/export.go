@@ -0,0 +1,101 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// Export writes the named database to w as a plain SQLite file, reading every page from one snapshot. A VFS with a
+// coordinator catches up with it first, so every commit made before the call is exported. Databases in WAL mode must
+// have been checkpointed, the WAL isn't exported. It returns the number of bytes written.
+//
+// The file change counter SQLite writes isn't kept: connections are shown a counter of their own (see spliceVersion)
+// and the stored first page has it zeroed. The exported file's change counter, and its version-valid-for number, is
+// the database revision instead. Like the counter SQLite keeps it grows with every commit, so exports of different
+// states of a database never share one.
+func (v *VFS) Export(name string, w io.Writer) (int64, error) {
+	if v.coordinator != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), coordinatorTimeout)
+		rev, err := v.coordinator.Revision(ctx, name)
+		cancel()
+		if err != nil {
+			return 0, fmt.Errorf("catching up with the coordinator: %w", err)
+		}
+		flags := sqlite3vfs.OpenReadWrite
+		if rev > 0 {
+			flags |= sqlite3vfs.OpenCreate // The database may only have been written through other processes
+		}
+		store, release, err := v.retainStore(name, flags, true)
+		if errors.Is(err, sqlite3vfs.CantOpenError) {
+			return 0, fmt.Errorf("database %s not found", name)
+		} else if err != nil {
+			return 0, err
+		}
+		err = v.catchUp(store, name)
+		release()
+		if err != nil {
+			return 0, fmt.Errorf("catching up with the coordinator: %w", err)
+		}
+	}
+	pending, err := v.pendingWAL(name)
+	if err != nil {
+		return 0, err
+	}
+	if pending {
+		return 0, errors.New("the database has a WAL that may hold commits, checkpoint it with PRAGMA wal_checkpoint(TRUNCATE) first")
+	}
+
+	written := int64(0)
+	err = v.inspect(name, func(txn PageTxn) error {
+		pageSize := int64(storedPageSize(txn))
+		revision := storedRevision(txn)
+		next := int64(0)
+		return txn.ForEach(func(off int64, buf []byte) error {
+			if off != next {
+				return fmt.Errorf("page %d is missing", next/pageSize+1)
+			}
+			data, err := v.storedPage(txn, name, off)
+			if err != nil {
+				return fmt.Errorf("reading page %d: %w", off/pageSize+1, err)
+			}
+			if int64(len(data)) != pageSize {
+				return fmt.Errorf("page %d holds %d bytes", off/pageSize+1, len(data))
+			}
+			if off == 0 {
+				data = spliceVersion(data, uint32(revision))
+			}
+			n, err := w.Write(data)
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+			next += pageSize
+			return nil
+		})
+	})
+	return written, err
+}
+
+// pendingWAL reports whether the named database has a WAL holding frames
+func (v *VFS) pendingWAL(name string) (bool, error) {
+	store, release, err := v.retainStore(name+"-wal", sqlite3vfs.OpenReadWrite, false)
+	if errors.Is(err, ErrStoreNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer release()
+	buffer := v.walBuffer(name + "-wal")
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	txn, err := store.Begin(false)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	return buffer.fileSize(txn) > 0, nil
+}
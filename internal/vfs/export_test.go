@@ -0,0 +1,103 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestVFS_Export(t *testing.T) {
+	stores := NewMemoryStores()
+	vfsInstance := makeVFS()
+	vfsInstance.openStore = stores.Open
+	writeDatabase(t, vfsInstance, "test.db", "one", "two")
+	writeDatabase(t, vfsInstance, "test.db", "uno", "two")
+
+	var buf bytes.Buffer
+	n, err := vfsInstance.Export("test.db", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3*SectorSize), n)
+	exported := buf.Bytes()
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(exported[24:28]), "The change counter should be the revision")
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(exported[92:96]))
+	assert.Equal(t, sector("uno"), exported[SectorSize:2*SectorSize])
+	assert.Equal(t, sector("two"), exported[2*SectorSize:])
+
+	store, err := stores.Open("test.db", sqlite3vfs.OpenReadWrite)
+	require.NoError(t, err)
+	txn, err := store.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, txn.Delete(SectorSize))
+	require.NoError(t, txn.Commit())
+	_, err = vfsInstance.Export("test.db", &buf)
+	assert.ErrorContains(t, err, "page 2 is missing")
+}
+
+func TestVFS_Export_Coordinator(t *testing.T) {
+	c := coordinator.NewEmbedded()
+	writer := makeCoordinatedVFS(c)
+	exporter := makeCoordinatedVFS(c) // With a store of its own, which only the coordinator updates
+	writeDatabase(t, writer, "test.db", "one")
+	export := func() []byte {
+		var buf bytes.Buffer
+		_, err := exporter.Export("test.db", &buf)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	exported := export()
+	first := binary.BigEndian.Uint32(exported[24:28])
+	assert.Equal(t, sector("one"), exported[SectorSize:])
+
+	writeDatabase(t, writer, "test.db", "uno")
+	rev, err := c.Revision(context.Background(), "test.db")
+	require.NoError(t, err)
+	exported = export()
+	assert.Equal(t, sector("uno"), exported[SectorSize:], "Exports should catch up with the coordinator")
+	assert.Equal(t, uint32(rev), binary.BigEndian.Uint32(exported[24:28]), "The change counter should be the revision")
+	assert.Equal(t, uint32(rev), binary.BigEndian.Uint32(exported[92:96]))
+	assert.Greater(t, binary.BigEndian.Uint32(exported[24:28]), first, "The change counter should grow with commits")
+}
+
+func TestVFS_Export_SQLite(t *testing.T) {
+	logger := zerolog.Nop()
+	vfsInstance, err := NewVFS(Options{DataDir: t.TempDir(), TmpDir: t.TempDir(), Logger: &logger})
+	require.NoError(t, err)
+	vfsInstance.UseDeltaEncoding()
+	require.NoError(t, sqlite3vfs.RegisterVFS("skylite-export", vfsInstance))
+	defer func() {
+		require.NoError(t, sqlite3vfs.UnregisterVFS("skylite-export"))
+	}()
+
+	conn, err := sqlite3vfs.OpenConn("file:export.db?vfs=skylite-export")
+	require.NoError(t, err)
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT); CREATE INDEX t_v ON t (v)"))
+	require.NoError(t, conn.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 500) INSERT INTO t (v) SELECT printf('row %d', i) FROM n"))
+	require.NoError(t, conn.Exec("UPDATE t SET v = 'updated' WHERE id % 7 = 0"))
+	require.NoError(t, conn.Close())
+
+	path := filepath.Join(t.TempDir(), "exported.db")
+	out, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = vfsInstance.Export("export.db", out)
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+
+	exported, err := sqlite3vfs.OpenConn("file:" + path)
+	require.NoError(t, err)
+	defer exported.Close()
+	rows, err := exported.Query("PRAGMA integrity_check")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"ok"}}, rows)
+	rows, err = exported.Query("SELECT count(*), sum(v = 'updated') FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"500", "71"}}, rows)
+}
@@ -1,21 +1,23 @@
 package vfs
 
 import (
+	"bytes"
 	_ "embed"
 	"encoding/binary"
+	"errors"
 	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/huandu/skiplist"
-	"github.com/psanford/sqlite3vfs"
-	bolt "go.etcd.io/bbolt"
 	"runtime/debug"
+	"s3qlite/internal/coordinator"
 	pageSchema "s3qlite/internal/schema/page"
+	"s3qlite/internal/sqlite3vfs"
+	"time"
 )
 
 const SectorSize = 4096
 
 //go:embed template_4k.db
 var firstPageTemplate []byte
-var pagesKey []byte = []byte("pages")
 
 type PageRevision struct {
 	Offset int64 // TODO: Update library to make this uint64
@@ -24,25 +26,45 @@ type PageRevision struct {
 
 type File struct {
 	vfs             *VFS
-	db              *bolt.DB
+	store           PageStore
 	name            string
 	sectorSize      uint64
+	pageSize        int64
 	lock            sqlite3vfs.LockType
-	txn             *bolt.Tx
+	txn             PageTxn
 	revisions       *skiplist.SkipList
 	versionCounter  uint32
 	firstPage       []byte
+	spliced         splicedPage
 	commitConfirmed bool
+	readRevision    int64              // store revision the transaction started reading at
+	commitRevision  int64              // revision the write transaction will commit as
+	written         map[int64]struct{} // offsets written by the write transaction
+	truncated       map[int64]struct{} // written offsets the write transaction deleted
+	bases           map[int64][]byte   // delta base of each written offset, taken from its committed version
+	codec           Codec              // compression for pages written by the write transaction
+	readOnly        bool               // opened with OpenReadOnly, or degraded to it because the store is read-only
+	historical      bool               // opened with as_of, see history.go
+	asOf            int64              // revision a historical File reads the versions current at
+	clientID        string             // recorded in the changelog entries of the File's commits
+	lastCommit      int64              // revision of the File's last commit, see session.go
+	minRevision     int64              // revision read transactions wait for, see session.go
+	revisionWait    time.Duration      // how long read transactions wait for minRevision
+	localStale      bool               // the coordinator accepted the commit but the local store couldn't apply it
+	wal             bool               // the database is in WAL mode, see wal.go
+	checkpointing   bool               // txn is a write transaction holding checkpoint writes
+	shmState        *shmState
+	shmLocks        [sqlite3vfs.ShmLockSlots]sqlite3vfs.ShmLockFlag
 }
 
 func NewFile(vfs *VFS, name string) *File {
-	firstPage := make([]byte, len(firstPageTemplate))
-	copy(firstPage, firstPageTemplate)
+	db := vfs.state.dbs[vfs.storePath(name)]
 	return &File{
 		vfs:        vfs,
-		db:         vfs.state.dbs[name].db,
+		store:      db.store,
 		name:       name,
 		sectorSize: SectorSize,
+		pageSize:   int64(db.pageSize),
 		lock:       sqlite3vfs.LockNone,
 		txn:        nil,
 		revisions: skiplist.New(skiplist.GreaterThanFunc(func(k1, k2 interface{}) int {
@@ -54,23 +76,31 @@ func NewFile(vfs *VFS, name string) *File {
 			return int(k1.(PageRevision).Rev - k2.(PageRevision).Rev)
 		})),
 		versionCounter:  0,
-		firstPage:       firstPage,
+		firstPage:       firstPageFor(db.pageSize),
 		commitConfirmed: false,
 	}
 }
 
 func (f *File) Close() error {
 	// TODO: This implementation is very tightly coupled with VFS, it should be refactored
+	if f.checkpointing {
+		if err := f.finishCheckpoint(); err != nil {
+			f.vfs.logger.Error().Err(err).Msg("error committing checkpoint on close")
+		}
+	}
+	if err := f.ShmUnmap(false); err != nil {
+		f.vfs.logger.Error().Err(err).Msg("ignoring error releasing shared memory")
+	}
 	if f.txn != nil {
 		err := f.txn.Rollback()
-		if err != nil && err != bolt.ErrTxClosed {
+		if err != nil && err != ErrTxClosed {
 			f.vfs.logger.Error().Err(err).Msg("ignoring error rolling back transaction")
 		}
 	}
 	f.vfs.state.mutex.Lock()
 	defer f.vfs.state.mutex.Unlock()
-	ref, ok := f.vfs.state.dbs[f.name]
-	if !ok || ref.db != f.db {
+	ref, ok := f.vfs.state.dbs[f.vfs.storePath(f.name)]
+	if !ok || ref.store != f.store {
 		f.vfs.logger.Error().Msg("db not found in vfs state")
 		return sqlite3vfs.InternalError
 	}
@@ -80,7 +110,8 @@ func (f *File) Close() error {
 	}
 	ref.count--
 	if ref.count == 0 {
-		err := ref.db.Close()
+		delete(f.vfs.state.dbs, f.vfs.storePath(f.name))
+		err := ref.store.Close()
 		if err != nil {
 			f.vfs.logger.Error().Err(err).Msg("error closing db")
 			return sqlite3vfs.IOError
@@ -102,9 +133,14 @@ func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
 		return copy(p, f.firstPage), nil
 	}
 
-	if off%SectorSize != 0 || len(p)%SectorSize != 0 {
+	if off < 0 {
+		f.vfs.logger.Error().Msg("unexpected negative read offset")
+		return 0, sqlite3vfs.IOError
+	}
+
+	if off%f.pageSize != 0 || int64(len(p))%f.pageSize != 0 {
 		// Indicates a partial read of the first page
-		if off >= SectorSize || len(p) >= SectorSize || off+int64(len(p)) > SectorSize {
+		if off >= f.pageSize || int64(len(p)) >= f.pageSize || off+int64(len(p)) > f.pageSize {
 			f.vfs.logger.Error().Msg("unexpected read offset or size")
 			return 0, sqlite3vfs.IOError
 		}
@@ -164,7 +200,11 @@ func (f *File) readPage(off int64, opts ...readPageOption) (result []byte, err e
 			err = sqlite3vfs.IOError
 		}
 	}()
-	page, found := f.rawPage(off)
+	page, found, err := f.rawPage(off)
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Int64("offset", off).Msg("error fetching page")
+		return nil, sqlite3vfs.IOError
+	}
 	if !found {
 		if off == 0 && options.defaultFirstPage { // TODO: We can get rid of this
 			return f.firstPage, nil
@@ -174,37 +214,64 @@ func (f *File) readPage(off int64, opts ...readPageOption) (result []byte, err e
 
 	}
 
-	unionTable := new(flatbuffers.Table)
-	if !page.Data(unionTable) {
-		f.vfs.logger.Error().Msg("page data not found")
+	bytes, ref, err := decodePage(page)
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Int64("offset", off).Msg("error decoding page")
 		return nil, sqlite3vfs.IOError
 	}
+	if ref != nil {
+		bytes, err = f.vfs.resolveRef(f.txn, f.name, ref)
+		if err != nil {
+			f.vfs.logger.Error().Err(err).Int64("offset", off).Msg("error fetching page content")
+			return nil, sqlite3vfs.IOError
+		}
+		if bytes == nil {
+			f.vfs.logger.Error().Int64("offset", off).Hex("hash", ref.hash).Msg("page content not found")
+			return nil, sqlite3vfs.IOError
+		}
+	}
 
-	if !options.dontRecord {
+	if !options.dontRecord && !f.wal {
 		f.revisions.Set(PageRevision{Offset: off, Rev: page.Revision()}, struct{}{})
 	}
 
-	if page.DataType() != pageSchema.DataReal {
-		// TODO
-		panic("data is a ref or none and we're not ready for that")
-	}
-	realData := new(pageSchema.Real)
-	realData.Init(unionTable.Bytes, unionTable.Pos)
-	bytes := realData.DataBytes()
 	if off == 0 {
-		return spliceVersion(bytes, f.versionCounter), nil
+		if f.spliced.data != nil && !f.txn.Writable() && f.spliced.revision == page.Revision() && f.spliced.counter == f.versionCounter {
+			return f.spliced.data, nil
+		}
+		bytes = spliceVersion(bytes, f.versionCounter)
+		if f.historical {
+			// The WAL that went with a past state is gone, SQLite reads it in rollback journal mode
+			bytes[18], bytes[19] = 1, 1
+		}
+		if !f.txn.Writable() {
+			// Committed first pages are immutable at a revision, those written by a write transaction aren't
+			f.spliced = splicedPage{revision: page.Revision(), counter: f.versionCounter, data: bytes}
+		}
 	}
 	return bytes, nil
 }
 
-func (f *File) rawPage(off int64) (*pageSchema.Page, bool) {
-	buf := f.txn.Bucket(pagesKey).Get(offsetKey(off))
-	if buf == nil {
-		return nil, false
+func (f *File) rawPage(off int64) (*pageSchema.Page, bool, error) {
+	var buf []byte
+	if f.historical {
+		buf, _ = f.txn.GetVersion(off, f.asOf)
+	} else {
+		buf = f.txn.Get(off)
+	}
+	if len(buf) == 0 {
+		return nil, false, nil
 	}
-
 	page := pageSchema.GetRootAsPage(buf, 0)
-	return page, true
+	return page, true, nil
+}
+
+// splicedPage is the first page as readPage last returned it, reused while its revision and the version counter are
+// unchanged
+type splicedPage struct {
+	revision int64
+	counter  uint32
+	data     []byte
 }
 
 func spliceVersion(bytes []byte, version uint32) []byte {
@@ -217,38 +284,37 @@ func spliceVersion(bytes []byte, version uint32) []byte {
 	return buf
 }
 
-func offsetKey(off int64) []byte {
-	return binary.BigEndian.AppendUint64(nil, uint64(off))
-}
-
 func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
 	f.vfs.logger.Debug().Int64("offset", off).Msg("write at")
-	if off%SectorSize != 0 {
+	if f.readOnly {
+		return 0, sqlite3vfs.ReadOnlyError
+	}
+	if off%f.pageSize != 0 {
 		f.vfs.logger.Error().Msg("unexpected write offset")
 		return 0, sqlite3vfs.IOError
 	}
 
-	if len(p) != SectorSize {
+	if int64(len(p)) != f.pageSize {
 		f.vfs.logger.Error().Msg("unexpected write size")
 		return 0, sqlite3vfs.IOError
 	}
 
-	if f.txn == nil || !f.txn.Writable() {
-		f.vfs.logger.Error().Msg("unexpected write without transaction")
-		return 0, sqlite3vfs.IOError
+	if err = f.prepareWrite(); err != nil {
+		return 0, err
 	}
 
 	if off == 0 {
 		// validate page size didn't change (taken from mvsqlite)
-		pageSize := binary.BigEndian.Uint16(p[16:18])
-		if pageSize != SectorSize {
+		if int64(headerPageSize(p)) != f.pageSize {
 			f.vfs.logger.Error().Msg("attempting to change page size")
 			return 0, sqlite3vfs.IOError
 		}
-		if p[18] == 2 || p[19] == 2 {
-			f.vfs.logger.Error().Msg("attempting to enable WAL mode")
+		wal := p[18] == 2 || p[19] == 2
+		if wal && f.vfs.coordinator != nil {
+			f.vfs.logger.Error().Msg("attempting to enable WAL mode with a coordinator")
 			return 0, sqlite3vfs.IOError
 		}
+		f.wal = wal
 		p = spliceVersion(p, 0)
 	}
 
@@ -258,8 +324,8 @@ func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
 			f.vfs.logger.Error().Msg("error writing page")
 			return n, err
 		}
-		n += SectorSize
-		off += SectorSize
+		n += int(f.pageSize)
+		off += f.pageSize
 	}
 	return n, err
 }
@@ -272,49 +338,106 @@ func (f *File) writePage(p []byte, off int64) (err error) {
 			err = sqlite3vfs.IOError
 		}
 	}()
+	if _, ok := f.written[off]; !ok {
+		f.bases[off] = bytes.Clone(deltaBase(f.txn, off))
+	}
+	ref, err := f.encodePage(off, p[:f.pageSize])
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error writing page content")
+		return sqlite3vfs.IOError
+	}
+	err = f.txn.Put(off, newRefPage(f.commitRevision, ref))
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error writing page")
+		return sqlite3vfs.IOError
+	}
+	f.written[off] = struct{}{}
+	delete(f.truncated, off)
+	return nil
+}
+
+// newRealPage serializes a page envelope holding data verbatim
+func newRealPage(revision int64, data []byte) []byte {
 	builder := flatbuffers.NewBuilder(0)
-	realData := builder.CreateByteVector(p)
+	realData := builder.CreateByteVector(data)
 	pageSchema.RealStart(builder)
 	pageSchema.RealAddData(builder, realData)
 	realPtr := pageSchema.RealEnd(builder)
 	pageSchema.PageStart(builder)
-	pageSchema.PageAddRevision(builder, int64(f.versionCounter))
+	pageSchema.PageAddRevision(builder, revision)
 	pageSchema.PageAddDataType(builder, pageSchema.DataReal)
 	pageSchema.PageAddData(builder, realPtr)
 	root := pageSchema.PageEnd(builder)
 	builder.Finish(root)
-	buf := builder.FinishedBytes()
+	return builder.FinishedBytes()
+}
 
-	err = f.txn.Bucket(pagesKey).Put(offsetKey(off), buf)
+// Truncate deletes every page starting at or after size in the write transaction
+func (f *File) Truncate(size int64) error {
+	f.vfs.logger.Debug().Int64("size", size).Msg("truncate")
+	if f.readOnly {
+		return sqlite3vfs.ReadOnlyError
+	}
+	if err := f.prepareWrite(); err != nil {
+		return err
+	}
+	var offsets []int64
+	err := f.txn.ForEach(func(off int64, page []byte) error {
+		if off >= size {
+			offsets = append(offsets, off)
+		}
+		return nil
+	})
 	if err != nil {
-		f.vfs.logger.Error().Err(err).Msg("error writing page")
+		f.vfs.logger.Error().Err(err).Msg("error listing pages to truncate")
 		return sqlite3vfs.IOError
 	}
-	return nil
-}
-
-func (f *File) Truncate(size int64) error {
-	// TODO: Actually clear unused space
+	for _, off := range offsets {
+		if err = f.txn.Delete(off); err != nil {
+			f.vfs.logger.Error().Err(err).Int64("offset", off).Msg("error deleting page")
+			return sqlite3vfs.IOError
+		}
+		f.written[off] = struct{}{}
+		f.truncated[off] = struct{}{}
+	}
 	return nil
 }
 
 func (f *File) Sync(flag sqlite3vfs.SyncType) error {
+	if f.checkpointing {
+		if err := f.finishCheckpoint(); err != nil {
+			f.vfs.logger.Error().Err(err).Msg("error committing checkpoint")
+			return sqlite3vfs.IOError
+		}
+	}
 	return nil
 }
 
+// FileSize returns the end of the last page in the transaction's snapshot, or in the latest snapshot outside of one
 func (f *File) FileSize() (int64, error) {
-	// TODO: Read max offset instead
-	if f.txn == nil {
-		f.vfs.logger.Warn().Msg("unexpected file size call without transaction")
-		return SectorSize, nil
+	txn := f.txn
+	if txn == nil {
+		var err error
+		txn, err = f.store.Begin(false)
+		if err != nil {
+			f.vfs.logger.Error().Err(err).Msg("error starting transaction")
+			return 0, sqlite3vfs.IOError
+		}
+		defer func() { _ = txn.Rollback() }()
 	}
-	p, err := f.readPage(0, dontRecord(), defaultFirstPage())
-	if err != nil {
-		f.vfs.logger.Error().Msg("error reading first page")
-		return 0, err
+	if f.historical {
+		size, err := f.historicalSize(txn)
+		if err != nil {
+			f.vfs.logger.Error().Err(err).Msg("error reading past database size")
+			return 0, sqlite3vfs.IOError
+		}
+		return size, nil
+	}
+	last, ok := txn.LastOffset()
+	if !ok {
+		return 0, nil
 	}
-	nPages := binary.BigEndian.Uint32(p[28:32])
-	return int64(nPages) * SectorSize, nil
+	return last + f.pageSize, nil
 }
 
 func (f *File) Lock(elock sqlite3vfs.LockType) error {
@@ -330,19 +453,45 @@ func (f *File) Lock(elock sqlite3vfs.LockType) error {
 		f.vfs.logger.Error().Msg("lock received unexpected lower type")
 		return sqlite3vfs.IOError
 	}
+	if f.readOnly && elock > sqlite3vfs.LockShared {
+		return sqlite3vfs.ReadOnlyError
+	}
 
 	if f.txn == nil {
 		if elock != sqlite3vfs.LockShared {
 			f.vfs.logger.Error().Msg("unexpected lock type received with no transaction")
 			return sqlite3vfs.IOError
 		}
+		if err := f.waitForMinRevision(); err != nil {
+			f.vfs.logger.Warn().Err(err).Str("db", f.name).Msg("error waiting for min_revision")
+			return sqlite3vfs.BusyError
+		}
+		if f.vfs.coordinator != nil {
+			err := f.vfs.catchUp(f.store, f.name)
+			if err != nil {
+				f.vfs.logger.Error().Err(err).Msg("error catching up with coordinator")
+				return sqlite3vfs.IOError
+			}
+		}
 		var err error
-		f.txn, err = f.db.Begin(false)
+		f.txn, err = f.store.Begin(false)
 		if err != nil {
 			f.vfs.logger.Error().Err(err).Msg("error starting transaction")
 			return sqlite3vfs.IOError
 		}
+		if rev := storedRevision(f.txn); rev != f.readRevision {
+			// Committed by another File, or applied to a replica, since this File last read
+			f.versionCounter += 2
+			f.readRevision = rev
+		}
+		if pageSize := int64(storedPageSize(f.txn)); pageSize != f.pageSize {
+			f.pageSize = pageSize
+			f.firstPage = firstPageFor(int(pageSize))
+		}
 		f.revisions.Init()
+		f.wal = f.walMode()
+	} else if f.wal {
+		// WAL mode writers are serialized by the WAL index locks, database writes are checkpoints (see prepareWrite)
 	} else if elock == sqlite3vfs.LockReserved {
 		// Replace the transaction with a writable transaction
 		// Note: We're maintaining a revisions map, so we can check that they haven't changed when switching to a write transaction
@@ -351,7 +500,7 @@ func (f *File) Lock(elock sqlite3vfs.LockType) error {
 			f.vfs.logger.Error().Err(err).Msg("error rolling back transaction")
 			return sqlite3vfs.IOError
 		}
-		f.txn, err = f.db.Begin(true)
+		f.txn, err = f.store.Begin(true)
 		if err != nil {
 			f.vfs.logger.Error().Err(err).Msg("error starting write transaction")
 			return sqlite3vfs.IOError
@@ -363,12 +512,12 @@ func (f *File) Lock(elock sqlite3vfs.LockType) error {
 			elem := f.revisions.Front()
 			for elem != nil {
 				rev := elem.Key().(PageRevision)
-				page, _ := f.rawPage(rev.Offset)
-				if page == nil {
-					f.vfs.logger.Error().Msg("error reading page")
+				page, found, err := f.rawPage(rev.Offset)
+				if err != nil {
+					f.vfs.logger.Error().Err(err).Msg("error reading page")
 					return sqlite3vfs.IOError
 				}
-				if rev.Rev != page.Revision() {
+				if !found || rev.Rev != page.Revision() {
 					f.vfs.logger.Error().Msg("phantom read detected")
 					err = f.txn.Rollback()
 					if err != nil {
@@ -379,12 +528,23 @@ func (f *File) Lock(elock sqlite3vfs.LockType) error {
 				elem = elem.Next()
 			}
 		}
+		// Everything read so far is unchanged at the write transaction's revision, so reads can be validated from there
+		f.readRevision = storedRevision(f.txn)
+		f.commitRevision = f.readRevision + 1
+		f.written = make(map[int64]struct{})
+		f.truncated = make(map[int64]struct{})
+		f.bases = make(map[int64][]byte)
+		f.codec = f.vfs.databaseCodec(f.txn)
+		f.localStale = false
 	}
 	f.lock = elock
 	return nil
 }
 
 func (f *File) ConfirmCommit() error {
+	if f.wal && (f.txn == nil || !f.txn.Writable() || f.checkpointing) {
+		return nil // The transaction was committed to the WAL
+	}
 	if f.txn == nil || !f.txn.Writable() {
 		f.vfs.logger.Error().Msg("unexpected commit confirmation without transaction")
 		return sqlite3vfs.IOError
@@ -397,6 +557,27 @@ func (f *File) ConfirmCommit() error {
 		f.vfs.logger.Error().Msg("commit already confirmed")
 		return sqlite3vfs.IOError
 	}
+	if f.vfs.coordinator != nil {
+		rev, err := f.commitToCoordinator()
+		if errors.Is(err, coordinator.ErrConflict) {
+			f.vfs.logger.Info().Msg("commit conflicts with another writer")
+			return sqlite3vfs.BusyError
+		}
+		if err != nil {
+			f.vfs.logger.Error().Err(err).Msg("error committing to coordinator")
+			return sqlite3vfs.IOError
+		}
+		f.commitRevision = rev
+	} else {
+		err := putStoredRevision(f.txn, f.commitRevision)
+		if err == nil {
+			err = recordCommit(f.txn, f.commitRevision, f.written, f.clientID)
+		}
+		if err != nil {
+			f.vfs.logger.Error().Err(err).Msg("error recording revision")
+			return sqlite3vfs.IOError
+		}
+	}
 	f.commitConfirmed = true
 	return nil
 
@@ -407,15 +588,22 @@ func (f *File) Unlock(elock sqlite3vfs.LockType) error {
 		return nil
 	}
 
+	if f.checkpointing {
+		if err := f.finishCheckpoint(); err != nil {
+			f.vfs.logger.Error().Err(err).Msg("error committing checkpoint")
+			return sqlite3vfs.IOError
+		}
+	}
+
 	prevLock := f.lock
 	f.lock = elock
-	if prevLock >= sqlite3vfs.LockReserved && elock < sqlite3vfs.LockReserved {
+	if prevLock >= sqlite3vfs.LockReserved && elock < sqlite3vfs.LockReserved && !(f.wal && f.txn != nil && !f.txn.Writable()) {
 		if f.txn == nil || !f.txn.Writable() {
 			f.vfs.logger.Error().Msg("unexpected unlock without transaction")
 			return sqlite3vfs.IOError
 		}
 		var err error
-		if !f.commitConfirmed {
+		if !f.commitConfirmed || f.localStale {
 			err = f.txn.Rollback()
 			if err != nil {
 				f.vfs.logger.Error().Err(err).Msg("error rolling back transaction")
@@ -426,12 +614,17 @@ func (f *File) Unlock(elock sqlite3vfs.LockType) error {
 				f.vfs.logger.Error().Err(err).Msg("error committing transaction")
 				return sqlite3vfs.IOError
 			}
+			f.readRevision = f.commitRevision
+			f.recordWrites()
+			f.committed()
 		}
 
 		var err2 error
-		f.txn, err2 = f.db.Begin(false)
+		f.txn, err2 = f.store.Begin(false)
 		if err2 != nil {
 			f.vfs.logger.Error().Err(err2).Msg("error replacing transaction")
+		} else {
+			f.wal = f.walMode()
 		}
 		f.commitConfirmed = false
 		if err != nil || err2 != nil {
@@ -443,7 +636,7 @@ func (f *File) Unlock(elock sqlite3vfs.LockType) error {
 	if elock == sqlite3vfs.LockNone {
 		if f.txn != nil {
 			err := f.txn.Rollback()
-			if err != nil && err != bolt.ErrTxClosed {
+			if err != nil && err != ErrTxClosed {
 				f.vfs.logger.Error().Err(err).Msg("error rolling back transaction")
 				return sqlite3vfs.IOError
 			}
@@ -453,6 +646,26 @@ func (f *File) Unlock(elock sqlite3vfs.LockType) error {
 	return nil
 }
 
+// recordWrites replaces the recorded revisions of the pages we just committed, they were read before we wrote them
+func (f *File) recordWrites() {
+	var kept []PageRevision
+	for elem := f.revisions.Front(); elem != nil; elem = elem.Next() {
+		rev := elem.Key().(PageRevision)
+		if _, ok := f.written[rev.Offset]; !ok {
+			kept = append(kept, rev)
+		}
+	}
+	f.revisions.Init()
+	for _, rev := range kept {
+		f.revisions.Set(rev, struct{}{})
+	}
+	for off := range f.written {
+		if _, ok := f.truncated[off]; !ok {
+			f.revisions.Set(PageRevision{Offset: off, Rev: f.commitRevision}, struct{}{})
+		}
+	}
+}
+
 func (f *File) CheckReservedLock() (bool, error) {
 	return f.lock > sqlite3vfs.LockNone, nil
 }
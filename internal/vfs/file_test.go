@@ -1,31 +1,29 @@
 package vfs
 
 import (
-	"sync"
 	"testing"
 
-	"github.com/psanford/sqlite3vfs"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
 )
 
 func makeVFS() *VFS {
 	return &VFS{
-		tmp: newTempVFS(),
-		state: &globalState{
-			dbs:   make(map[string]*dbRef),
-			mutex: sync.Mutex{},
-		},
-		logger: log.Logger,
+		state:     newGlobalState(),
+		logger:    log.Logger,
+		openStore: NewMemoryStores().Open,
+		segments:  newSegmentCache(DefaultCacheSize),
+		pageSize:  DefaultPageSize,
 	}
-
 }
 
 // Tests
 func TestFile_ReadAt_FirstPage_Success(t *testing.T) {
 	vfsInstance := makeVFS()
-	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file)
 
@@ -38,7 +36,7 @@ func TestFile_ReadAt_FirstPage_Success(t *testing.T) {
 
 func TestFile_ReadAt_PageNotFound_ReturnsError(t *testing.T) {
 	vfsInstance := makeVFS()
-	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file)
 
@@ -65,7 +63,7 @@ func cleanup(t *testing.T) func(file sqlite3vfs.File) {
 
 func TestFile_WriteAt_Success(t *testing.T) {
 	vfsInstance := makeVFS()
-	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file)
 
@@ -95,7 +93,7 @@ func TestFile_WriteAt_Success(t *testing.T) {
 
 func TestFile_InvalidOffset(t *testing.T) {
 	vfsInstance := makeVFS()
-	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file)
 
@@ -119,11 +117,11 @@ func TestFile_InvalidOffset(t *testing.T) {
 
 func TestFile_ConcurrentAccess(t *testing.T) {
 	vfsInstance := makeVFS()
-	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file)
 
-	file2, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file2, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file2)
 
@@ -160,11 +158,11 @@ func TestFile_ConcurrentAccess(t *testing.T) {
 
 func TestFile_ConcurrentAccess_PhantomRead(t *testing.T) {
 	vfsInstance := makeVFS()
-	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file)
 
-	file2, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file2, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file2)
 
@@ -214,7 +212,7 @@ func TestFile_ConcurrentAccess_PhantomRead(t *testing.T) {
 
 func TestFile_FileSize(t *testing.T) {
 	vfsInstance := makeVFS()
-	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
 	require.NoError(t, err)
 	defer cleanup(t)(file)
 
@@ -223,6 +221,60 @@ func TestFile_FileSize(t *testing.T) {
 	size, err := file.FileSize()
 	require.NoError(t, err)
 	assert.Equal(t, int64(SectorSize), size, "Initial file size should be one sector size")
+
+	writePages(t, file, map[int64]string{3 * SectorSize: "four"})
+	size, err = file.FileSize()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4*SectorSize), size, "File size should end at the last page")
+	unlockForRead(t, file)
+}
+
+func TestFile_Truncate(t *testing.T) {
+	c := coordinator.NewEmbedded()
+	file, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	replica, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(replica)
+
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{SectorSize: "two", 2 * SectorSize: "three", 3 * SectorSize: "four"})
+	assert.Error(t, file.Truncate(2*SectorSize), "Truncate requires a write transaction")
+
+	lockForWrite(t, file)
+	require.NoError(t, file.Truncate(2*SectorSize))
+	require.NoError(t, file.(*File).ConfirmCommit())
+	unlockForWrite(t, file)
+
+	size, err := file.FileSize()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*SectorSize), size)
+	assert.Nil(t, file.(*File).txn.Get(3*SectorSize))
+	assertPage(t, file, SectorSize, "two")
+	unlockForRead(t, file)
+
+	lockForRead(t, replica)
+	size, err = replica.FileSize()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*SectorSize), size, "Truncation should replicate")
+	unlockForRead(t, replica)
+}
+
+func TestFile_DeduplicatesContent(t *testing.T) {
+	vfsInstance := makeVFS()
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{SectorSize: "same", 2 * SectorSize: "same", 3 * SectorSize: "other"})
+	assertPage(t, file, SectorSize, "same")
+	assertPage(t, file, 2*SectorSize, "same")
+	assertPage(t, file, 3*SectorSize, "other")
+
+	assert.Equal(t, 3, countContents(t, file), "Expected the first page plus one content per distinct page")
+	unlockForRead(t, file)
 }
 
 func lockForRead(t *testing.T, file sqlite3vfs.File) {
@@ -258,3 +310,77 @@ func unlockForRead(t *testing.T, file sqlite3vfs.File) {
 	err := file.Unlock(sqlite3vfs.LockNone)
 	require.NoError(t, err)
 }
+
+func makeCoordinatedVFS(c coordinator.Coordinator) *VFS {
+	v := makeVFS()
+	v.UseCoordinator(c)
+	return v
+}
+
+func TestFile_Coordinator_Replicates(t *testing.T) {
+	c := coordinator.NewEmbedded()
+	writerFile, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(writerFile)
+	readerFile, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(readerFile)
+
+	lockForRead(t, writerFile)
+	writePages(t, writerFile, map[int64]string{SectorSize: "Hello, World!"})
+	unlockForRead(t, writerFile)
+
+	lockForRead(t, readerFile)
+	assertPage(t, readerFile, SectorSize, "Hello, World!")
+	unlockForRead(t, readerFile)
+}
+
+func TestFile_Coordinator_Conflict(t *testing.T) {
+	c := coordinator.NewEmbedded()
+	file, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	file2, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file2)
+
+	lockForRead(t, file)
+	writePages(t, file, map[int64]string{SectorSize: "first", 2 * SectorSize: "second"})
+	unlockForRead(t, file)
+
+	lockForRead(t, file)
+	lockForRead(t, file2)
+	assertPage(t, file, SectorSize, "first")
+	assertPage(t, file2, SectorSize, "first")
+
+	writePages(t, file, map[int64]string{SectorSize: "winner"})
+
+	// file2 doesn't see the other process at the lock, the coordinator rejects the commit
+	lockForWrite(t, file2)
+	data := make([]byte, SectorSize)
+	copy(data, "loser")
+	_, err = file2.WriteAt(data, SectorSize)
+	require.NoError(t, err)
+	err = file2.(*File).ConfirmCommit()
+	assert.Equal(t, sqlite3vfs.BusyError, err, "Should return a BusyError when a page read was committed by another process")
+	unlockForWrite(t, file2)
+	unlockForRead(t, file2)
+
+	lockForRead(t, file2)
+	assertPage(t, file2, SectorSize, "winner")
+	unlockForRead(t, file2)
+
+	// Writes to pages nobody else touched go through and pick up the other process's commits
+	lockForRead(t, file2)
+	assertPage(t, file2, 2*SectorSize, "second")
+	writePages(t, file, map[int64]string{SectorSize: "third"})
+	writePages(t, file2, map[int64]string{2 * SectorSize: "fourth"})
+	assertPage(t, file2, SectorSize, "third")
+	assertPage(t, file2, 2*SectorSize, "fourth")
+	unlockForRead(t, file2)
+	unlockForRead(t, file)
+
+	lockForRead(t, file)
+	assertPage(t, file, 2*SectorSize, "fourth")
+	unlockForRead(t, file)
+}
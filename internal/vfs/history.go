@@ -0,0 +1,309 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	pageSchema "s3qlite/internal/schema/page"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// Every commit records the envelopes it wrote as versions keyed by offset and revision (see PageTxn.PutVersion), next
+// to the current ones, along with a commit record holding the time of the commit. A File opened with the as_of URI
+// parameter is read-only and reads the versions that were current at that revision instead of the current pages, the
+// WAL of the database is hidden from it. Commit records are the entries of the changelog, see changelog.go.
+// Versions refer to contents like current pages do, so GC keeps the contents of every version.
+//
+// History is kept from the revision under the history meta key on. Stores that predate it record their current pages
+// as versions the first time they're opened read-write, and a replica that caught up without the coordinator's commit
+// history only has accurate versions from the revision it caught up to.
+//
+// History is kept forever unless it is pruned, by PruneHistory or by GC under Options.HistoryRetention. Pruning moves
+// the start of history forward to a revision, deleting the commit records before it and the versions that stopped
+// being current at or before it. The database can still be read as of that revision, and changelog followers aren't
+// pruned past.
+
+var historyMetaKey = "history"
+
+// historyStart returns the first revision the store has history for, ok is false when it keeps none
+func historyStart(txn PageTxn) (int64, bool) {
+	buf := txn.GetMeta(historyMetaKey)
+	if len(buf) != 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(buf)), true
+}
+
+func putHistoryStart(txn PageTxn, rev int64) error {
+	return txn.PutMeta(historyMetaKey, binary.BigEndian.AppendUint64(nil, uint64(rev)))
+}
+
+// startHistory records the current pages of a store that keeps no history yet as their versions
+func startHistory(store PageStore) error {
+	txn, err := store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if _, ok := historyStart(txn); ok {
+		return nil
+	}
+	err = txn.ForEach(func(off int64, buf []byte) error {
+		return txn.PutVersion(off, pageSchema.GetRootAsPage(buf, 0).Revision(), buf)
+	})
+	if err != nil {
+		return err
+	}
+	if err = putHistoryStart(txn, storedRevision(txn)); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// recordCommit records the pages at the written offsets as the versions of the commit of revision rev, and the commit
+// as made now by clientID
+func recordCommit(txn PageTxn, rev int64, written map[int64]struct{}, clientID string) error {
+	return recordEntry(txn, ChangelogEntry{Revision: rev, Time: time.Now(), Offsets: sortedOffsets(written), ClientID: clientID})
+}
+
+// recordEntry records the pages at the offsets of entry as the versions of its commit, and the entry
+func recordEntry(txn PageTxn, entry ChangelogEntry) error {
+	for _, off := range entry.Offsets {
+		if err := txn.PutVersion(off, entry.Revision, txn.Get(off)); err != nil {
+			return err
+		}
+	}
+	return txn.PutCommit(entry.Revision, encodeCommitRecord(entry))
+}
+
+// HistoryRetention bounds the history of a database that pruning keeps, the zero value keeps all of it. When both
+// fields are set history is kept as long as either keeps it.
+type HistoryRetention struct {
+	Commits int           // the states after the last Commits commits stay readable
+	Age     time.Duration // the states the database was in within Age stay readable
+}
+
+// pruneStart returns the revision history can start at under retention, 0 when nothing can be pruned
+func pruneStart(txn PageTxn, retention HistoryRetention, now time.Time) (int64, error) {
+	start, ok := historyStart(txn)
+	if !ok || (retention.Commits <= 0 && retention.Age <= 0) {
+		return 0, nil
+	}
+	var revisions []int64
+	var byAge int64
+	err := txn.ForEachCommit(start, func(rev int64, record []byte) error {
+		revisions = append(revisions, rev)
+		if retention.Age > 0 && !commitTime(record).After(now.Add(-retention.Age)) {
+			byAge = rev // The state at the cutoff
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	before := int64(math.MaxInt64)
+	if retention.Commits > 0 {
+		byCommits := int64(0)
+		if len(revisions) > retention.Commits {
+			byCommits = revisions[len(revisions)-retention.Commits]
+		}
+		before = min(before, byCommits)
+	}
+	if retention.Age > 0 {
+		before = min(before, byAge)
+	}
+	if before <= start {
+		return 0, nil
+	}
+	return before, nil
+}
+
+// pruneHistory starts the history of the store at revision before, returning the number of versions deleted
+func pruneHistory(txn PageTxn, before int64) (int, error) {
+	if start, ok := historyStart(txn); !ok || before <= start {
+		return 0, nil
+	}
+	before = min(before, storedRevision(txn))
+
+	// A version is stale once a later version of its page is current at before. The one current at before is kept
+	// unless it is a deletion.
+	type version struct{ off, rev int64 }
+	var stale []version
+	var current version
+	currentDeleted, seen := false, false
+	flush := func() {
+		if seen && currentDeleted {
+			stale = append(stale, current)
+		}
+		seen = false
+	}
+	err := txn.ForEachVersion(func(off int64, rev int64, page []byte) error {
+		if seen && off != current.off {
+			flush()
+		}
+		if rev > before {
+			return nil
+		}
+		if seen {
+			stale = append(stale, current)
+		}
+		current, currentDeleted, seen = version{off: off, rev: rev}, len(page) == 0, true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	flush()
+	for _, v := range stale {
+		if err = txn.DeleteVersion(v.off, v.rev); err != nil {
+			return 0, err
+		}
+	}
+
+	var commits []int64
+	err = txn.ForEachCommit(0, func(rev int64, record []byte) error {
+		if rev >= before {
+			return errStopIteration
+		}
+		commits = append(commits, rev)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return 0, err
+	}
+	for _, rev := range commits {
+		if err = txn.DeleteCommit(rev); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), putHistoryStart(txn, before)
+}
+
+// PruneHistory drops the history of the named database that retention doesn't keep, so GC can delete the contents
+// only pruned versions referred to. It returns the number of versions deleted.
+func (v *VFS) PruneHistory(name string, retention HistoryRetention) (int, error) {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadWrite, true)
+	if errors.Is(err, sqlite3vfs.CantOpenError) {
+		return 0, fmt.Errorf("database %s not found", name)
+	} else if err != nil {
+		return 0, err
+	}
+	defer release()
+	txn, err := store.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	pruned, err := v.pruneHistory(txn, name, retention)
+	if err != nil {
+		return 0, err
+	}
+	return pruned, txn.Commit()
+}
+
+// pruneHistory prunes under retention in txn, keeping the history the followers of the database still need
+func (v *VFS) pruneHistory(txn PageTxn, name string, retention HistoryRetention) (int, error) {
+	before, err := pruneStart(txn, retention, time.Now())
+	if err != nil || before == 0 {
+		return 0, err
+	}
+	v.followMutex.Lock()
+	for f := range v.followers[name] {
+		before = min(before, f.revision.Load())
+	}
+	v.followMutex.Unlock()
+	return pruneHistory(txn, before)
+}
+
+// asOf selects a past state of a database by revision, or by time when at is set
+type asOf struct {
+	revision int64
+	at       time.Time
+}
+
+func parseAsOf(value string) (asOf, error) {
+	if rev, err := strconv.ParseInt(value, 10, 64); err == nil && rev >= 0 {
+		return asOf{revision: rev}, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return asOf{}, fmt.Errorf("as_of must be a revision or an RFC 3339 time, got %q", value)
+	}
+	return asOf{at: at}, nil
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// resolveAsOf returns the revision a historical File of the database reads at
+func resolveAsOf(store PageStore, selected asOf) (int64, error) {
+	txn, err := store.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	start, ok := historyStart(txn)
+	if !ok {
+		return 0, errors.New("the database keeps no history")
+	}
+	rev := selected.revision
+	if !selected.at.IsZero() {
+		rev = -1
+		err = txn.ForEachCommit(start, func(r int64, record []byte) error {
+			if commitTime(record).After(selected.at) {
+				return errStopIteration
+			}
+			rev = r
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIteration) {
+			return 0, err
+		}
+		if rev < 0 {
+			return 0, fmt.Errorf("no commit was recorded at or before %s", selected.at.Format(time.RFC3339Nano))
+		}
+	}
+	if rev < start {
+		return 0, fmt.Errorf("history before revision %d isn't kept", start)
+	}
+	if current := storedRevision(txn); rev > current {
+		return 0, fmt.Errorf("revision %d is ahead of the database at revision %d", rev, current)
+	}
+	return rev, nil
+}
+
+// openAsOf returns the revision a historical File of the database reads at
+func (v *VFS) openAsOf(store PageStore, name string, selected asOf) (int64, error) {
+	if v.coordinator != nil {
+		// The revision may have been committed by another process
+		if err := v.catchUp(store, name); err != nil {
+			return 0, err
+		}
+	}
+	return resolveAsOf(store, selected)
+}
+
+// versionPage returns the data of the version of the page at off current at revision rev, nil if there was none
+func (v *VFS) versionPage(txn PageTxn, name string, off int64, rev int64) ([]byte, error) {
+	buf, _ := txn.GetVersion(off, rev)
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	return v.envelopeData(txn, name, buf)
+}
+
+// historicalSize returns the size of the database file at the revision of a historical File. The header of every
+// stored first page has the same change counter and version-valid-for number, so its page count is always valid.
+func (f *File) historicalSize(txn PageTxn) (int64, error) {
+	header, err := f.vfs.versionPage(txn, f.name, 0, f.asOf)
+	if err != nil {
+		return 0, err
+	}
+	if len(header) < 100 {
+		return 0, nil
+	}
+	return int64(binary.BigEndian.Uint32(header[28:32])) * f.pageSize, nil
+}
@@ -0,0 +1,136 @@
+package vfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestVFS_AsOf(t *testing.T) {
+	logger := zerolog.Nop()
+	vfsInstance, err := NewVFS(Options{DataDir: t.TempDir(), TmpDir: t.TempDir(), Logger: &logger})
+	require.NoError(t, err)
+	vfsInstance.UseDeltaEncoding()
+	require.NoError(t, sqlite3vfs.RegisterVFS("skylite-history", vfsInstance))
+	defer func() {
+		require.NoError(t, sqlite3vfs.UnregisterVFS("skylite-history"))
+	}()
+
+	conn, err := sqlite3vfs.OpenConn("file:history.db?vfs=skylite-history")
+	require.NoError(t, err)
+	defer conn.Close()
+	revision := func() int64 {
+		info, err := vfsInstance.Info("history.db")
+		require.NoError(t, err)
+		return info.Revision
+	}
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)"))
+	require.NoError(t, conn.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 100) INSERT INTO t (v) SELECT printf('row %d', i) FROM n"))
+	small := revision()
+	between := time.Now().UTC()
+	require.NoError(t, conn.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 400) INSERT INTO t (v) SELECT printf('more %d', i) FROM n"))
+	large := revision()
+	require.NoError(t, conn.Exec("DELETE FROM t; VACUUM"))
+	require.NoError(t, conn.Exec("PRAGMA journal_mode = WAL; INSERT INTO t (v) VALUES ('wal'); PRAGMA wal_checkpoint(TRUNCATE)"))
+
+	count := func(uri string) string {
+		past, err := sqlite3vfs.OpenConn(uri)
+		require.NoError(t, err)
+		defer past.Close()
+		rows, err := past.Query("PRAGMA integrity_check")
+		require.NoError(t, err)
+		assert.Equal(t, [][]string{{"ok"}}, rows)
+		assert.Error(t, past.Exec("INSERT INTO t (v) VALUES ('rewrite history')"), "Past states are read-only")
+		rows, err = past.Query("SELECT count(*) FROM t")
+		require.NoError(t, err)
+		return rows[0][0]
+	}
+	assert.Equal(t, "100", count(fmt.Sprintf("file:history.db?vfs=skylite-history&as_of=%d", small)))
+	assert.Equal(t, "500", count(fmt.Sprintf("file:history.db?vfs=skylite-history&as_of=%d", large)))
+	assert.Equal(t, "100", count("file:history.db?vfs=skylite-history&as_of="+between.Format(time.RFC3339Nano)))
+	assert.Equal(t, "1", count(fmt.Sprintf("file:history.db?vfs=skylite-history&as_of=%d", revision())),
+		"The latest checkpointed state of a WAL database is read in rollback journal mode")
+
+	_, err = sqlite3vfs.OpenConn(fmt.Sprintf("file:history.db?vfs=skylite-history&as_of=%d", revision()+1))
+	assert.Error(t, err)
+	_, err = sqlite3vfs.OpenConn("file:missing.db?vfs=skylite-history&as_of=1")
+	assert.Error(t, err)
+	_, err = vfsInstance.Info("missing.db")
+	assert.ErrorContains(t, err, "not found", "Opening a past state shouldn't create the database")
+
+	rows, err := conn.Query("SELECT count(*) FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"1"}}, rows, "Reading the past doesn't affect the present")
+}
+
+func TestStartHistory(t *testing.T) {
+	stores := NewMemoryStores()
+	store, err := stores.Open("test.db", sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	txn, err := store.Begin(true)
+	require.NoError(t, err)
+	hash, err := storeContent(txn, sector("old"), CodecNone)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(SectorSize, newRefPage(3, pageRef{hash: hash})))
+	require.NoError(t, putStoredRevision(txn, 4))
+	require.NoError(t, txn.Commit())
+
+	vfsInstance := makeVFS()
+	vfsInstance.openStore = stores.Open
+	writeDatabase(t, vfsInstance, "test.db", "new")
+	_, err = vfsInstance.ReadPageAt("test.db", SectorSize, 3)
+	assert.ErrorContains(t, err, "no history is kept for revision 3")
+	page, err := vfsInstance.ReadPageAt("test.db", SectorSize, 4)
+	require.NoError(t, err)
+	assert.Equal(t, sector("old"), page, "Pages predating history should be kept as versions at the revision it starts")
+	page, err = vfsInstance.ReadPageAt("test.db", SectorSize, 5)
+	require.NoError(t, err)
+	assert.Equal(t, sector("new"), page)
+	_, err = vfsInstance.ReadPageAt("test.db", SectorSize, 6)
+	assert.Error(t, err)
+}
+
+func TestVFS_PruneHistory(t *testing.T) {
+	stores := NewMemoryStores()
+	vfsInstance := makeVFS()
+	vfsInstance.openStore = stores.Open
+	writeDatabase(t, vfsInstance, "test.db", "one", "two")
+	writeDatabase(t, vfsInstance, "test.db", "uno", "two")
+	writeDatabase(t, vfsInstance, "test.db", "eins", "two")
+
+	pruned, err := vfsInstance.PruneHistory("test.db", HistoryRetention{Age: time.Hour})
+	require.NoError(t, err)
+	assert.Zero(t, pruned, "Recent history should be kept")
+
+	vfsInstance.retention = HistoryRetention{Commits: 2}
+	deleted, _, err := vfsInstance.GC("test.db")
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted, "The created header and the first page only pruned versions refer to should be deleted")
+	_, err = vfsInstance.ReadPageAt("test.db", SectorSize, 1)
+	assert.ErrorContains(t, err, "no history is kept for revision 1")
+	page, err := vfsInstance.ReadPageAt("test.db", SectorSize, 2)
+	require.NoError(t, err)
+	assert.Equal(t, sector("uno"), page, "The state history starts at should stay readable")
+	page, err = vfsInstance.ReadPageAt("test.db", 2*SectorSize, 2)
+	require.NoError(t, err)
+	assert.Equal(t, sector("two"), page)
+
+	var revisions []int64
+	require.NoError(t, vfsInstance.Changelog("test.db", 0, func(entry ChangelogEntry) error {
+		revisions = append(revisions, entry.Revision)
+		return nil
+	}))
+	assert.Equal(t, []int64{2, 3}, revisions, "The changelog should start at the commit history starts at")
+
+	pruned, err = vfsInstance.PruneHistory("test.db", HistoryRetention{Commits: 2})
+	require.NoError(t, err)
+	assert.Zero(t, pruned)
+	problems, err := vfsInstance.Verify("test.db")
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
@@ -0,0 +1,183 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// Import reads the plain SQLite file from r into the named database, which must not exist yet or never have been
+// written to. The file is validated as it is read and stored page by page in a single transaction, so the database is
+// either imported in full or left empty and the import can be retried. Databases in WAL mode are imported in rollback
+// journal mode, their WAL must have been checkpointed. It returns the number of pages imported.
+func (v *VFS) Import(name string, r io.Reader) (int64, error) {
+	return v.importFrom(name, r, -1)
+}
+
+// importFrom imports the file of size bytes read from r, a negative size if it isn't known
+func (v *VFS) importFrom(name string, r io.Reader, size int64) (int64, error) {
+	if v.coordinator != nil {
+		return 0, errors.New("import isn't supported with a coordinator")
+	}
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+	pageSize, err := checkHeader(header, size)
+	if err != nil {
+		return 0, err
+	}
+
+	// Commits in the WAL of a database don't count in its revision until they're checkpointed
+	if pending, err := v.pendingWAL(name); err != nil {
+		return 0, err
+	} else if pending {
+		return 0, fmt.Errorf("database %s already exists", name)
+	}
+	store, release, err := v.createStore(name, pageSize)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	txn, err := store.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if storedRevision(txn) != 0 {
+		return 0, fmt.Errorf("database %s already exists", name)
+	}
+	codec := v.databaseCodec(txn)
+	revision := int64(1)
+
+	page := make([]byte, pageSize)
+	copy(page, header)
+	pages := int64(0)
+	written := make(map[int64]struct{})
+	for {
+		start := 0
+		if pages == 0 {
+			start = len(header)
+		}
+		n, err := io.ReadFull(r, page[start:])
+		if errors.Is(err, io.EOF) && pages > 0 {
+			break
+		} else if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("page %d is truncated to %d bytes", pages+1, start+n)
+		} else if err != nil {
+			return 0, err
+		}
+		data := page
+		if pages == 0 {
+			// Rollback journal mode, and no change counter like every first page we store (see spliceVersion)
+			data = spliceVersion(page, 0)
+			data[18], data[19] = 1, 1
+		}
+		hash, err := storeContent(txn, data, codec)
+		if err != nil {
+			return 0, err
+		}
+		if err = txn.Put(pages*int64(pageSize), newRefPage(revision, pageRef{hash: hash})); err != nil {
+			return 0, err
+		}
+		written[pages*int64(pageSize)] = struct{}{}
+		pages++
+	}
+
+	if count := headerPageCount(header); count != 0 && count != pages {
+		return 0, fmt.Errorf("header counts %d pages but the file holds %d", count, pages)
+	}
+	if err = putStoredRevision(txn, revision); err != nil {
+		return 0, err
+	}
+	if err = recordCommit(txn, revision, written, v.clientID); err != nil {
+		return 0, err
+	}
+	// An empty database seeded by an earlier attempt may have another page size
+	if err = putStoredPageSize(txn, pageSize); err != nil {
+		return 0, err
+	}
+	return pages, txn.Commit()
+}
+
+// ImportFile imports the SQLite file at path, refusing files whose WAL or rollback journal may hold changes
+func (v *VFS) ImportFile(name string, path string) (int64, error) {
+	if info, err := os.Stat(path + "-wal"); err == nil && info.Size() > 0 {
+		return 0, fmt.Errorf("%s-wal isn't empty, checkpoint the database first", path)
+	}
+	if info, err := os.Stat(path + "-journal"); err == nil && info.Size() > 0 {
+		return 0, fmt.Errorf("%s-journal exists, open the database with sqlite3 to roll it back first", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return v.importFrom(name, f, info.Size())
+}
+
+// checkHeader validates the header of a database file to import and returns its page size. The file size is checked
+// against it unless negative.
+func checkHeader(header []byte, size int64) (int, error) {
+	if !bytes.Equal(header[:16], []byte("SQLite format 3\x00")) {
+		return 0, errors.New("not a SQLite database, or an encrypted one")
+	}
+	pageSize := headerPageSize(header)
+	if !validPageSize(pageSize) {
+		return 0, fmt.Errorf("invalid page size %d", pageSize)
+	}
+	if header[18] < 1 || header[18] > 2 || header[19] < 1 || header[19] > 2 {
+		return 0, fmt.Errorf("unsupported file format version %d/%d", header[18], header[19])
+	}
+	if header[21] != 64 || header[22] != 32 || header[23] != 32 {
+		return 0, errors.New("unsupported payload fractions")
+	}
+	if header[20] != 0 {
+		return 0, fmt.Errorf("%d bytes are reserved at the end of each page, the file needs an extension to read", header[20])
+	}
+	if size < 0 {
+		return pageSize, nil
+	}
+	if size%int64(pageSize) != 0 {
+		return 0, fmt.Errorf("file size %d isn't a multiple of the page size %d, the last page is torn", size, pageSize)
+	}
+	if count := headerPageCount(header); count != 0 && count != size/int64(pageSize) {
+		return 0, fmt.Errorf("header counts %d pages but the file holds %d", count, size/int64(pageSize))
+	}
+	return pageSize, nil
+}
+
+// headerPageCount returns the page count in the header, 0 unless it's valid, when the version-valid-for number
+// matches the change counter
+func headerPageCount(header []byte) int64 {
+	if !bytes.Equal(header[24:28], header[92:96]) {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint32(header[28:32]))
+}
+
+// createStore opens the named database, creating it with pageSize if needed, and retains its store. Databases open in
+// this process are refused, others can't be written while the store is held.
+func (v *VFS) createStore(name string, pageSize int) (PageStore, func(), error) {
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	if _, ok := v.state.dbs[v.storePath(name)]; ok {
+		return nil, nil, fmt.Errorf("database %s is open", name)
+	}
+	ref, err := v.openDatabase(name, sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate, pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref.count = 1
+	v.state.dbs[v.storePath(name)] = ref
+	return ref.store, func() { v.releaseStore(name) }, nil
+}
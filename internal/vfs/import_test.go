@@ -0,0 +1,105 @@
+package vfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestVFS_Import(t *testing.T) {
+	vfsInstance := makeVFS()
+	writeDatabase(t, vfsInstance, "source.db", "one", "two")
+	var file bytes.Buffer
+	_, err := vfsInstance.Export("source.db", &file)
+	require.NoError(t, err)
+	exported := file.Bytes()
+	exported[18], exported[19] = 2, 2
+
+	_, err = vfsInstance.Import("bad.db", bytes.NewReader(bytes.Repeat([]byte{1}, SectorSize)))
+	assert.ErrorContains(t, err, "not a SQLite database")
+	_, err = vfsInstance.Import("test.db", bytes.NewReader(exported[:2*SectorSize+10]))
+	assert.ErrorContains(t, err, "page 3 is truncated to 10 bytes")
+	_, err = vfsInstance.Import("test.db", bytes.NewReader(exported[:2*SectorSize]))
+	assert.ErrorContains(t, err, "header counts 3 pages but the file holds 2")
+	reserved := bytes.Clone(exported)
+	reserved[20] = 8
+	_, err = vfsInstance.Import("test.db", bytes.NewReader(reserved))
+	assert.ErrorContains(t, err, "8 bytes are reserved at the end of each page")
+
+	// The size of files is checked before reading them
+	path := filepath.Join(t.TempDir(), "source.db")
+	require.NoError(t, os.WriteFile(path, exported[:3*SectorSize-10], 0o644))
+	_, err = vfsInstance.ImportFile("test.db", path)
+	assert.ErrorContains(t, err, "file size 12278 isn't a multiple of the page size 4096, the last page is torn")
+	require.NoError(t, os.WriteFile(path, append(bytes.Clone(exported), make([]byte, SectorSize)...), 0o644))
+	_, err = vfsInstance.ImportFile("test.db", path)
+	assert.ErrorContains(t, err, "header counts 3 pages but the file holds 4")
+
+	pages, err := vfsInstance.Import("test.db", bytes.NewReader(exported))
+	require.NoError(t, err, "A failed import should leave the database empty")
+	assert.Equal(t, int64(3), pages)
+	info, err := vfsInstance.Info("test.db")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), info.Revision)
+	assert.False(t, info.WAL)
+	header, err := vfsInstance.ReadPage("test.db", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 1}, header[18:20], "WAL mode should be converted to rollback journal mode")
+	problems, err := vfsInstance.Verify("test.db")
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	page, err := vfsInstance.ReadPage("test.db", 2*SectorSize)
+	require.NoError(t, err)
+	assert.Equal(t, sector("two"), page)
+
+	_, err = vfsInstance.Import("test.db", bytes.NewReader(exported))
+	assert.ErrorContains(t, err, "database test.db already exists")
+}
+
+func TestVFS_ImportFile_SQLite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "source.db")
+	source, err := sqlite3vfs.OpenConn("file:" + path)
+	require.NoError(t, err)
+	require.NoError(t, source.Exec("PRAGMA page_size = 8192; PRAGMA journal_mode = WAL"))
+	require.NoError(t, source.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT); CREATE INDEX t_v ON t (v)"))
+	require.NoError(t, source.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 500) INSERT INTO t (v) SELECT printf('row %d', i) FROM n"))
+
+	logger := zerolog.Nop()
+	vfsInstance, err := NewVFS(Options{DataDir: t.TempDir(), TmpDir: t.TempDir(), Logger: &logger})
+	require.NoError(t, err)
+	_, err = vfsInstance.ImportFile("import.db", path)
+	assert.ErrorContains(t, err, "checkpoint the database first")
+	require.NoError(t, source.Close())
+	_, err = os.Stat(path + "-wal")
+	require.ErrorIs(t, err, os.ErrNotExist, "Closing the last connection should checkpoint and delete the WAL")
+
+	_, err = vfsInstance.ImportFile("import.db", path)
+	require.NoError(t, err)
+	require.NoError(t, sqlite3vfs.RegisterVFS("skylite-import", vfsInstance))
+	defer func() {
+		require.NoError(t, sqlite3vfs.UnregisterVFS("skylite-import"))
+	}()
+	conn, err := sqlite3vfs.OpenConn("file:import.db?vfs=skylite-import")
+	require.NoError(t, err)
+	defer conn.Close()
+	rows, err := conn.Query("PRAGMA integrity_check")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"ok"}}, rows)
+	rows, err = conn.Query("PRAGMA journal_mode")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"delete"}}, rows)
+	rows, err = conn.Query("PRAGMA page_size")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"8192"}}, rows)
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('imported')"))
+	rows, err = conn.Query("SELECT count(*) FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"501"}}, rows)
+}
@@ -0,0 +1,170 @@
+package vfs
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultCacheSize is the memory budget of a VFS's caches when Options.CacheSize is zero
+const DefaultCacheSize = 64 << 20
+
+// Options configure a VFS. The zero value is usable, every field has a default.
+type Options struct {
+	// DataDir holds the store of every database, named after the database. Defaults to a new directory under TmpDir,
+	// which is only suitable for tests.
+	DataDir string
+
+	// TmpDir is where a new directory for SQLite's journals and temporary files is created. Defaults to os.TempDir().
+	TmpDir string
+
+	// BoltOptions are used to open database stores, defaults to DefaultBoltOptions(). ReadOnly is ignored, stores are
+	// opened read-only while only read-only Files use them.
+	BoltOptions *bolt.Options
+
+	// Logger defaults to a console logger on stderr
+	Logger *zerolog.Logger
+
+	// PageSize is the page size of new databases, defaults to DefaultPageSize. See UsePageSize.
+	PageSize int
+
+	// CacheSize is the number of bytes the VFS may use to cache data read from the object store, defaults to
+	// DefaultCacheSize.
+	CacheSize int64
+
+	// PageCacheSize is the number of bytes of page data the VFS may keep in memory, shared by every database, see
+	// pagecache.go. Defaults to DefaultPageCacheSize, a negative size disables the cache.
+	PageCacheSize int64
+
+	// DiskCacheDir holds the contents read from the object store and the coordinator across restarts, see
+	// diskcache.go. There is no disk cache when empty.
+	DiskCacheDir string
+
+	// DiskCacheSize is the number of bytes the disk cache may use, defaults to DefaultDiskCacheSize
+	DiskCacheSize int64
+
+	// HistoryRetention is the history of each database GC keeps, see history.go. History is kept forever by default.
+	HistoryRetention HistoryRetention
+
+	// LogRotateSize is the size a replication log is started over at with a snapshot, see replica_log.go. Defaults
+	// to DefaultLogRotateSize, a negative size lets logs grow forever.
+	LogRotateSize int64
+
+	// ClientID is recorded in the changelog entry of every commit made through the VFS, unless the connection gives
+	// its own with the client_id URI parameter. See changelog.go.
+	ClientID string
+}
+
+func (o Options) withDefaults() (Options, error) {
+	if o.TmpDir == "" {
+		o.TmpDir = os.TempDir()
+	}
+	if o.DataDir == "" {
+		dir, err := os.MkdirTemp(o.TmpDir, "skylite-data")
+		if err != nil {
+			return o, err
+		}
+		o.DataDir = dir
+	}
+	if o.BoltOptions == nil {
+		o.BoltOptions = DefaultBoltOptions()
+	}
+	if o.Logger == nil {
+		logger := log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		o.Logger = &logger
+	}
+	if o.PageSize == 0 {
+		o.PageSize = DefaultPageSize
+	} else if !validPageSize(o.PageSize) {
+		return o, fmt.Errorf("invalid page size %d", o.PageSize)
+	}
+	if o.CacheSize == 0 {
+		o.CacheSize = DefaultCacheSize
+	}
+	if o.PageCacheSize == 0 {
+		o.PageCacheSize = DefaultPageCacheSize
+	}
+	if o.DiskCacheSize == 0 {
+		o.DiskCacheSize = DefaultDiskCacheSize
+	}
+	if o.LogRotateSize == 0 {
+		o.LogRotateSize = DefaultLogRotateSize
+	}
+	return o, nil
+}
+
+// Database names may carry SQLite URI parameters after a '?', as in "app.db?dir=/var/lib/app&page_size=8192":
+//
+//	dir        directory holding the database's store instead of Options.DataDir, must be absolute
+//	page_size  page size of the database if it is created by this open
+//	as_of      revision, or RFC 3339 time, to read the database at (see history.go), the connection is read-only
+//	client_id  identifies the connection in the changelog entries of its commits (see changelog.go)
+//	min_revision, min_revision_timeout
+//	           revision the database must be at before a read transaction starts, and how long to wait for it as a
+//	           Go duration (see session.go)
+//
+// Databases are keyed by their store path, so the same name in different directories are different databases, and
+// VFSs with the same data directory share them. Journal and WAL names carry the parameters of their database.
+
+// nameParams are the parameters of a database name that don't select the database
+type nameParams struct {
+	pageSize int   // zero when not given
+	asOf     *asOf // nil when not given
+	clientID string
+	// zero when not given
+	minRevision        int64
+	minRevisionTimeout time.Duration
+}
+
+// parseName splits the name SQLite passed to the VFS into the database name and its parameters
+func parseName(name string) (string, nameParams, error) {
+	var params nameParams
+	name, query, _ := strings.Cut(name, "?")
+	name, _ = strings.CutPrefix(name, "/")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", params, fmt.Errorf("invalid URI parameters %q: %w", query, err)
+	}
+	if dir := values.Get("dir"); dir != "" {
+		if !filepath.IsAbs(dir) {
+			return "", params, fmt.Errorf("dir must be an absolute path, got %q", dir)
+		}
+		name = filepath.Join(dir, name)
+	}
+	if size := values.Get("page_size"); size != "" {
+		params.pageSize, err = strconv.Atoi(size)
+		if err != nil || !validPageSize(params.pageSize) {
+			return "", params, fmt.Errorf("invalid page size %q", size)
+		}
+	}
+	if value := values.Get("as_of"); value != "" {
+		selected, err := parseAsOf(value)
+		if err != nil {
+			return "", params, err
+		}
+		params.asOf = &selected
+	}
+	params.clientID = values.Get("client_id")
+	if value := values.Get("min_revision"); value != "" {
+		params.minRevision, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || params.minRevision < 0 {
+			return "", params, fmt.Errorf("invalid min_revision %q", value)
+		}
+	}
+	params.minRevisionTimeout = DefaultMinRevisionTimeout
+	if value := values.Get("min_revision_timeout"); value != "" {
+		params.minRevisionTimeout, err = time.ParseDuration(value)
+		if err != nil || params.minRevisionTimeout <= 0 {
+			return "", params, fmt.Errorf("invalid min_revision_timeout %q", value)
+		}
+	}
+	return name, params, nil
+}
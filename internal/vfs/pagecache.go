@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// The page cache keeps the data of recently read page contents in memory, keyed by content hash, so reading a page
+// whose envelope refers to cached content skips fetching it from the store, a segment or the coordinator, and
+// decompressing it or applying its delta. A hash always names the same data, so entries are valid at every revision
+// of every database and never need invalidating: a page rewritten by a commit refers to a new hash. The cache is
+// shared by every File and database of a VFS and evicts the least recently used contents once they take up more than
+// Options.PageCacheSize bytes.
+//
+// Pages held in their envelope (see content.go) aren't cached, their data is read with the envelope.
+
+// DefaultPageCacheSize is the page cache budget of a VFS when Options.PageCacheSize is zero
+const DefaultPageCacheSize = 32 << 20
+
+// PageCacheStats counts the page cache's lookups since the VFS was created
+type PageCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Bytes     int64 // size of the cached data
+}
+
+type pageCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	pages    map[string]*list.Element
+	lru      *list.List // of *cachedPage, most recently used first
+	stats    PageCacheStats
+}
+
+type cachedPage struct {
+	hash string
+	data []byte
+}
+
+// newPageCache returns a cache of capacity bytes, nil when capacity isn't positive. A nil cache holds nothing.
+func newPageCache(capacity int64) *pageCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &pageCache{
+		capacity: capacity,
+		pages:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the cached data of a content, which callers must not modify
+func (c *pageCache) get(hash []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.pages[string(hash)]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedPage).data, true
+}
+
+// put caches a copy of data, which may belong to a store transaction, and returns it
+func (c *pageCache) put(hash []byte, data []byte) []byte {
+	if c == nil || int64(len(data)) > c.capacity {
+		return data
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.pages[string(hash)]; ok {
+		return elem.Value.(*cachedPage).data
+	}
+	page := &cachedPage{hash: string(hash), data: bytes.Clone(data)}
+	c.pages[page.hash] = c.lru.PushFront(page)
+	c.stats.Bytes += int64(len(page.data))
+	for c.stats.Bytes > c.capacity {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedPage)
+		delete(c.pages, oldest.hash)
+		c.stats.Bytes -= int64(len(oldest.data))
+		c.stats.Evictions++
+	}
+	return page.data
+}
+
+func (c *pageCache) snapshot() PageCacheStats {
+	if c == nil {
+		return PageCacheStats{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// PageCacheStats returns the page cache's counters
+func (v *VFS) PageCacheStats() PageCacheStats {
+	return v.pages.snapshot()
+}
@@ -0,0 +1,61 @@
+package vfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestPageCache(t *testing.T) {
+	cache := newPageCache(10)
+	_, ok := cache.get([]byte("a"))
+	assert.False(t, ok)
+	data := []byte("12345")
+	cached := cache.put([]byte("a"), data)
+	data[0] = 'x'
+	assert.Equal(t, []byte("12345"), cached, "Cached data should be a copy")
+	cache.put([]byte("b"), []byte("6789"))
+	got, ok := cache.get([]byte("a"))
+	require.True(t, ok)
+	assert.Equal(t, []byte("12345"), got)
+
+	cache.put([]byte("c"), []byte("abc"))
+	_, ok = cache.get([]byte("b"))
+	assert.False(t, ok, "The least recently used content should be evicted")
+	_, ok = cache.get([]byte("a"))
+	assert.True(t, ok)
+	cache.put([]byte("d"), []byte("too large to cache"))
+	_, ok = cache.get([]byte("d"))
+	assert.False(t, ok)
+	assert.Equal(t, PageCacheStats{Hits: 2, Misses: 3, Evictions: 1, Entries: 2, Bytes: 8}, cache.snapshot())
+
+	var disabled *pageCache
+	assert.Equal(t, []byte("abc"), disabled.put([]byte("a"), []byte("abc")))
+	_, ok = disabled.get([]byte("a"))
+	assert.False(t, ok)
+	assert.Zero(t, newPageCache(-1).snapshot())
+}
+
+func TestPageCache_SharedByConnections(t *testing.T) {
+	vfsInstance, conn := openCaptureDatabase(t, "skylite-page-cache")
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)"))
+	require.NoError(t, conn.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 2000) INSERT INTO t (v) SELECT printf('row %d', i) FROM n"))
+
+	count := func() {
+		reader, err := sqlite3vfs.OpenConn("file:test.db?vfs=skylite-page-cache")
+		require.NoError(t, err)
+		defer reader.Close()
+		rows, err := reader.Query("SELECT count(*) FROM t")
+		require.NoError(t, err)
+		assert.Equal(t, [][]string{{"2000"}}, rows)
+	}
+	count()
+	before := vfsInstance.PageCacheStats()
+	count()
+	after := vfsInstance.PageCacheStats()
+	assert.Greater(t, after.Hits, before.Hits, "A new connection should read the pages cached by the last one")
+	assert.Equal(t, before.Misses, after.Misses)
+	assert.Positive(t, after.Bytes)
+}
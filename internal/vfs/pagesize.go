@@ -0,0 +1,68 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Databases keep the page size they were created with. It is recorded in the store metadata when the store is seeded
+// and in the first page header, which is where SQLite reads it from.
+
+const (
+	DefaultPageSize = 4096
+	MinPageSize     = 512
+	MaxPageSize     = 65536
+)
+
+var pageSizeMetaKey = "pagesize"
+
+// firstPageHeaderSize covers the database header and the b-tree page header of the empty schema table
+const firstPageHeaderSize = 108
+
+func validPageSize(size int) bool {
+	return size >= MinPageSize && size <= MaxPageSize && size&(size-1) == 0
+}
+
+// UsePageSize sets the page size of databases created by this VFS. Existing databases keep their own.
+func (v *VFS) UsePageSize(size int) error {
+	if !validPageSize(size) {
+		return fmt.Errorf("invalid page size %d", size)
+	}
+	v.pageSize = size
+	return nil
+}
+
+// headerPageSize decodes the page size field of a database header
+func headerPageSize(header []byte) int {
+	size := int(binary.BigEndian.Uint16(header[16:18]))
+	if size == 1 {
+		return MaxPageSize
+	}
+	return size
+}
+
+// firstPageFor returns the first page of an empty database with the given page size
+func firstPageFor(size int) []byte {
+	page := make([]byte, size)
+	copy(page, firstPageTemplate[:firstPageHeaderSize])
+	headerValue := uint16(size)
+	if size == MaxPageSize {
+		headerValue = 1
+	}
+	binary.BigEndian.PutUint16(page[16:18], headerValue)
+	// Start of the cell content area, which is the end of the page as it holds no cells (65536 wraps to 0 as SQLite expects)
+	binary.BigEndian.PutUint16(page[105:107], uint16(size))
+	return page
+}
+
+func storedPageSize(txn PageTxn) int {
+	buf := txn.GetMeta(pageSizeMetaKey)
+	if len(buf) != 4 {
+		return DefaultPageSize
+	}
+	return int(binary.BigEndian.Uint32(buf))
+}
+
+func putStoredPageSize(txn PageTxn, size int) error {
+	return txn.PutMeta(pageSizeMetaKey, binary.BigEndian.AppendUint32(nil, uint32(size)))
+}
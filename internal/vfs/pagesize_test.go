@@ -0,0 +1,104 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestFirstPageFor(t *testing.T) {
+	assert.Equal(t, firstPageTemplate, firstPageFor(DefaultPageSize))
+	for _, size := range []int{MinPageSize, 16384, MaxPageSize} {
+		page := firstPageFor(size)
+		assert.Len(t, page, size)
+		assert.Equal(t, size, headerPageSize(page))
+		assert.Equal(t, uint16(size), binary.BigEndian.Uint16(page[105:107]))
+	}
+}
+
+func TestVFS_UsePageSize_Invalid(t *testing.T) {
+	vfsInstance := makeVFS()
+	assert.Error(t, vfsInstance.UsePageSize(256))
+	assert.Error(t, vfsInstance.UsePageSize(3000))
+	assert.Error(t, vfsInstance.UsePageSize(131072))
+}
+
+func TestFile_PageSize(t *testing.T) {
+	const pageSize = 16384
+	vfsInstance := makeVFS()
+	require.NoError(t, vfsInstance.UsePageSize(pageSize))
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+
+	header := make([]byte, 100)
+	_, err = file.ReadAt(header, 0)
+	require.NoError(t, err)
+	assert.Equal(t, pageSize, headerPageSize(header))
+
+	lockForRead(t, file)
+	lockForWrite(t, file)
+	_, err = file.WriteAt(make([]byte, DefaultPageSize), pageSize)
+	assert.Error(t, err, "Writes must be a whole page")
+
+	first := firstPageFor(pageSize)
+	binary.BigEndian.PutUint32(first[28:32], 2)
+	_, err = file.WriteAt(first, 0)
+	require.NoError(t, err)
+	page := make([]byte, pageSize)
+	copy(page, "Hello, World!")
+	_, err = file.WriteAt(page, pageSize)
+	require.NoError(t, err)
+	require.NoError(t, file.(*File).ConfirmCommit())
+	unlockForWrite(t, file)
+
+	ret := make([]byte, pageSize)
+	_, err = file.ReadAt(ret, pageSize)
+	require.NoError(t, err)
+	assert.Equal(t, page, ret)
+	size, err := file.FileSize()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*pageSize), size)
+	unlockForRead(t, file)
+
+	// The page size belongs to the database, not the VFS that opens it
+	reopened := makeVFS()
+	reopened.openStore = vfsInstance.openStore
+	other, _, err := reopened.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(other)
+	assert.Equal(t, int64(pageSize), other.(*File).pageSize)
+}
+
+func TestFile_PageSize_Replicates(t *testing.T) {
+	const pageSize = 8192
+	c := coordinator.NewEmbedded()
+	writerVFS := makeCoordinatedVFS(c)
+	require.NoError(t, writerVFS.UsePageSize(pageSize))
+	writerFile, _, err := writerVFS.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(writerFile)
+	readerFile, _, err := makeCoordinatedVFS(c).Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(readerFile)
+
+	lockForRead(t, writerFile)
+	lockForWrite(t, writerFile)
+	_, err = writerFile.WriteAt(firstPageFor(pageSize), 0)
+	require.NoError(t, err)
+	require.NoError(t, writerFile.(*File).ConfirmCommit())
+	unlockForWrite(t, writerFile)
+	unlockForRead(t, writerFile)
+
+	lockForRead(t, readerFile)
+	assert.Equal(t, int64(pageSize), readerFile.(*File).pageSize)
+	header := make([]byte, 100)
+	_, err = readerFile.ReadAt(header, 0)
+	require.NoError(t, err)
+	assert.Equal(t, pageSize, headerPageSize(header))
+	unlockForRead(t, readerFile)
+}
@@ -0,0 +1,322 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"s3qlite/internal/coordinator"
+	pageSchema "s3qlite/internal/schema/page"
+)
+
+// A replica is a read-only copy of a database kept in a store of its own, so it can be read by processes other than
+// the one writing the database. It is fed by a ReplicaSource: it bootstraps from a snapshot of every page, then
+// applies the pages each commit wrote, in revision order, as the source delivers them. Applied commits are recorded
+// like local ones, so replicas keep history and a changelog and can be captured from.
+//
+// Replicas are always in rollback journal mode, a primary in WAL mode replicates its checkpoints. Once a store has
+// been replicated to, every File of the database is read-only.
+
+// replicaMetaKey marks the store of a replica
+var replicaMetaKey = "replica"
+
+// replicaRetryInterval is how long a replica waits before following its source again after an error
+const replicaRetryInterval = time.Second
+
+// ReplicaPage is the data of a page at an offset, nil when the page was deleted
+type ReplicaPage struct {
+	Offset int64
+	Data   []byte
+}
+
+// ReplicaCommit is a set of pages to apply to a replica at a revision
+type ReplicaCommit struct {
+	Revision int64
+	Time     time.Time
+	ClientID string
+	// Snapshot is set when Pages hold every page of the database, which replace the pages of the replica
+	Snapshot bool
+	Pages    []ReplicaPage
+}
+
+// ReplicaSource feeds replicas the commits of a database
+type ReplicaSource interface {
+	// Follow calls fn with the commits of the named database after revision from in revision order, starting with a
+	// snapshot when the commits after from aren't available, until ctx is cancelled or fn fails.
+	Follow(ctx context.Context, name string, from int64, fn func(ReplicaCommit) error) error
+}
+
+// Replica keeps a database up to date with its source until it is closed
+type Replica struct {
+	vfs     *VFS
+	name    string
+	source  ReplicaSource
+	store   PageStore
+	release func()
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	applied atomic.Int64 // last revision applied, for when the store can't be read anymore
+}
+
+// Replicate starts replicating the named database from source into the local store, creating it if needed. Replicas
+// resume from the revision they applied last. The database must not be open in this process.
+func (v *VFS) Replicate(name string, source ReplicaSource) (*Replica, error) {
+	if v.coordinator != nil {
+		return nil, errors.New("replicas aren't supported with a coordinator, use a CoordinatorSource")
+	}
+	store, release, err := v.createStore(name, v.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	v.state.mutex.Lock()
+	v.state.dbs[v.storePath(name)].replica = true
+	v.state.mutex.Unlock()
+
+	txn, err := store.Begin(false)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	applied := storedRevision(txn)
+	_ = txn.Rollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replica{
+		vfs:     v,
+		name:    name,
+		source:  source,
+		store:   store,
+		release: release,
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+	r.applied.Store(applied)
+	go r.run()
+	return r, nil
+}
+
+// AppliedRevision returns the revision of the last commit applied to the replica, it never decreases. It is the
+// revision readers of the replica see, a commit counts as applied as soon as it is stored.
+func (r *Replica) AppliedRevision() int64 {
+	txn, err := r.store.Begin(false)
+	if err != nil {
+		return r.applied.Load()
+	}
+	defer func() { _ = txn.Rollback() }()
+	return max(storedRevision(txn), r.applied.Load())
+}
+
+// Close stops replicating, the replica can be read until the database is closed
+func (r *Replica) Close() error {
+	r.cancel()
+	<-r.stopped
+	r.release()
+	return nil
+}
+
+func (r *Replica) run() {
+	defer close(r.stopped)
+	for {
+		err := r.source.Follow(r.ctx, r.name, r.AppliedRevision(), r.apply)
+		if r.ctx.Err() != nil {
+			return
+		}
+		r.vfs.logger.Warn().Err(err).Str("db", r.name).Int64("revision", r.AppliedRevision()).Msg("error following replica source, retrying")
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// apply stores the pages of a commit at its revision and records it
+func (r *Replica) apply(commit ReplicaCommit) error {
+	txn, err := r.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if commit.Revision <= storedRevision(txn) {
+		return nil // Sources may deliver commits again
+	}
+	codec := r.vfs.databaseCodec(txn)
+	written := make(map[int64]struct{}, len(commit.Pages))
+	for _, page := range commit.Pages {
+		written[page.Offset] = struct{}{}
+		if page.Data == nil {
+			if err = txn.Delete(page.Offset); err != nil {
+				return err
+			}
+			continue
+		}
+		data := page.Data
+		if page.Offset == 0 {
+			if len(data) < 100 || !validPageSize(headerPageSize(data)) || headerPageSize(data) != len(data) {
+				return fmt.Errorf("first page of revision %d has an invalid header", commit.Revision)
+			}
+			// Rollback journal mode, and no change counter like every first page we store (see spliceVersion)
+			data = spliceVersion(data, 0)
+			data[18], data[19] = 1, 1
+			if err = putStoredPageSize(txn, len(data)); err != nil {
+				return err
+			}
+		}
+		hash, err := storeContent(txn, data, codec)
+		if err != nil {
+			return err
+		}
+		if err = txn.Put(page.Offset, newRefPage(commit.Revision, pageRef{hash: hash})); err != nil {
+			return err
+		}
+	}
+	if commit.Snapshot {
+		var stale []int64
+		err = txn.ForEach(func(off int64, buf []byte) error {
+			if _, ok := written[off]; !ok {
+				stale = append(stale, off)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, off := range stale {
+			if err = txn.Delete(off); err != nil {
+				return err
+			}
+			written[off] = struct{}{}
+		}
+		// History only covers the commits applied after the snapshot
+		if err = putHistoryStart(txn, commit.Revision); err != nil {
+			return err
+		}
+	}
+	entry := ChangelogEntry{Revision: commit.Revision, Time: commit.Time, Offsets: sortedOffsets(written), ClientID: commit.ClientID}
+	if err = recordEntry(txn, entry); err != nil {
+		return err
+	}
+	if err = putStoredRevision(txn, commit.Revision); err != nil {
+		return err
+	}
+	if err = txn.PutMeta(replicaMetaKey, []byte{1}); err != nil {
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	r.applied.Store(commit.Revision)
+	r.vfs.notifyCommit(r.name)
+	return nil
+}
+
+// isReplica reports whether a store has been replicated to
+func isReplica(store PageStore) (bool, error) {
+	txn, err := store.Begin(false)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	return len(txn.GetMeta(replicaMetaKey)) != 0, nil
+}
+
+// CoordinatorSource feeds replicas from a coordinator, snapshotting its pointers and watching its commits. A watch
+// that fails, for instance because the commits after the replica's revision were compacted, is followed by a
+// snapshot.
+type CoordinatorSource struct {
+	coordinator coordinator.Coordinator
+}
+
+func NewCoordinatorSource(c coordinator.Coordinator) *CoordinatorSource {
+	return &CoordinatorSource{coordinator: c}
+}
+
+func (s *CoordinatorSource) Follow(ctx context.Context, name string, from int64, fn func(ReplicaCommit) error) error {
+	snapshot := from == 0
+	for {
+		if snapshot {
+			commit, err := s.snapshot(ctx, name)
+			if err != nil {
+				return err
+			}
+			if commit.Revision > from {
+				if err = fn(commit); err != nil {
+					return err
+				}
+				from = commit.Revision
+			}
+		}
+		watchCtx, cancel := context.WithCancel(ctx)
+		events, err := s.coordinator.Watch(watchCtx, name, from+1)
+		if err != nil {
+			cancel()
+			return err
+		}
+		for event := range events {
+			commit := ReplicaCommit{Revision: event.Revision, Time: event.Time, ClientID: event.ClientID}
+			commit.Pages, err = s.pages(ctx, name, event.Pointers)
+			if err == nil {
+				err = fn(commit)
+			}
+			if err != nil {
+				cancel()
+				return err
+			}
+			from = event.Revision
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		snapshot = true
+	}
+}
+
+func (s *CoordinatorSource) snapshot(ctx context.Context, name string) (ReplicaCommit, error) {
+	rev, err := s.coordinator.Revision(ctx, name)
+	if err != nil || rev == 0 {
+		return ReplicaCommit{}, err
+	}
+	pointers, err := s.coordinator.Range(ctx, name, rev, 0, 0)
+	if err != nil {
+		return ReplicaCommit{}, err
+	}
+	commit := ReplicaCommit{Revision: rev, Time: time.Now(), Snapshot: true}
+	commit.Pages, err = s.pages(ctx, name, pointers)
+	return commit, err
+}
+
+// pages resolves the envelopes pointers hold to the pages they store
+func (s *CoordinatorSource) pages(ctx context.Context, name string, pointers []coordinator.Pointer) ([]ReplicaPage, error) {
+	content := func(hash []byte) ([]byte, error) {
+		blob, err := s.coordinator.GetContent(ctx, name, hash)
+		if err != nil || blob == nil {
+			return nil, err
+		}
+		return decodeContent(blob)
+	}
+	pages := make([]ReplicaPage, 0, len(pointers))
+	for _, p := range pointers {
+		page := ReplicaPage{Offset: p.Offset}
+		if len(p.Value) != 0 {
+			data, ref, err := decodePage(pageSchema.GetRootAsPage(p.Value, 0))
+			if err == nil && ref != nil {
+				data, err = resolveRefWith(ref, content)
+				if err == nil && data == nil {
+					err = fmt.Errorf("content %x is missing from the coordinator", ref.hash)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			page.Data = bytes.Clone(data)
+		}
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
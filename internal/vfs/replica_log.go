@@ -0,0 +1,462 @@
+package vfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// A replication log is a file a LogShipper appends the commits of a database to, for replicas to follow with a
+// LogSource. It starts with a snapshot of every page and holds a record for each commit after it, a snapshot is
+// appended again when the commits after the last record aren't in the changelog anymore. Records are
+//
+//	[payload length uint32][payload crc32c uint32][payload]
+//
+// and payloads, big endian,
+//
+//	[revision uint64][unix nanoseconds uint64][snapshot uint8][client id length uvarint][client id][page count uint32]
+//	([offset uint64][data length uint32, max for a deleted page][data])...
+//
+// A shipper restarted on a log resumes after its last complete record, dropping a torn one. A shipper starts a new log
+// with a snapshot, written next to the log and renamed over it, when it needs one and once the log reaches
+// Options.LogRotateSize and is at least twice the size of its snapshot. A LogSource reopens the log when it's replaced.
+
+// DefaultLogRotateSize is the size a replication log is started over at when Options.LogRotateSize is zero
+const DefaultLogRotateSize = 64 << 20
+
+// logPollInterval is how often a LogSource looks for records appended to its log
+const logPollInterval = 100 * time.Millisecond
+
+const logRecordHeaderSize = 8
+
+// logDeletedPage is the data length of a deleted page
+const logDeletedPage = math.MaxUint32
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func encodeLogRecord(commit ReplicaCommit) []byte {
+	buf := make([]byte, logRecordHeaderSize, 64)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(commit.Revision))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(commit.Time.UnixNano()))
+	if commit.Snapshot {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(commit.ClientID)))
+	buf = append(buf, commit.ClientID...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(commit.Pages)))
+	for _, page := range commit.Pages {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(page.Offset))
+		if page.Data == nil {
+			buf = binary.BigEndian.AppendUint32(buf, logDeletedPage)
+			continue
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(page.Data)))
+		buf = append(buf, page.Data...)
+	}
+	payload := buf[logRecordHeaderSize:]
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(payload, crc32cTable))
+	return buf
+}
+
+var errLogRecordCorrupt = errors.New("corrupt replication log record")
+
+func decodeLogRecord(payload []byte) (ReplicaCommit, error) {
+	var commit ReplicaCommit
+	if len(payload) < 17 {
+		return commit, errLogRecordCorrupt
+	}
+	commit.Revision = int64(binary.BigEndian.Uint64(payload))
+	commit.Time = time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:])))
+	commit.Snapshot = payload[16] == 1
+	payload = payload[17:]
+	n, size := binary.Uvarint(payload)
+	if size <= 0 || uint64(len(payload)-size) < n+4 {
+		return commit, errLogRecordCorrupt
+	}
+	commit.ClientID = string(payload[size : size+int(n)])
+	payload = payload[size+int(n):]
+	count := binary.BigEndian.Uint32(payload)
+	payload = payload[4:]
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 12 {
+			return commit, errLogRecordCorrupt
+		}
+		page := ReplicaPage{Offset: int64(binary.BigEndian.Uint64(payload))}
+		length := binary.BigEndian.Uint32(payload[8:])
+		payload = payload[12:]
+		if length != logDeletedPage {
+			if uint64(len(payload)) < uint64(length) {
+				return commit, errLogRecordCorrupt
+			}
+			page.Data = payload[:length:length]
+			payload = payload[length:]
+		}
+		commit.Pages = append(commit.Pages, page)
+	}
+	if len(payload) != 0 {
+		return commit, errLogRecordCorrupt
+	}
+	return commit, nil
+}
+
+// readLogRevision returns the revision of the record at off and the offset of the next one without reading its pages,
+// io.ErrUnexpectedEOF when it isn't complete yet
+func readLogRevision(file *os.File, off int64) (int64, int64, error) {
+	buf := make([]byte, logRecordHeaderSize+8)
+	if n, err := file.ReadAt(buf, off); n < len(buf) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	next := off + logRecordHeaderSize + int64(binary.BigEndian.Uint32(buf))
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if next > info.Size() {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return int64(binary.BigEndian.Uint64(buf[logRecordHeaderSize:])), next, nil
+}
+
+// readLogRecord reads the record at off, io.ErrUnexpectedEOF when it isn't complete yet
+func readLogRecord(file *os.File, off int64) (ReplicaCommit, int64, error) {
+	header := make([]byte, logRecordHeaderSize)
+	if n, err := file.ReadAt(header, off); n < len(header) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return ReplicaCommit{}, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	if n, err := file.ReadAt(payload, off+logRecordHeaderSize); n < len(payload) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return ReplicaCommit{}, 0, err
+	}
+	if crc32.Checksum(payload, crc32cTable) != binary.BigEndian.Uint32(header[4:]) {
+		return ReplicaCommit{}, 0, io.ErrUnexpectedEOF // Torn by a writer that crashed, or being written
+	}
+	commit, err := decodeLogRecord(payload)
+	if err != nil {
+		return ReplicaCommit{}, 0, err
+	}
+	return commit, off + logRecordHeaderSize + int64(len(payload)), nil
+}
+
+// LogShipper appends the commits of a database to a replication log until it is closed
+type LogShipper struct {
+	follower *follower
+	path     string
+	mutex    sync.Mutex // guards the file and writes to it
+	file     *os.File
+	size     int64 // of the log
+	snapshot int64 // size of the last snapshot record in the log
+}
+
+// ShipLog starts appending the commits of the named database to the replication log at path, creating it with a
+// snapshot if needed. The LogShipper keeps the database's store open until it is closed.
+func (v *VFS) ShipLog(name string, path string) (*LogShipper, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// Find the last complete record, dropping anything after it
+	s := &LogShipper{path: path, file: file}
+	var last int64
+	for {
+		commit, next, err := readLogRecord(file, s.size)
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errLogRecordCorrupt) {
+			break
+		} else if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		if commit.Snapshot {
+			s.snapshot = next - s.size
+		}
+		s.size, last = next, commit.Revision
+	}
+	if err = file.Truncate(s.size); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(s.size, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if last, err = s.snapshotIfBehind(v, name, last); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	s.follower, err = v.follow(name, last, s.ship)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	s.follower.start()
+	return s, nil
+}
+
+// Revision returns the revision of the last commit appended to the log
+func (s *LogShipper) Revision() int64 {
+	return s.follower.revision.Load()
+}
+
+// Close stops appending to the log and closes it
+func (s *LogShipper) Close() error {
+	s.follower.close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// snapshotIfBehind starts a new log with a snapshot when the changelog doesn't hold every commit after revision last,
+// returning the revision of the last record
+func (s *LogShipper) snapshotIfBehind(v *VFS, name string, last int64) (int64, error) {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadWrite, true)
+	if errors.Is(err, sqlite3vfs.CantOpenError) {
+		return 0, fmt.Errorf("database %s not found", name)
+	} else if err != nil {
+		return 0, err
+	}
+	defer release()
+	if v.coordinator != nil {
+		if err = v.catchUp(store, name); err != nil {
+			return 0, err
+		}
+	}
+	txn, err := store.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	rev := storedRevision(txn)
+	if rev < last {
+		return 0, fmt.Errorf("replication log is at revision %d, ahead of database %s at revision %d", last, name, rev)
+	}
+	if start, ok := historyStart(txn); last != 0 && ok && last >= start {
+		return last, nil
+	}
+	commit := ReplicaCommit{Revision: rev, Time: time.Now(), Snapshot: true}
+	err = txn.ForEach(func(off int64, buf []byte) error {
+		data, err := v.envelopeData(txn, name, buf)
+		commit.Pages = append(commit.Pages, ReplicaPage{Offset: off, Data: data})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rev, s.startLog(commit)
+}
+
+// ship appends a commit to the log
+func (s *LogShipper) ship(_ context.Context, entry ChangelogEntry) error {
+	f := s.follower
+	txn, err := f.store.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	commit := ReplicaCommit{Revision: entry.Revision, Time: entry.Time, ClientID: entry.ClientID}
+	for _, off := range entry.Offsets {
+		data, err := f.vfs.versionPage(txn, f.name, off, entry.Revision)
+		if err != nil {
+			return err
+		}
+		commit.Pages = append(commit.Pages, ReplicaPage{Offset: off, Data: data})
+	}
+	if err = s.append(commit); err != nil {
+		return err
+	}
+	if s.full() {
+		// The commit is in the log whether or not it's started over
+		if err = s.rotate(txn, entry.Revision); err != nil {
+			f.vfs.logger.Warn().Err(err).Str("path", s.path).Msg("starting a new replication log")
+		}
+	}
+	return nil
+}
+
+// full reports whether the log should be started over
+func (s *LogShipper) full() bool {
+	limit := s.follower.vfs.logRotateSize
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return limit > 0 && s.size >= limit && s.size >= 2*s.snapshot
+}
+
+// rotate starts a new log with a snapshot of the database at revision rev, from the history in txn
+func (s *LogShipper) rotate(txn PageTxn, rev int64) error {
+	var offsets []int64
+	err := txn.ForEachVersion(func(off int64, _ int64, _ []byte) error {
+		if len(offsets) == 0 || offsets[len(offsets)-1] != off {
+			offsets = append(offsets, off)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	commit := ReplicaCommit{Revision: rev, Time: time.Now(), Snapshot: true}
+	for _, off := range offsets {
+		data, err := s.follower.vfs.versionPage(txn, s.follower.name, off, rev)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			commit.Pages = append(commit.Pages, ReplicaPage{Offset: off, Data: data})
+		}
+	}
+	return s.startLog(commit)
+}
+
+// startLog replaces the log with one holding the snapshot
+func (s *LogShipper) startLog(snapshot ReplicaCommit) error {
+	record := encodeLogRecord(snapshot)
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(record); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_ = s.file.Close()
+	s.file, s.size, s.snapshot = file, int64(len(record)), int64(len(record))
+	return nil
+}
+
+func (s *LogShipper) append(commit ReplicaCommit) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	end, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	record := encodeLogRecord(commit)
+	if _, err = s.file.Write(record); err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// Drop what was written so the record can be appended again
+		_ = s.file.Truncate(end)
+		_, _ = s.file.Seek(end, io.SeekStart)
+		return err
+	}
+	s.size = end + int64(len(record))
+	return nil
+}
+
+// LogSource feeds replicas from a replication log, waiting for records to be appended to it and reopening it when a
+// new log replaces it. The log holds a single database, whatever name replicas follow.
+type LogSource struct {
+	path string
+}
+
+func NewLogSource(path string) *LogSource {
+	return &LogSource{path: path}
+}
+
+func (s *LogSource) Follow(ctx context.Context, _ string, from int64, fn func(ReplicaCommit) error) error {
+	var file *os.File
+	for file == nil {
+		var err error
+		file, err = os.Open(s.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		} else if err != nil {
+			if err = sleepContext(ctx, logPollInterval); err != nil {
+				return err
+			}
+		}
+	}
+	defer func() { _ = file.Close() }()
+	var off int64
+	for {
+		if rev, next, err := readLogRevision(file, off); err == nil && rev <= from {
+			off = next // Applied already, its pages aren't read
+			continue
+		}
+		commit, next, err := readLogRecord(file, off)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The new log starts with a snapshot of every record of the old one
+			replaced, err := s.replaced(file)
+			if err != nil {
+				return err
+			} else if replaced != nil {
+				_ = file.Close()
+				file, off = replaced, 0
+				continue
+			}
+			if err = sleepContext(ctx, logPollInterval); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if commit.Revision > from {
+			if err = fn(commit); err != nil {
+				return err
+			}
+			from = commit.Revision
+		}
+		off = next
+	}
+}
+
+// replaced opens the log at the path of the LogSource when it isn't file anymore, nil when it is
+func (s *LogSource) replaced(file *os.File) (*os.File, error) {
+	current, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && os.SameFile(current, info)) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	replaced, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return replaced, err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,177 @@
+package vfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// registerReplicaVFS registers a VFS with a data dir of its own under vfsName
+func registerReplicaVFS(t *testing.T, vfsName string, dataDir string) *VFS {
+	logger := zerolog.Nop()
+	vfsInstance, err := NewVFS(Options{DataDir: dataDir, TmpDir: t.TempDir(), Logger: &logger})
+	require.NoError(t, err)
+	require.NoError(t, sqlite3vfs.RegisterVFS(vfsName, vfsInstance))
+	t.Cleanup(func() {
+		require.NoError(t, sqlite3vfs.UnregisterVFS(vfsName))
+	})
+	return vfsInstance
+}
+
+func waitForRevision(t *testing.T, replica *Replica, rev int64) {
+	assert.Eventually(t, func() bool { return replica.AppliedRevision() >= rev }, 10*time.Second, 10*time.Millisecond)
+}
+
+func queryCount(t *testing.T, conn *sqlite3vfs.Conn) int {
+	rows, err := conn.Query("SELECT count(*) FROM t")
+	require.NoError(t, err)
+	count, err := strconv.Atoi(rows[0][0])
+	require.NoError(t, err)
+	return count
+}
+
+func TestReplica_Log(t *testing.T) {
+	primary, conn := openCaptureDatabase(t, "skylite-replica-primary")
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)"))
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('one'), ('two')"))
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	shipper, err := primary.ShipLog("test.db", path)
+	require.NoError(t, err)
+
+	dataDir := t.TempDir()
+	replicaVFS := registerReplicaVFS(t, "skylite-replica", dataDir)
+	replica, err := replicaVFS.Replicate("test.db", NewLogSource(path))
+	require.NoError(t, err)
+	info, err := primary.Info("test.db")
+	require.NoError(t, err)
+	waitForRevision(t, replica, info.Revision)
+
+	reader, err := sqlite3vfs.OpenConn("file:test.db?vfs=skylite-replica")
+	require.NoError(t, err)
+	assert.Equal(t, 2, queryCount(t, reader), "The replica should bootstrap from a snapshot")
+	assert.Error(t, reader.Exec("INSERT INTO t (v) VALUES ('three')"), "Replicas are read-only")
+
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('three')"))
+	require.NoError(t, conn.Exec("DELETE FROM t WHERE id = 1"))
+	waitForRevision(t, replica, info.Revision+2)
+	assert.Equal(t, 2, queryCount(t, reader))
+	rows, err := reader.Query("SELECT v FROM t ORDER BY id")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"two"}, {"three"}}, rows)
+
+	// Replicas and shippers resume where they stopped
+	require.NoError(t, reader.Close())
+	require.NoError(t, replica.Close())
+	require.NoError(t, shipper.Close())
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('four')"))
+	shipper, err = primary.ShipLog("test.db", path)
+	require.NoError(t, err)
+	defer shipper.Close()
+	replica, err = replicaVFS.Replicate("test.db", NewLogSource(path))
+	require.NoError(t, err)
+	defer replica.Close()
+	applied := replica.AppliedRevision()
+	assert.Equal(t, info.Revision+2, applied)
+	waitForRevision(t, replica, applied+1)
+	assert.Equal(t, applied+1, shipper.Revision())
+
+	reader, err = sqlite3vfs.OpenConn("file:test.db?vfs=skylite-replica")
+	require.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, 3, queryCount(t, reader))
+	entries := changelog(t, replicaVFS, "test.db", applied+1)
+	require.Len(t, entries, 1, "Applied commits should be in the replica's changelog")
+	assert.Equal(t, "app", entries[0].ClientID)
+}
+
+func TestReplica_LogRotation(t *testing.T) {
+	primary, conn := openCaptureDatabase(t, "skylite-rotate-primary")
+	primary.logRotateSize = 1 // Whenever the commits take up as much as the snapshot
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v BLOB)"))
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES (randomblob(100))"))
+	path := filepath.Join(t.TempDir(), "test.log")
+	shipper, err := primary.ShipLog("test.db", path)
+	require.NoError(t, err)
+	defer shipper.Close()
+	first := shipper.Revision()
+
+	replicaVFS := registerReplicaVFS(t, "skylite-rotate-replica", t.TempDir())
+	replica, err := replicaVFS.Replicate("test.db", NewLogSource(path))
+	require.NoError(t, err)
+	defer replica.Close()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES (randomblob(3000))"))
+	}
+	info, err := primary.Info("test.db")
+	require.NoError(t, err)
+	waitForRevision(t, replica, info.Revision)
+	assert.Eventually(t, func() bool { return shipper.Revision() == info.Revision }, 10*time.Second, 10*time.Millisecond)
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	snapshot, _, err := readLogRecord(file, 0)
+	require.NoError(t, err)
+	assert.True(t, snapshot.Snapshot)
+	assert.Greater(t, snapshot.Revision, first, "The log should have been started over")
+
+	reader, err := sqlite3vfs.OpenConn("file:test.db?vfs=skylite-rotate-replica")
+	require.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, 21, queryCount(t, reader), "The replica should follow the log across new ones")
+
+	lateVFS := registerReplicaVFS(t, "skylite-rotate-late", t.TempDir())
+	late, err := lateVFS.Replicate("test.db", NewLogSource(path))
+	require.NoError(t, err)
+	defer late.Close()
+	waitForRevision(t, late, info.Revision)
+	lateReader, err := sqlite3vfs.OpenConn("file:test.db?vfs=skylite-rotate-late")
+	require.NoError(t, err)
+	defer lateReader.Close()
+	rows, err := lateReader.Query("PRAGMA integrity_check")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"ok"}}, rows, "A snapshot from the history should be a consistent database")
+	assert.Equal(t, 21, queryCount(t, lateReader))
+}
+
+func TestReplica_Coordinator(t *testing.T) {
+	c := coordinator.NewEmbedded()
+	primary := makeCoordinatedVFS(c) // With a state of its own, so the replica can open test.db too
+	var err error
+	primary.tmp, err = newTempVFS(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, sqlite3vfs.RegisterVFS("skylite-replica-coordinated", primary))
+	defer func() { require.NoError(t, sqlite3vfs.UnregisterVFS("skylite-replica-coordinated")) }()
+	conn, err := sqlite3vfs.OpenConn("file:test.db?vfs=skylite-replica-coordinated")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)"))
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('one')"))
+
+	replicaVFS := registerReplicaVFS(t, "skylite-replica-follower", t.TempDir())
+	replica, err := replicaVFS.Replicate("test.db", NewCoordinatorSource(c))
+	require.NoError(t, err)
+	defer replica.Close()
+	rev, err := c.Revision(context.Background(), "test.db")
+	require.NoError(t, err)
+	waitForRevision(t, replica, rev)
+
+	reader, err := sqlite3vfs.OpenConn("file:test.db?vfs=skylite-replica-follower")
+	require.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, 1, queryCount(t, reader))
+
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('two')"))
+	waitForRevision(t, replica, rev+1)
+	assert.Equal(t, 2, queryCount(t, reader))
+}
@@ -0,0 +1,363 @@
+package vfs
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"s3qlite/internal/sqlite3vfs"
+
+	"s3qlite/internal/objectstore"
+)
+
+// Segments are the sorted content files described in LAYOUT.txt. Compaction moves page contents out of the local
+// PageStore into a segment in the object store and records the segment in the store's manifest, all readers that no
+// longer find a hash locally then consult the manifest (newest segment first) and fetch the content with a ranged read.
+//
+// Segment layout, all integers big endian:
+//
+//	[count uint32][count x ([hash 32 bytes][position uint64][length uint32])][contents]
+//
+// Entries are sorted by hash and position is relative to the start of the segment.
+
+const segmentEntrySize = hashSize + 8 + 4
+
+var segmentsMetaKey = "segments"
+
+type segmentEntry struct {
+	hash     []byte
+	position int64
+	length   int64
+}
+
+type segmentIndex struct {
+	entries []segmentEntry
+}
+
+func (s *segmentIndex) find(hash []byte) (segmentEntry, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool { return bytes.Compare(s.entries[i].hash, hash) >= 0 })
+	if i < len(s.entries) && bytes.Equal(s.entries[i].hash, hash) {
+		return s.entries[i], true
+	}
+	return segmentEntry{}, false
+}
+
+type segmentContent struct {
+	hash []byte
+	data []byte
+}
+
+// encodeSegment builds a segment from contents sorted by hash
+func encodeSegment(contents []segmentContent) []byte {
+	headerSize := 4 + segmentEntrySize*len(contents)
+	size := headerSize
+	for _, c := range contents {
+		size += len(c.data)
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(contents)))
+	position := headerSize
+	for _, c := range contents {
+		buf = append(buf, c.hash...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(position))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(c.data)))
+		position += len(c.data)
+	}
+	for _, c := range contents {
+		buf = append(buf, c.data...)
+	}
+	return buf
+}
+
+func decodeSegmentIndex(count uint32, buf []byte) (*segmentIndex, error) {
+	if len(buf) != int(count)*segmentEntrySize {
+		return nil, errors.New("truncated segment index")
+	}
+	index := &segmentIndex{entries: make([]segmentEntry, count)}
+	for i := range index.entries {
+		entry := buf[i*segmentEntrySize:]
+		index.entries[i] = segmentEntry{
+			hash:     entry[0:hashSize],
+			position: int64(binary.BigEndian.Uint64(entry[hashSize : hashSize+8])),
+			length:   int64(binary.BigEndian.Uint32(entry[hashSize+8 : hashSize+12])),
+		}
+	}
+	return index, nil
+}
+
+// segmentCache keeps the indexes of segments that have been read, evicting the least recently used once they take up
+// more than capacity bytes. Segments are immutable so entries never go stale.
+type segmentCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	indexes  map[string]*list.Element
+	lru      *list.List // of *cachedIndex, most recently used first
+}
+
+type cachedIndex struct {
+	key   string
+	index *segmentIndex
+}
+
+func newSegmentCache(capacity int64) *segmentCache {
+	return &segmentCache{
+		capacity: capacity,
+		indexes:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (i *segmentIndex) size() int64 {
+	return int64(len(i.entries)) * segmentEntrySize
+}
+
+func (c *segmentCache) get(key string) (*segmentIndex, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.indexes[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedIndex).index, true
+}
+
+func (c *segmentCache) put(key string, index *segmentIndex) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.indexes[key]; ok {
+		return
+	}
+	c.indexes[key] = c.lru.PushFront(&cachedIndex{key: key, index: index})
+	c.size += index.size()
+	for c.size > c.capacity && c.lru.Len() > 1 {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedIndex)
+		delete(c.indexes, oldest.key)
+		c.size -= oldest.index.size()
+	}
+}
+
+func (c *segmentCache) index(objects objectstore.ObjectStore, key string) (*segmentIndex, error) {
+	if index, ok := c.get(key); ok {
+		return index, nil
+	}
+
+	header, err := objects.GetRange(key, 0, 4)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) != 4 {
+		return nil, errors.New("truncated segment header")
+	}
+	count := binary.BigEndian.Uint32(header)
+	buf, err := objects.GetRange(key, 4, int64(count)*segmentEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	index, err := decodeSegmentIndex(count, buf)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, index)
+	return index, nil
+}
+
+func readManifest(txn PageTxn) ([]string, error) {
+	buf := txn.GetMeta(segmentsMetaKey)
+	if buf == nil {
+		return nil, nil
+	}
+	var segments []string
+	err := json.Unmarshal(buf, &segments)
+	return segments, err
+}
+
+func writeManifest(txn PageTxn, segments []string) error {
+	buf, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+	return txn.PutMeta(segmentsMetaKey, buf)
+}
+
+// segmentContent finds content in the newest segment holding it, returning nil if no segment does
+func (v *VFS) segmentContent(txn PageTxn, hash []byte) ([]byte, error) {
+	segments, err := readManifest(txn)
+	if err != nil || len(segments) == 0 {
+		return nil, err
+	}
+	if v.objects == nil {
+		return nil, errors.New("database has compacted segments but no object store is configured")
+	}
+	for _, key := range segments {
+		index, err := v.segments.index(v.objects, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading segment %s: %w", key, err)
+		}
+		entry, ok := index.find(hash)
+		if !ok {
+			continue
+		}
+		buf, err := v.objects.GetRange(key, entry.position, entry.length)
+		if err != nil {
+			return nil, fmt.Errorf("reading segment %s: %w", key, err)
+		}
+		if int64(len(buf)) != entry.length {
+			return nil, fmt.Errorf("short read from segment %s", key)
+		}
+		return buf, nil
+	}
+	return nil, nil
+}
+
+// Compact moves all page contents of the named database, except that of the first page, out of the local PageStore
+// and into a new level 0 segment in the object store. It returns the number of contents moved.
+func (v *VFS) Compact(name string) (int, error) {
+	if v.objects == nil {
+		return 0, errors.New("no object store configured")
+	}
+	store, release, err := v.acquireStore(name)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	// Gather the contents from a snapshot so writers aren't blocked while we upload
+	txn, err := store.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	contents, err := compactableContents(txn)
+	_ = txn.Rollback()
+	if err != nil || len(contents) == 0 {
+		return 0, err
+	}
+
+	key, err := v.uploadSegment(name, 0, contents)
+	if err != nil {
+		return 0, err
+	}
+
+	txn, err = store.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	firstPage := firstPageHash(txn)
+	moved := 0
+	for _, c := range contents {
+		// Content is immutable, but the first page may have been rewritten to something we uploaded
+		if bytes.Equal(c.hash, firstPage) || txn.GetContent(c.hash) == nil {
+			continue
+		}
+		if err = txn.DeleteContent(c.hash); err != nil {
+			return 0, err
+		}
+		moved++
+	}
+	manifest, err := readManifest(txn)
+	if err != nil {
+		return 0, err
+	}
+	err = writeManifest(txn, append([]string{key}, manifest...))
+	if err != nil {
+		return 0, err
+	}
+	return moved, txn.Commit()
+}
+
+// compactableContents returns every content in the store except the first page's, which every transaction reads
+func compactableContents(txn PageTxn) ([]segmentContent, error) {
+	firstPage := firstPageHash(txn)
+	var contents []segmentContent
+	err := txn.ForEachContent(func(hash []byte, data []byte) error {
+		if bytes.Equal(hash, firstPage) {
+			return nil
+		}
+		contents = append(contents, segmentContent{
+			hash: append([]byte(nil), hash...),
+			data: append([]byte(nil), data...),
+		})
+		return nil
+	})
+	return contents, err
+}
+
+func firstPageHash(txn PageTxn) []byte {
+	buf := txn.Get(0)
+	if buf == nil {
+		return nil
+	}
+	ref, err := decodeRef(buf)
+	if err != nil || ref == nil {
+		return nil
+	}
+	return ref.hash
+}
+
+func (v *VFS) uploadSegment(name string, level int, contents []segmentContent) (string, error) {
+	key := fmt.Sprintf("%s/l/%d/%x-%x-%016x", name, level, contents[0].hash[:8], contents[len(contents)-1].hash[:8], time.Now().UnixNano())
+	return key, v.objects.Put(key, encodeSegment(contents))
+}
+
+// acquireStore returns the PageStore of an open database, or opens it for the duration of an administrative task
+func (v *VFS) acquireStore(name string) (PageStore, func(), error) {
+	return v.retainStore(name, sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate, true)
+}
+
+// retainStore adds a reference to the named store, opening it with flags if needed. Database stores are opened with
+// openDatabase, other files (see walFile) are plain stores.
+func (v *VFS) retainStore(name string, flags sqlite3vfs.OpenFlag, database bool) (PageStore, func(), error) {
+	key := v.storePath(name)
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	if ref, ok := v.state.dbs[key]; ok {
+		if database && flags&sqlite3vfs.OpenReadWrite != 0 {
+			if err := v.upgradeDatabase(name, ref); err != nil {
+				return nil, nil, err
+			}
+		}
+		ref.count++
+		return ref.store, func() { v.releaseStore(name) }, nil
+	}
+	var ref *dbRef
+	if database {
+		var err error
+		if ref, err = v.openDatabase(name, flags, 0); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		store, err := v.openStore(name, flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		ref = &dbRef{store: store}
+	}
+	ref.count = 1
+	v.state.dbs[key] = ref
+	return ref.store, func() { v.releaseStore(name) }, nil
+}
+
+func (v *VFS) releaseStore(name string) {
+	key := v.storePath(name)
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	ref, ok := v.state.dbs[key]
+	if !ok {
+		return
+	}
+	ref.count--
+	if ref.count == 0 {
+		delete(v.state.dbs, key)
+		if err := ref.store.Close(); err != nil {
+			v.logger.Error().Err(err).Msg("error closing store")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/objectstore"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func sector(content string) []byte {
+	data := make([]byte, SectorSize)
+	copy(data, content)
+	return data
+}
+
+func writePages(t *testing.T, file sqlite3vfs.File, contents map[int64]string) {
+	lockForWrite(t, file)
+	for off, content := range contents {
+		_, err := file.WriteAt(sector(content), off)
+		require.NoError(t, err)
+	}
+	require.NoError(t, file.(*File).ConfirmCommit())
+	unlockForWrite(t, file)
+}
+
+func assertPage(t *testing.T, file sqlite3vfs.File, off int64, content string) {
+	expected := sector(content)
+	ret := make([]byte, SectorSize)
+	_, err := file.ReadAt(ret, off)
+	require.NoError(t, err)
+	assert.Equal(t, expected, ret)
+}
+
+func TestVFS_Compact(t *testing.T) {
+	local, err := objectstore.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	server := httptest.NewServer(objectstore.NewFakeS3("pages"))
+	defer server.Close()
+
+	stores := map[string]objectstore.ObjectStore{
+		"local": local,
+		"s3":    objectstore.NewS3Store(objectstore.S3Config{Endpoint: server.URL, Bucket: "pages"}),
+	}
+	for name, objects := range stores {
+		t.Run(name, func(t *testing.T) {
+			vfsInstance := makeVFS()
+			vfsInstance.UseObjectStore(objects)
+			file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+			require.NoError(t, err)
+			defer cleanup(t)(file)
+
+			lockForRead(t, file)
+			writePages(t, file, map[int64]string{SectorSize: "one", 2 * SectorSize: "two"})
+			unlockForRead(t, file)
+
+			moved, err := vfsInstance.Compact("test.db")
+			require.NoError(t, err)
+			assert.Equal(t, 2, moved)
+
+			keys, err := objects.List("test.db/l/0/")
+			require.NoError(t, err)
+			assert.Len(t, keys, 1)
+
+			lockForRead(t, file)
+			assert.Nil(t, file.(*File).txn.GetContent(pageHash(sector("one"))), "Compacted content should be gone from the local store")
+			assertPage(t, file, SectorSize, "one")
+			assertPage(t, file, 2*SectorSize, "two")
+
+			// Local writes shadow compacted pages
+			writePages(t, file, map[int64]string{SectorSize: "uno"})
+			assertPage(t, file, SectorSize, "uno")
+			assertPage(t, file, 2*SectorSize, "two")
+			unlockForRead(t, file)
+
+			moved, err = vfsInstance.Compact("test.db")
+			require.NoError(t, err)
+			assert.Equal(t, 1, moved)
+
+			lockForRead(t, file)
+			assertPage(t, file, SectorSize, "uno")
+			assertPage(t, file, 2*SectorSize, "two")
+			unlockForRead(t, file)
+		})
+	}
+}
+
+func TestVFS_Compact_WithoutObjectStore(t *testing.T) {
+	vfsInstance := makeVFS()
+	_, err := vfsInstance.Compact("test.db")
+	assert.Error(t, err)
+}
+
+func TestSegmentCache_Evicts(t *testing.T) {
+	index := func(entries int) *segmentIndex {
+		return &segmentIndex{entries: make([]segmentEntry, entries)}
+	}
+	cache := newSegmentCache(3 * segmentEntrySize)
+	cache.put("a", index(1))
+	cache.put("b", index(2))
+	_, ok := cache.get("a")
+	require.True(t, ok)
+	cache.put("c", index(1))
+
+	_, ok = cache.get("b")
+	assert.False(t, ok, "The least recently used index should be evicted")
+	_, ok = cache.get("a")
+	assert.True(t, ok)
+	_, ok = cache.get("c")
+	assert.True(t, ok)
+
+	cache.put("d", index(10))
+	_, ok = cache.get("d")
+	assert.True(t, ok, "An index larger than the cache is kept until the next one arrives")
+	assert.Equal(t, 1, cache.lru.Len())
+}
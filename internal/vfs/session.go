@@ -0,0 +1,138 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// Revisions double as read-your-writes tokens. Every commit gets the next revision of its database, which replicas
+// apply under the same revision (see replica.go), so a client that keeps the revision of its last commit can ask any
+// replica for a state that includes it. The revision of a connection's last commit is returned by
+// PRAGMA skylite_revision, and VFS.LastCommit returns the last one made with a client id. Commits to the WAL get their
+// revision when they're checkpointed, so the token is the revision of the last checkpoint the connection ran.
+//
+// A File opened with the min_revision URI parameter waits for its database to be at that revision at least before
+// every read transaction, catching up with the coordinator if there is one. It fails with SQLITE_BUSY after
+// min_revision_timeout (a Go duration, defaults to DefaultMinRevisionTimeout).
+
+// DefaultMinRevisionTimeout is how long a read transaction waits for the revision given with min_revision
+const DefaultMinRevisionTimeout = 5 * time.Second
+
+// revisionPollInterval is how often waiting for a revision looks for commits it wasn't notified of, made by other VFS
+// instances or other processes
+const revisionPollInterval = 50 * time.Millisecond
+
+// revisionPragma returns the revision of the connection's last commit
+const revisionPragma = "skylite_revision"
+
+type commitToken struct {
+	path     string // store path of the database, the same for every name of it
+	clientID string
+}
+
+// LastCommit returns the revision of the last commit to the named database made through this VFS with the client id,
+// 0 if there was none. Commits of connections without a client id aren't recorded.
+func (v *VFS) LastCommit(name string, clientID string) int64 {
+	if clientID == "" {
+		return 0
+	}
+	v.followMutex.Lock()
+	defer v.followMutex.Unlock()
+	return v.tokens[commitToken{path: v.storePath(name), clientID: clientID}]
+}
+
+// WaitForRevision blocks until the named database is at revision rev at least or ctx is done
+func (v *VFS) WaitForRevision(ctx context.Context, name string, rev int64) error {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadWrite, true)
+	if errors.Is(err, sqlite3vfs.CantOpenError) {
+		return fmt.Errorf("database %s not found", name)
+	} else if err != nil {
+		return err
+	}
+	defer release()
+	return v.waitForRevision(ctx, store, name, rev)
+}
+
+func (v *VFS) waitForRevision(ctx context.Context, store PageStore, name string, rev int64) error {
+	ticker := time.NewTicker(revisionPollInterval)
+	defer ticker.Stop()
+	for {
+		signal := v.commitSignal(name)
+		if v.coordinator != nil {
+			if err := v.catchUp(store, name); err != nil {
+				return err
+			}
+		}
+		txn, err := store.Begin(false)
+		if err != nil {
+			return err
+		}
+		current := storedRevision(txn)
+		_ = txn.Rollback()
+		if current >= rev {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database %s is at revision %d, waiting for %d: %w", name, current, rev, ctx.Err())
+		case <-signal:
+		case <-ticker.C:
+		}
+	}
+}
+
+// commitSignal returns a channel closed by the next notifyCommit for the database
+func (v *VFS) commitSignal(name string) <-chan struct{} {
+	v.followMutex.Lock()
+	defer v.followMutex.Unlock()
+	if v.commitSignals == nil {
+		v.commitSignals = make(map[string]chan struct{})
+	}
+	signal, ok := v.commitSignals[name]
+	if !ok {
+		signal = make(chan struct{})
+		v.commitSignals[name] = signal
+	}
+	return signal
+}
+
+// committed records the revision the File just committed as its token, and as the last commit of its client id if it
+// has one, and notifies followers of the database
+func (f *File) committed() {
+	f.lastCommit = f.commitRevision
+	f.vfs.followMutex.Lock()
+	if f.vfs.tokens == nil {
+		f.vfs.tokens = make(map[commitToken]int64)
+	}
+	if f.clientID != "" {
+		f.vfs.tokens[commitToken{path: f.vfs.storePath(f.name), clientID: f.clientID}] = f.commitRevision
+	}
+	f.vfs.followMutex.Unlock()
+	f.vfs.notifyCommit(f.name)
+}
+
+// waitForMinRevision waits for the database to be at the File's min_revision before a read transaction starts
+func (f *File) waitForMinRevision() error {
+	if f.minRevision <= f.readRevision || f.historical {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.revisionWait)
+	defer cancel()
+	return f.vfs.waitForRevision(ctx, f.store, f.name, f.minRevision)
+}
+
+func (f *File) Pragma(name string, value string) (string, error) {
+	if !strings.EqualFold(name, revisionPragma) {
+		return "", sqlite3vfs.NotFoundError
+	}
+	if value != "" {
+		return "", fmt.Errorf("%s can't be set", revisionPragma)
+	}
+	return strconv.FormatInt(f.lastCommit, 10), nil
+}
@@ -0,0 +1,80 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func queryRevision(t *testing.T, conn *sqlite3vfs.Conn) int64 {
+	rows, err := conn.Query("PRAGMA skylite_revision")
+	require.NoError(t, err)
+	rev, err := strconv.ParseInt(rows[0][0], 10, 64)
+	require.NoError(t, err)
+	return rev
+}
+
+func TestSession_ReadYourWrites(t *testing.T) {
+	primary, conn := openCaptureDatabase(t, "skylite-session-primary")
+	assert.Zero(t, queryRevision(t, conn))
+	require.NoError(t, conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)"))
+	info, err := primary.Info("test.db")
+	require.NoError(t, err)
+	assert.Equal(t, info.Revision, queryRevision(t, conn), "The token should be the revision of the last commit")
+	assert.Equal(t, info.Revision, primary.LastCommit("test.db", "app"))
+	assert.Zero(t, primary.LastCommit("test.db", "other"))
+	assert.Equal(t, info.Revision, primary.LastCommit(primary.storePath("test.db"), "app"), "Tokens should be kept by database, whatever its name")
+
+	elsewhere, err := sqlite3vfs.OpenConn("file:test.db?client_id=app&vfs=skylite-session-primary&dir=" + t.TempDir())
+	require.NoError(t, err)
+	defer elsewhere.Close()
+	require.NoError(t, elsewhere.Exec("CREATE TABLE other (id INTEGER PRIMARY KEY)"))
+	require.NoError(t, elsewhere.Exec("INSERT INTO other DEFAULT VALUES"))
+	assert.Equal(t, info.Revision, primary.LastCommit("test.db", "app"), "Databases in other directories have tokens of their own")
+	anonymous, err := sqlite3vfs.OpenConn("file:test.db?vfs=skylite-session-primary")
+	require.NoError(t, err)
+	defer anonymous.Close()
+	require.NoError(t, anonymous.Exec("CREATE TABLE anonymous (id INTEGER PRIMARY KEY)"))
+	assert.Zero(t, primary.LastCommit("test.db", ""), "Commits without a client id shouldn't be recorded")
+	info, err = primary.Info("test.db")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	shipper, err := primary.ShipLog("test.db", path)
+	require.NoError(t, err)
+	defer shipper.Close()
+	replicaVFS := registerReplicaVFS(t, "skylite-session-replica", t.TempDir())
+	replica, err := replicaVFS.Replicate("test.db", NewLogSource(path))
+	require.NoError(t, err)
+	defer replica.Close()
+
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('mine')"))
+	token := queryRevision(t, conn)
+	assert.Equal(t, info.Revision+1, token)
+	reader, err := sqlite3vfs.OpenConn(fmt.Sprintf("file:test.db?vfs=skylite-session-replica&min_revision=%d", token))
+	require.NoError(t, err)
+	defer reader.Close()
+	rows, err := reader.Query("SELECT v FROM t")
+	require.NoError(t, err, "Reads should wait for the replica to apply the token")
+	assert.Equal(t, [][]string{{"mine"}}, rows)
+	assert.GreaterOrEqual(t, replica.AppliedRevision(), token)
+
+	ahead, err := sqlite3vfs.OpenConn(fmt.Sprintf("file:test.db?vfs=skylite-session-replica&min_revision=%d&min_revision_timeout=100ms", token+10))
+	require.NoError(t, err)
+	defer ahead.Close()
+	_, err = ahead.Query("SELECT v FROM t")
+	assert.Error(t, err, "Reads should time out waiting for a revision that isn't applied")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, replicaVFS.WaitForRevision(ctx, "test.db", token+1), context.DeadlineExceeded)
+	require.NoError(t, conn.Exec("INSERT INTO t (v) VALUES ('again')"))
+	require.NoError(t, replicaVFS.WaitForRevision(context.Background(), "test.db", token+1))
+}
@@ -0,0 +1,159 @@
+package vfs
+
+import (
+	"errors"
+	"sync"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// The WAL index (the -shm file) is emulated in process memory. Every File of a database maps the same regions and
+// shares the same lock table, so connections within a process can use a WAL database concurrently. Processes can't
+// share a WAL index, so a WAL database is only usable from the process holding it.
+
+type shmState struct {
+	mutex     sync.Mutex
+	regions   [][]byte
+	shared    [sqlite3vfs.ShmLockSlots]int
+	exclusive [sqlite3vfs.ShmLockSlots]*File
+	refs      int
+}
+
+// shm returns the shared memory of the file's database, attaching the file to it on first use
+func (f *File) shm() *shmState {
+	if f.shmState != nil {
+		return f.shmState
+	}
+	f.vfs.state.mutex.Lock()
+	defer f.vfs.state.mutex.Unlock()
+	state, ok := f.vfs.state.shm[f.vfs.storePath(f.name)]
+	if !ok {
+		state = &shmState{}
+		f.vfs.state.shm[f.vfs.storePath(f.name)] = state
+	}
+	state.mutex.Lock()
+	state.refs++
+	state.mutex.Unlock()
+	f.shmState = state
+	return state
+}
+
+// ShmMap returns region of the WAL index, each region is size bytes. If the region doesn't exist yet it is
+// created when extend is set and nil is returned otherwise.
+func (f *File) ShmMap(region int, size int, extend bool) ([]byte, error) {
+	state := f.shm()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	for len(state.regions) <= region {
+		if !extend {
+			return nil, nil
+		}
+		state.regions = append(state.regions, sqlite3vfs.ShmAlloc(size))
+	}
+	return state.regions[region], nil
+}
+
+// shmReadLock is WAL_READ_LOCK(0), the first of the locks a reader holds one of for its read transaction
+const shmReadLock = 3
+
+// ShmLock acquires or releases n of the WAL index locks starting at offset, returning BusyError on conflict. A read
+// transaction taking its read lock moves the File to the latest committed state of the database.
+func (f *File) ShmLock(offset int, n int, flags sqlite3vfs.ShmLockFlag) error {
+	reading, err := f.shmLock(offset, n, flags)
+	if err != nil || !reading || !f.wal || f.txn == nil || f.txn.Writable() {
+		return err
+	}
+	if err = f.refreshSnapshot(); err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error refreshing snapshot")
+		return sqlite3vfs.IOError
+	}
+	return nil
+}
+
+// shmLock updates the lock table, reading is set when the File took a read lock it didn't hold
+func (f *File) shmLock(offset int, n int, flags sqlite3vfs.ShmLockFlag) (reading bool, err error) {
+	if offset < 0 || n < 1 || offset+n > sqlite3vfs.ShmLockSlots {
+		return false, sqlite3vfs.IOError
+	}
+	state := f.shm()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	switch {
+	case flags&sqlite3vfs.ShmUnlock != 0:
+		for i := offset; i < offset+n; i++ {
+			if f.shmLocks[i] == sqlite3vfs.ShmShared {
+				state.shared[i]--
+			} else if f.shmLocks[i] == sqlite3vfs.ShmExclusive {
+				state.exclusive[i] = nil
+			}
+			f.shmLocks[i] = 0
+		}
+	case flags&sqlite3vfs.ShmShared != 0:
+		for i := offset; i < offset+n; i++ {
+			if state.exclusive[i] != nil && state.exclusive[i] != f {
+				return false, sqlite3vfs.BusyError
+			}
+		}
+		for i := offset; i < offset+n; i++ {
+			if f.shmLocks[i] == 0 {
+				reading = reading || i >= shmReadLock
+				state.shared[i]++
+				f.shmLocks[i] = sqlite3vfs.ShmShared
+			}
+		}
+	case flags&sqlite3vfs.ShmExclusive != 0:
+		for i := offset; i < offset+n; i++ {
+			others := state.shared[i]
+			if f.shmLocks[i] == sqlite3vfs.ShmShared {
+				others--
+			}
+			if (state.exclusive[i] != nil && state.exclusive[i] != f) || others > 0 {
+				return false, sqlite3vfs.BusyError
+			}
+		}
+		for i := offset; i < offset+n; i++ {
+			if f.shmLocks[i] == sqlite3vfs.ShmShared {
+				state.shared[i]--
+			}
+			state.exclusive[i] = f
+			f.shmLocks[i] = sqlite3vfs.ShmExclusive
+		}
+	default:
+		return false, errors.New("invalid shm lock flags")
+	}
+	return reading, nil
+}
+
+// ShmBarrier orders memory accesses to the WAL index. The bridge has already issued a hardware barrier, taking the
+// mutex orders the Go side.
+func (f *File) ShmBarrier() {
+	state := f.shm()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+}
+
+// ShmUnmap releases the file's locks and detaches it from the WAL index. When deleteFlag is set and no other file
+// is attached the index is discarded.
+func (f *File) ShmUnmap(deleteFlag bool) error {
+	if f.shmState == nil {
+		return nil
+	}
+	state := f.shmState
+	err := f.ShmLock(0, sqlite3vfs.ShmLockSlots, sqlite3vfs.ShmUnlock)
+	f.shmState = nil
+
+	f.vfs.state.mutex.Lock()
+	defer f.vfs.state.mutex.Unlock()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.refs--
+	if state.refs == 0 && deleteFlag && f.vfs.state.shm[f.vfs.storePath(f.name)] == state {
+		delete(f.vfs.state.shm, f.vfs.storePath(f.name))
+		for _, region := range state.regions {
+			sqlite3vfs.ShmFree(region)
+		}
+		state.regions = nil
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// ErrTxClosed is returned by a PageTxn when it is used after being committed or rolled back.
+var ErrTxClosed = errors.New("transaction closed")
+
+// ErrStoreNotFound is returned by a StoreOpener asked to open a missing store without OpenCreate.
+var ErrStoreNotFound = errors.New("store not found")
+
+// PageStore is the backing storage for the pages of a single database.
+// Implementations must provide snapshot isolation: a read transaction sees the pages as they were when it began,
+// and only one write transaction may be open at a time (Begin(true) blocks until the previous writer finishes).
+type PageStore interface {
+	// Begin starts a new transaction. Writable transactions see their own writes.
+	Begin(writable bool) (PageTxn, error)
+
+	// ReadOnly reports whether the store could only be opened read-only, its writable transactions fail.
+	ReadOnly() bool
+
+	// Close releases the store. Transactions must be closed before calling Close.
+	Close() error
+}
+
+// PageTxn is a transaction against a PageStore. Pages are addressed by their byte offset within the database file
+// and stored as serialized pageSchema.Page envelopes.
+type PageTxn interface {
+	// Get returns the page stored at off or nil if there is none. The returned slice is only valid for the life of the
+	// transaction and must not be modified.
+	Get(off int64) []byte
+
+	// Put stores the page at off. It is an error to call Put on a read-only transaction.
+	Put(off int64, page []byte) error
+
+	// Delete removes the page stored at off, if any.
+	Delete(off int64) error
+
+	// GetMeta returns the database metadata stored under key or nil if there is none. The same lifetime rules as Get apply.
+	GetMeta(key string) []byte
+
+	// PutMeta stores database metadata under key.
+	PutMeta(key string, value []byte) error
+
+	// DeleteMeta removes a metadata value, if any.
+	DeleteMeta(key string) error
+
+	// GetContent returns the page content stored under hash or nil if there is none. The same lifetime rules as Get apply.
+	GetContent(hash []byte) []byte
+
+	// PutContent stores page content under its hash.
+	PutContent(hash []byte, data []byte) error
+
+	// DeleteContent removes the content stored under hash, if any.
+	DeleteContent(hash []byte) error
+
+	// ForEachContent calls fn for every stored content in ascending hash order, stopping at the first error.
+	ForEachContent(fn func(hash []byte, data []byte) error) error
+
+	// ForEach calls fn for every stored page in ascending offset order, stopping at the first error.
+	ForEach(fn func(off int64, page []byte) error) error
+
+	// LastOffset returns the highest offset holding a page, ok is false when there are no pages.
+	LastOffset() (off int64, ok bool)
+
+	// GetVersion returns the version of the page at off that was current at revision rev, the one recorded with the
+	// highest revision at or below rev. ok is false when there is none, page is empty when that version is a deletion.
+	// The same lifetime rules as Get apply.
+	GetVersion(off int64, rev int64) (page []byte, ok bool)
+
+	// PutVersion records page as the version of the page at off written by the commit of revision rev, an empty page
+	// records that the commit deleted it.
+	PutVersion(off int64, rev int64, page []byte) error
+
+	// ForEachVersion calls fn for every recorded version in ascending offset then revision order, stopping at the
+	// first error.
+	ForEachVersion(fn func(off int64, rev int64, page []byte) error) error
+
+	// DeleteVersion removes the version of the page at off recorded at revision rev, if any.
+	DeleteVersion(off int64, rev int64) error
+
+	// PutCommit stores the record of the commit of revision rev.
+	PutCommit(rev int64, record []byte) error
+
+	// DeleteCommit removes the record of the commit of revision rev, if any.
+	DeleteCommit(rev int64) error
+
+	// ForEachCommit calls fn for every commit record with a revision at or above from in ascending revision order,
+	// stopping at the first error.
+	ForEachCommit(from int64, fn func(rev int64, record []byte) error) error
+
+	Writable() bool
+	Commit() error
+	Rollback() error
+}
+
+// StoreOpener opens the PageStore for the named database. Openers honor OpenCreate, returning ErrStoreNotFound for a
+// missing store when it isn't set, and may open the store read-only for OpenReadOnly. A read-only store that can be
+// reopened for writing implements upgradableStore, a writable open of its database upgrades it.
+type StoreOpener func(name string, flags sqlite3vfs.OpenFlag) (PageStore, error)
+
+// upgradableStore is a PageStore opened read-only that can be reopened for writing, see BoltStore.Upgrade
+type upgradableStore interface {
+	Upgrade(timeout time.Duration) error
+}
+
+func offsetKey(off int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(off))
+}
+
+func keyOffset(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+// versionKey orders versions by offset, then revision
+func versionKey(off int64, rev int64) []byte {
+	return binary.BigEndian.AppendUint64(offsetKey(off), uint64(rev))
+}
+
+func keyVersion(key []byte) (int64, int64) {
+	return keyOffset(key[:8]), int64(binary.BigEndian.Uint64(key[8:]))
+}
@@ -0,0 +1,275 @@
+package vfs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var pagesKey []byte = []byte("pages")
+var metaKey []byte = []byte("meta")
+var contentKey []byte = []byte("content")
+var versionsKey []byte = []byte("versions")
+var commitsKey []byte = []byte("commits")
+
+// BoltStore is a PageStore backed by a local BoltDB file.
+type BoltStore struct {
+	mutex   sync.RWMutex // guards db, which Upgrade replaces
+	db      *bolt.DB
+	path    string
+	options bolt.Options
+}
+
+// upgradePollInterval is how often Upgrade checks whether the transactions of the store have ended
+const upgradePollInterval = 10 * time.Millisecond
+
+// OpenBoltStore opens (or creates) the BoltDB file at path and prepares its buckets. Read-only stores must have been
+// prepared by an earlier read-write open.
+func OpenBoltStore(path string, options *bolt.Options) (*BoltStore, error) {
+	if options == nil {
+		options = DefaultBoltOptions()
+	}
+	db, err := bolt.Open(path, 0600, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.ReadOnly {
+		return &BoltStore{db: db, path: path, options: *options}, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(pagesKey)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(metaKey)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(contentKey)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(versionsKey)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(commitsKey)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db, path: path, options: *options}, nil
+}
+
+// DefaultBoltOptions returns a copy of the options stores are opened with when Options.BoltOptions is nil, for callers
+// to change
+func DefaultBoltOptions() *bolt.Options {
+	options := *bolt.DefaultOptions
+	options.PageSize = 1 << 16 // 64k - Larger pages to avoid overflow
+	// WAL read transactions keep their snapshot while other connections checkpoint (see wal.go). Growing the mmap
+	// would block those commits until every open read transaction closes.
+	options.InitialMmapSize = 1 << 30
+	return &options
+}
+
+func (s *BoltStore) Begin(writable bool) (PageTxn, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	tx, err := s.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return &boltTxn{tx: tx}, nil
+}
+
+func (s *BoltStore) ReadOnly() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db.IsReadOnly()
+}
+
+// Upgrade reopens a store opened read-only for writing. New transactions wait while it does, and the file is only
+// reopened once the open ones have ended and no other process holds it. It gives up after timeout and the store stays
+// read-only.
+func (s *BoltStore) Upgrade(timeout time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.db.IsReadOnly() {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for s.db.Stats().OpenTxN > 0 {
+		if time.Now().After(deadline) {
+			return errors.New("transactions of the read-only store are still open")
+		}
+		time.Sleep(upgradePollInterval)
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	options := s.options
+	options.ReadOnly = false
+	options.Timeout = max(time.Until(deadline), upgradePollInterval) // A zero timeout waits forever
+	store, err := OpenBoltStore(s.path, &options)
+	if err == nil {
+		s.db = store.db
+		return nil
+	}
+	db, err2 := bolt.Open(s.path, 0600, &s.options)
+	if err2 != nil {
+		return errors.Join(err, err2)
+	}
+	s.db = db
+	return err
+}
+
+func (s *BoltStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.db.Close()
+}
+
+type boltTxn struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTxn) Get(off int64) []byte {
+	return t.tx.Bucket(pagesKey).Get(offsetKey(off))
+}
+
+func (t *boltTxn) Put(off int64, page []byte) error {
+	return t.tx.Bucket(pagesKey).Put(offsetKey(off), page)
+}
+
+func (t *boltTxn) Delete(off int64) error {
+	return t.tx.Bucket(pagesKey).Delete(offsetKey(off))
+}
+
+func (t *boltTxn) GetMeta(key string) []byte {
+	return t.tx.Bucket(metaKey).Get([]byte(key))
+}
+
+func (t *boltTxn) PutMeta(key string, value []byte) error {
+	return t.tx.Bucket(metaKey).Put([]byte(key), value)
+}
+
+func (t *boltTxn) DeleteMeta(key string) error {
+	return t.tx.Bucket(metaKey).Delete([]byte(key))
+}
+
+func (t *boltTxn) GetContent(hash []byte) []byte {
+	return t.tx.Bucket(contentKey).Get(hash)
+}
+
+func (t *boltTxn) PutContent(hash []byte, data []byte) error {
+	return t.tx.Bucket(contentKey).Put(hash, data)
+}
+
+func (t *boltTxn) DeleteContent(hash []byte) error {
+	return t.tx.Bucket(contentKey).Delete(hash)
+}
+
+func (t *boltTxn) ForEachContent(fn func(hash []byte, data []byte) error) error {
+	return t.tx.Bucket(contentKey).ForEach(fn)
+}
+
+func (t *boltTxn) ForEach(fn func(off int64, page []byte) error) error {
+	return t.tx.Bucket(pagesKey).ForEach(func(k, v []byte) error {
+		return fn(keyOffset(k), v)
+	})
+}
+
+func (t *boltTxn) LastOffset() (int64, bool) {
+	k, _ := t.tx.Bucket(pagesKey).Cursor().Last()
+	if k == nil {
+		return 0, false
+	}
+	return keyOffset(k), true
+}
+
+// Stores prepared before history was kept have no versions or commits buckets until they are opened read-write
+
+func (t *boltTxn) GetVersion(off int64, rev int64) ([]byte, bool) {
+	bucket := t.tx.Bucket(versionsKey)
+	if bucket == nil {
+		return nil, false
+	}
+	c := bucket.Cursor()
+	k, v := c.Seek(versionKey(off, rev+1))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	if k == nil || keyOffset(k[:8]) != off {
+		return nil, false
+	}
+	return v, true
+}
+
+func (t *boltTxn) PutVersion(off int64, rev int64, page []byte) error {
+	if page == nil {
+		page = []byte{}
+	}
+	return t.tx.Bucket(versionsKey).Put(versionKey(off, rev), page)
+}
+
+func (t *boltTxn) ForEachVersion(fn func(off int64, rev int64, page []byte) error) error {
+	bucket := t.tx.Bucket(versionsKey)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		off, rev := keyVersion(k)
+		return fn(off, rev, v)
+	})
+}
+
+func (t *boltTxn) DeleteVersion(off int64, rev int64) error {
+	return t.tx.Bucket(versionsKey).Delete(versionKey(off, rev))
+}
+
+func (t *boltTxn) PutCommit(rev int64, record []byte) error {
+	return t.tx.Bucket(commitsKey).Put(offsetKey(rev), record)
+}
+
+func (t *boltTxn) DeleteCommit(rev int64) error {
+	return t.tx.Bucket(commitsKey).Delete(offsetKey(rev))
+}
+
+func (t *boltTxn) ForEachCommit(from int64, fn func(rev int64, record []byte) error) error {
+	bucket := t.tx.Bucket(commitsKey)
+	if bucket == nil {
+		return nil
+	}
+	c := bucket.Cursor()
+	for k, v := c.Seek(offsetKey(from)); k != nil; k, v = c.Next() {
+		if err := fn(keyOffset(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *boltTxn) Writable() bool {
+	return t.tx.Writable()
+}
+
+func (t *boltTxn) Commit() error {
+	return boltErr(t.tx.Commit())
+}
+
+func (t *boltTxn) Rollback() error {
+	return boltErr(t.tx.Rollback())
+}
+
+func boltErr(err error) error {
+	if errors.Is(err, bolt.ErrTxClosed) {
+		return ErrTxClosed
+	}
+	return err
+}
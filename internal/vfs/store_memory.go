@@ -0,0 +1,399 @@
+package vfs
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// MemoryStore is a PageStore kept entirely in memory. Committed pages are published as immutable snapshots, so read
+// transactions never block and never observe a concurrent writer. Writers are serialized like they are in BoltDB.
+type MemoryStore struct {
+	writer   sync.Mutex // held for the life of a write transaction
+	mutex    sync.Mutex // guards snapshot
+	snapshot *memorySnapshot
+}
+
+// memorySnapshot is never modified once it has been published to readers
+type memorySnapshot struct {
+	pages    map[int64][]byte
+	meta     map[string][]byte
+	content  map[string][]byte
+	versions map[int64][]memoryVersion // sorted by revision, copied rather than appended to
+	commits  map[int64][]byte
+}
+
+type memoryVersion struct {
+	rev  int64
+	page []byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		snapshot: &memorySnapshot{
+			pages:    make(map[int64][]byte),
+			meta:     make(map[string][]byte),
+			content:  make(map[string][]byte),
+			versions: make(map[int64][]memoryVersion),
+			commits:  make(map[int64][]byte),
+		},
+	}
+}
+
+func (s *MemoryStore) Begin(writable bool) (PageTxn, error) {
+	if writable {
+		s.writer.Lock()
+	}
+	s.mutex.Lock()
+	snapshot := s.snapshot
+	s.mutex.Unlock()
+	return &memoryTxn{
+		store:    s,
+		snapshot: snapshot,
+		writable: writable,
+	}, nil
+}
+
+func (s *MemoryStore) ReadOnly() bool {
+	return false
+}
+
+// Close is a no-op, the pages stay available to the next Begin. Use MemoryStores.Drop to discard a database.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+type memoryTxn struct {
+	store    *MemoryStore
+	snapshot *memorySnapshot
+	writable bool
+	copied   bool
+	closed   bool
+}
+
+func (t *memoryTxn) Get(off int64) []byte {
+	if t.closed {
+		return nil
+	}
+	return t.snapshot.pages[off]
+}
+
+func (t *memoryTxn) Put(off int64, page []byte) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	t.snapshot.pages[off] = append([]byte(nil), page...)
+	return nil
+}
+
+func (t *memoryTxn) Delete(off int64) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	delete(t.snapshot.pages, off)
+	return nil
+}
+
+func (t *memoryTxn) GetMeta(key string) []byte {
+	if t.closed {
+		return nil
+	}
+	return t.snapshot.meta[key]
+}
+
+func (t *memoryTxn) PutMeta(key string, value []byte) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	t.snapshot.meta[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (t *memoryTxn) DeleteMeta(key string) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	delete(t.snapshot.meta, key)
+	return nil
+}
+
+func (t *memoryTxn) GetContent(hash []byte) []byte {
+	if t.closed {
+		return nil
+	}
+	return t.snapshot.content[string(hash)]
+}
+
+func (t *memoryTxn) PutContent(hash []byte, data []byte) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	t.snapshot.content[string(hash)] = append([]byte(nil), data...)
+	return nil
+}
+
+func (t *memoryTxn) DeleteContent(hash []byte) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	delete(t.snapshot.content, string(hash))
+	return nil
+}
+
+func (t *memoryTxn) ForEachContent(fn func(hash []byte, data []byte) error) error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	hashes := make([]string, 0, len(t.snapshot.content))
+	for hash := range t.snapshot.content {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		if err := fn([]byte(hash), t.snapshot.content[hash]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareWrite copies the snapshot on the first write, the one we started from may be shared with readers
+func (t *memoryTxn) prepareWrite() error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	if !t.writable {
+		return errors.New("write on read only transaction")
+	}
+	if t.copied {
+		return nil
+	}
+	snapshot := &memorySnapshot{
+		pages:    make(map[int64][]byte, len(t.snapshot.pages)+1),
+		meta:     make(map[string][]byte, len(t.snapshot.meta)+1),
+		content:  make(map[string][]byte, len(t.snapshot.content)+1),
+		versions: make(map[int64][]memoryVersion, len(t.snapshot.versions)+1),
+		commits:  make(map[int64][]byte, len(t.snapshot.commits)+1),
+	}
+	for k, v := range t.snapshot.pages {
+		snapshot.pages[k] = v
+	}
+	for k, v := range t.snapshot.meta {
+		snapshot.meta[k] = v
+	}
+	for k, v := range t.snapshot.content {
+		snapshot.content[k] = v
+	}
+	for k, v := range t.snapshot.versions {
+		snapshot.versions[k] = v
+	}
+	for k, v := range t.snapshot.commits {
+		snapshot.commits[k] = v
+	}
+	t.snapshot = snapshot
+	t.copied = true
+	return nil
+}
+
+func (t *memoryTxn) ForEach(fn func(off int64, page []byte) error) error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	offsets := make([]int64, 0, len(t.snapshot.pages))
+	for off := range t.snapshot.pages {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, off := range offsets {
+		if err := fn(off, t.snapshot.pages[off]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTxn) LastOffset() (int64, bool) {
+	if t.closed {
+		return 0, false
+	}
+	last, ok := int64(0), false
+	for off := range t.snapshot.pages {
+		if !ok || off > last {
+			last, ok = off, true
+		}
+	}
+	return last, ok
+}
+
+func (t *memoryTxn) GetVersion(off int64, rev int64) ([]byte, bool) {
+	if t.closed {
+		return nil, false
+	}
+	versions := t.snapshot.versions[off]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].rev > rev })
+	if i == 0 {
+		return nil, false
+	}
+	return versions[i-1].page, true
+}
+
+func (t *memoryTxn) PutVersion(off int64, rev int64, page []byte) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	versions := t.snapshot.versions[off]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].rev >= rev })
+	updated := make([]memoryVersion, 0, len(versions)+1)
+	updated = append(updated, versions[:i]...)
+	updated = append(updated, memoryVersion{rev: rev, page: append([]byte{}, page...)})
+	if i < len(versions) && versions[i].rev == rev {
+		i++
+	}
+	t.snapshot.versions[off] = append(updated, versions[i:]...)
+	return nil
+}
+
+func (t *memoryTxn) ForEachVersion(fn func(off int64, rev int64, page []byte) error) error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	offsets := make([]int64, 0, len(t.snapshot.versions))
+	for off := range t.snapshot.versions {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, off := range offsets {
+		for _, version := range t.snapshot.versions[off] {
+			if err := fn(off, version.rev, version.page); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *memoryTxn) DeleteVersion(off int64, rev int64) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	versions := t.snapshot.versions[off]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].rev >= rev })
+	if i == len(versions) || versions[i].rev != rev {
+		return nil
+	}
+	if len(versions) == 1 {
+		delete(t.snapshot.versions, off)
+		return nil
+	}
+	updated := make([]memoryVersion, 0, len(versions)-1)
+	t.snapshot.versions[off] = append(append(updated, versions[:i]...), versions[i+1:]...)
+	return nil
+}
+
+func (t *memoryTxn) PutCommit(rev int64, record []byte) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	t.snapshot.commits[rev] = append([]byte(nil), record...)
+	return nil
+}
+
+func (t *memoryTxn) DeleteCommit(rev int64) error {
+	if err := t.prepareWrite(); err != nil {
+		return err
+	}
+	delete(t.snapshot.commits, rev)
+	return nil
+}
+
+func (t *memoryTxn) ForEachCommit(from int64, fn func(rev int64, record []byte) error) error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	revisions := make([]int64, 0, len(t.snapshot.commits))
+	for rev := range t.snapshot.commits {
+		if rev >= from {
+			revisions = append(revisions, rev)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] < revisions[j] })
+	for _, rev := range revisions {
+		if err := fn(rev, t.snapshot.commits[rev]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTxn) Writable() bool {
+	return t.writable
+}
+
+func (t *memoryTxn) Commit() error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	if !t.writable {
+		return errors.New("commit on read only transaction")
+	}
+	if t.copied {
+		t.store.mutex.Lock()
+		t.store.snapshot = t.snapshot
+		t.store.mutex.Unlock()
+	}
+	t.close()
+	return nil
+}
+
+func (t *memoryTxn) Rollback() error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	t.close()
+	return nil
+}
+
+func (t *memoryTxn) close() {
+	t.closed = true
+	t.snapshot = nil
+	if t.writable {
+		t.store.writer.Unlock()
+	}
+}
+
+// MemoryStores hands out MemoryStores by database name. A database lives until it is dropped, so connections can be
+// closed and reopened without losing data.
+type MemoryStores struct {
+	mutex  sync.Mutex
+	stores map[string]*MemoryStore
+}
+
+func NewMemoryStores() *MemoryStores {
+	return &MemoryStores{
+		stores: make(map[string]*MemoryStore),
+	}
+}
+
+// Open is a StoreOpener. Stores are never read-only, File rejects the writes of read-only databases.
+func (m *MemoryStores) Open(name string, flags sqlite3vfs.OpenFlag) (PageStore, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	store, ok := m.stores[name]
+	if !ok {
+		if flags&sqlite3vfs.OpenCreate == 0 {
+			return nil, ErrStoreNotFound
+		}
+		store = NewMemoryStore()
+		m.stores[name] = store
+	}
+	return store, nil
+}
+
+// Drop discards the named database. Files that still have it open keep their current snapshot.
+func (m *MemoryStores) Drop(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.stores, name)
+}
@@ -0,0 +1,173 @@
+package vfs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func storeImplementations(t *testing.T) map[string]PageStore {
+	// Readers hold their transaction across commits, which can't grow the mmap while they're open
+	options := *bolt.DefaultOptions
+	options.InitialMmapSize = 1 << 24
+	boltStore, err := OpenBoltStore(filepath.Join(t.TempDir(), "test.db"), &options)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = boltStore.Close() })
+	return map[string]PageStore{
+		"bolt":   boltStore,
+		"memory": NewMemoryStore(),
+	}
+}
+
+func TestPageStore_SnapshotIsolation(t *testing.T) {
+	for name, store := range storeImplementations(t) {
+		t.Run(name, func(t *testing.T) {
+			writer, err := store.Begin(true)
+			require.NoError(t, err)
+			require.NoError(t, writer.Put(SectorSize, []byte("first")))
+			require.NoError(t, writer.Commit())
+
+			reader, err := store.Begin(false)
+			require.NoError(t, err)
+			assert.False(t, reader.Writable())
+
+			writer, err = store.Begin(true)
+			require.NoError(t, err)
+			require.NoError(t, writer.Put(SectorSize, []byte("second")))
+			require.NoError(t, writer.Put(2*SectorSize, []byte("third")))
+			assert.Equal(t, []byte("second"), writer.Get(SectorSize), "Writer should see its own writes")
+			assert.Equal(t, []byte("first"), reader.Get(SectorSize), "Reader should not see uncommitted writes")
+			require.NoError(t, writer.Commit())
+
+			assert.Equal(t, []byte("first"), reader.Get(SectorSize), "Reader should keep its snapshot")
+			assert.Nil(t, reader.Get(2*SectorSize))
+			require.NoError(t, reader.Rollback())
+			assert.Equal(t, ErrTxClosed, reader.Rollback())
+
+			reader, err = store.Begin(false)
+			require.NoError(t, err)
+			defer func() { _ = reader.Rollback() }()
+			var offsets []int64
+			err = reader.ForEach(func(off int64, page []byte) error {
+				offsets = append(offsets, off)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []int64{SectorSize, 2 * SectorSize}, offsets)
+		})
+	}
+}
+
+func TestPageStore_Rollback(t *testing.T) {
+	for name, store := range storeImplementations(t) {
+		t.Run(name, func(t *testing.T) {
+			writer, err := store.Begin(true)
+			require.NoError(t, err)
+			require.NoError(t, writer.Put(0, []byte("discarded")))
+			require.NoError(t, writer.Rollback())
+
+			reader, err := store.Begin(false)
+			require.NoError(t, err)
+			defer func() { _ = reader.Rollback() }()
+			assert.Nil(t, reader.Get(0))
+		})
+	}
+}
+
+func TestPageStore_LastOffset(t *testing.T) {
+	for name, store := range storeImplementations(t) {
+		t.Run(name, func(t *testing.T) {
+			writer, err := store.Begin(true)
+			require.NoError(t, err)
+			_, ok := writer.LastOffset()
+			assert.False(t, ok)
+			require.NoError(t, writer.Put(8192, []byte("two")))
+			require.NoError(t, writer.Put(4096, []byte("one")))
+			off, ok := writer.LastOffset()
+			assert.True(t, ok)
+			assert.Equal(t, int64(8192), off)
+			require.NoError(t, writer.Delete(8192))
+			off, _ = writer.LastOffset()
+			assert.Equal(t, int64(4096), off)
+			require.NoError(t, writer.Rollback())
+		})
+	}
+}
+
+func TestPageStore_Versions(t *testing.T) {
+	for name, store := range storeImplementations(t) {
+		t.Run(name, func(t *testing.T) {
+			writer, err := store.Begin(true)
+			require.NoError(t, err)
+			require.NoError(t, writer.PutVersion(SectorSize, 3, []byte("three")))
+			require.NoError(t, writer.PutVersion(SectorSize, 1, []byte("one")))
+			require.NoError(t, writer.PutVersion(SectorSize, 5, nil))
+			require.NoError(t, writer.PutVersion(2*SectorSize, 2, []byte("other")))
+			require.NoError(t, writer.PutCommit(1, []byte("first")))
+			require.NoError(t, writer.PutCommit(2, []byte("second")))
+			require.NoError(t, writer.Commit())
+
+			reader, err := store.Begin(false)
+			require.NoError(t, err)
+			defer func() { _ = reader.Rollback() }()
+			_, ok := reader.GetVersion(SectorSize, 0)
+			assert.False(t, ok, "No version was recorded before revision 1")
+			page, ok := reader.GetVersion(SectorSize, 2)
+			assert.True(t, ok)
+			assert.Equal(t, []byte("one"), page)
+			page, _ = reader.GetVersion(SectorSize, 3)
+			assert.Equal(t, []byte("three"), page)
+			page, ok = reader.GetVersion(SectorSize, 9)
+			assert.True(t, ok)
+			assert.Empty(t, page, "The page was deleted at revision 5")
+			_, ok = reader.GetVersion(3*SectorSize, 9)
+			assert.False(t, ok)
+
+			var versions []int64
+			err = reader.ForEachVersion(func(off int64, rev int64, page []byte) error {
+				versions = append(versions, off/SectorSize*10+rev)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []int64{11, 13, 15, 22}, versions)
+
+			var commits []string
+			err = reader.ForEachCommit(2, func(rev int64, record []byte) error {
+				commits = append(commits, string(record))
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"second"}, commits)
+		})
+	}
+}
+
+func TestBoltStore_Upgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	store, err := OpenBoltStore(path, nil)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	options := DefaultBoltOptions()
+	options.ReadOnly = true
+	store, err = OpenBoltStore(path, options)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.True(t, store.ReadOnly())
+
+	reader, err := store.Begin(false)
+	require.NoError(t, err)
+	assert.Error(t, store.Upgrade(50*time.Millisecond), "Upgrading should wait for open transactions")
+	assert.True(t, store.ReadOnly())
+	require.NoError(t, reader.Rollback())
+
+	require.NoError(t, store.Upgrade(time.Second))
+	assert.False(t, store.ReadOnly())
+	writer, err := store.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, writer.Put(SectorSize, []byte("written")))
+	require.NoError(t, writer.Commit())
+}
@@ -2,117 +2,368 @@ package vfs
 
 import (
 	"errors"
-	flatbuffers "github.com/google/flatbuffers/go"
-	"github.com/psanford/sqlite3vfs"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	bolt "go.etcd.io/bbolt"
 	"io"
+	"io/fs"
+	"net/url"
 	"os"
 	"path/filepath"
-	pageSchema "s3qlite/internal/schema/page"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/objectstore"
+	"s3qlite/internal/sqlite3vfs"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type dbRef struct {
-	db    *bolt.DB
-	count uint
+	store    PageStore
+	count    uint
+	pageSize int
+	readOnly bool       // the store is open read-only, until a writable open upgrades it (see upgradeDatabase)
+	replica  bool       // the store is a replica, its Files are read-only, see replica.go
+	wal      *walBuffer // writes to the WAL file held by the store that aren't committed yet, see walfile.go
 }
 
+// storeUpgradeTimeout bounds how long a writable open waits for a read-only store to be reopened for writing
+const storeUpgradeTimeout = time.Second
+
+// globalState holds the open stores and WAL indexes, keyed by store path (see VFS.storePath). VFSs keeping their
+// databases in BoltDB files share it, as a BoltDB file can only be opened once in a process.
 type globalState struct {
 	dbs   map[string]*dbRef
+	shm   map[string]*shmState
 	mutex sync.Mutex
 }
 
-var global = globalState{
-	dbs:   make(map[string]*dbRef),
-	mutex: sync.Mutex{},
+func newGlobalState() *globalState {
+	return &globalState{
+		dbs: make(map[string]*dbRef),
+		shm: make(map[string]*shmState),
+	}
 }
 
+var global = newGlobalState()
+
 type VFS struct {
-	tmp    *TmpVFS
-	state  *globalState
-	logger zerolog.Logger
+	tmp           *TmpVFS
+	state         *globalState
+	logger        zerolog.Logger
+	openStore     StoreOpener
+	objects       objectstore.ObjectStore
+	segments      *segmentCache
+	pages         *pageCache
+	disk          *diskCache
+	coordinator   coordinator.Coordinator
+	deltas        bool
+	codec         Codec
+	pageSize      int
+	dataDir       string
+	boltOptions   *bolt.Options
+	clientID      string
+	retention     HistoryRetention
+	logRotateSize int64
+
+	followMutex   sync.Mutex                        // guards followers, commitSignals and tokens
+	followers     map[string]map[*follower]struct{} // by database, see changelog.go
+	commitSignals map[string]chan struct{}          // by database, see session.go
+	tokens        map[commitToken]int64             // revision of the last commit by database and client id
+}
+
+// NewVFS creates a VFS keeping its databases in BoltDB stores under options.DataDir.
+func NewVFS(options Options) (*VFS, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := newTempVFS(options.TmpDir)
+	if err != nil {
+		return nil, err
+	}
+	v := &VFS{
+		tmp:           tmp,
+		state:         global,
+		logger:        *options.Logger,
+		segments:      newSegmentCache(options.CacheSize),
+		pages:         newPageCache(options.PageCacheSize),
+		pageSize:      options.PageSize,
+		dataDir:       options.DataDir,
+		boltOptions:   options.BoltOptions,
+		clientID:      options.ClientID,
+		retention:     options.HistoryRetention,
+		logRotateSize: options.LogRotateSize,
+	}
+	if options.DiskCacheDir != "" {
+		if v.disk, err = openDiskCache(options.DiskCacheDir, options.DiskCacheSize, v.logger); err != nil {
+			return nil, err
+		}
+	}
+	v.openStore = v.openBoltStore
+	return v, nil
 }
 
-func NewVFS() *VFS {
-	return &VFS{
-		tmp:    newTempVFS(),
-		state:  &global,
-		logger: log.Output(zerolog.ConsoleWriter{Out: os.Stderr}),
+// NewVFSWithStore creates a VFS whose main database files are kept in the PageStores returned by opener.
+func NewVFSWithStore(opener StoreOpener, options Options) (*VFS, error) {
+	v, err := NewVFS(options)
+	if err != nil {
+		return nil, err
 	}
+	v.openStore = opener
+	v.state = newGlobalState() // Only this VFS opens the stores of opener
+	return v, nil
+}
+
+// UseObjectStore configures where compacted pages are written by Compact and read back from on demand.
+func (v *VFS) UseObjectStore(objects objectstore.ObjectStore) {
+	v.objects = objects
+}
+
+// storePath returns the path of the store of a database or WAL, which identifies it across VFSs
+func (v *VFS) storePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(v.dataDir, name)
+}
+
+// tmpName returns the name of a journal or temporary file in TmpDir. Files named after a database are named after its
+// store path, so databases with the same name in different directories don't share journals.
+func (v *VFS) tmpName(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	name, _, err := parseName(name)
+	if err != nil {
+		return "", err
+	}
+	return "/" + url.PathEscape(v.storePath(name)), nil
+}
+
+func (v *VFS) openBoltStore(name string, flags sqlite3vfs.OpenFlag) (PageStore, error) {
+	path := v.storePath(name)
+	if flags&sqlite3vfs.OpenCreate == 0 {
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrStoreNotFound
+		}
+	}
+	// Read-only stores only take a shared lock on the file, other processes can still read it
+	options := *v.boltOptions
+	options.ReadOnly = flags&sqlite3vfs.OpenReadOnly != 0
+	return OpenBoltStore(path, &options)
+}
+
+// upgradeDatabase reopens the read-only store of a database for writing, so a writable open can write it. The store
+// stays read-only, and so does the File being opened, when it can't be: other processes hold it, it isn't writable or
+// Files don't end their transactions in time.
+func (v *VFS) upgradeDatabase(name string, db *dbRef) error {
+	store, ok := db.store.(upgradableStore)
+	if !db.readOnly || !ok {
+		return nil
+	}
+	if err := store.Upgrade(storeUpgradeTimeout); err != nil {
+		v.logger.Info().Err(err).Str("name", name).Msg("database stays read-only")
+		return nil
+	}
+	db.readOnly = db.store.ReadOnly()
+	if db.readOnly {
+		return nil
+	}
+	return startHistory(db.store)
 }
 
 func (v *VFS) Open(name string, flags sqlite3vfs.OpenFlag) (sqlite3vfs.File, sqlite3vfs.OpenFlag, error) {
 	if flags&sqlite3vfs.OpenWAL != 0 {
-		return nil, 0, errors.New("WAL mode not supported")
+		if v.coordinator != nil {
+			return nil, 0, errors.New("WAL mode is not supported with a coordinator")
+		}
+		walName, _, err := parseName(name)
+		if err != nil {
+			v.logger.Error().Err(err).Str("name", name).Msg("error parsing WAL name")
+			return nil, 0, sqlite3vfs.CantOpenError
+		}
+		return v.openWAL(walName, flags)
 	}
 
 	if flags&sqlite3vfs.OpenMainDB == 0 {
+		name, err := v.tmpName(name)
+		if err != nil {
+			v.logger.Error().Err(err).Str("name", name).Msg("error parsing file name")
+			return nil, 0, sqlite3vfs.CantOpenError
+		}
 		return v.tmp.Open(name, flags)
 	}
 
-	dbName, _ := strings.CutPrefix(name, "/")
+	dbName, params, err := parseName(name)
+	if err != nil {
+		v.logger.Error().Err(err).Str("name", name).Msg("error parsing database name")
+		return nil, 0, sqlite3vfs.CantOpenError
+	}
+	if params.asOf != nil {
+		flags &^= sqlite3vfs.OpenCreate // Past states of databases that don't exist are an error
+	}
+	key := v.storePath(dbName)
 	v.state.mutex.Lock()
 	defer v.state.mutex.Unlock()
-	db, ok := v.state.dbs[dbName]
+	db, ok := v.state.dbs[key]
+	if ok && flags&sqlite3vfs.OpenExclusive != 0 {
+		return nil, 0, sqlite3vfs.CantOpenError
+	}
 	if !ok {
-		db = &dbRef{
-			count: 0,
-		}
-		options := *bolt.DefaultOptions
-		options.PageSize = 1 << 16 // 64k - Larger pages to avoid overflow
-
-		// TODO: Deal with read only opening and other flags
-		var err error
-		db.db, err = bolt.Open(filepath.Join(v.tmp.tmpdir, dbName), 0600, &options)
+		db, err = v.openDatabase(dbName, flags, params.pageSize)
 		if err != nil {
 			return nil, 0, err
 		}
-		err = db.db.Update(func(tx *bolt.Tx) error {
-			b, err := tx.CreateBucketIfNotExists(pagesKey)
-			if err != nil {
-				return err
-			}
-			fp := b.Get(offsetKey(0))
-			if fp == nil {
-				builder := flatbuffers.NewBuilder(0)
-				realData := builder.CreateByteVector(firstPageTemplate)
-				pageSchema.RealStart(builder)
-				pageSchema.RealAddData(builder, realData)
-				realPtr := pageSchema.RealEnd(builder)
-				pageSchema.PageStart(builder)
-				pageSchema.PageAddRevision(builder, 0)
-				pageSchema.PageAddDataType(builder, pageSchema.DataReal)
-				pageSchema.PageAddData(builder, realPtr)
-				root := pageSchema.PageEnd(builder)
-				builder.Finish(root)
-				buf := builder.FinishedBytes()
-				err = b.Put(offsetKey(0), buf)
-				if err != nil {
-					return err
-				}
+		v.state.dbs[key] = db
+	} else if flags&sqlite3vfs.OpenReadWrite != 0 && params.asOf == nil {
+		if err = v.upgradeDatabase(dbName, db); err != nil {
+			v.logger.Error().Err(err).Str("name", name).Msg("error upgrading database store")
+			return nil, 0, sqlite3vfs.IOError
+		}
+	}
+	rev := int64(0)
+	if params.asOf != nil {
+		if rev, err = v.openAsOf(db.store, dbName, *params.asOf); err != nil {
+			v.logger.Error().Err(err).Str("name", name).Msg("error opening database as of a past revision")
+			if db.count == 0 {
+				delete(v.state.dbs, key)
+				_ = db.store.Close()
 			}
-			return nil
-		})
-		if err != nil {
-			_ = db.db.Close()
-			return nil, 0, err
+			return nil, 0, sqlite3vfs.CantOpenError
 		}
-		v.state.dbs[dbName] = db
 	}
 	db.count++
 
-	return NewFile(v, dbName), flags, nil
+	// Like the default VFS, a database that can't be opened for writing is opened read-only and reported as such.
+	// Otherwise read-only opens are enforced by their File, the store may be writable for others.
+	if (db.readOnly || db.replica || params.asOf != nil) && flags&sqlite3vfs.OpenReadWrite != 0 {
+		flags = flags&^sqlite3vfs.OpenReadWrite | sqlite3vfs.OpenReadOnly
+	}
+	f := NewFile(v, dbName)
+	f.readOnly = flags&sqlite3vfs.OpenReadOnly != 0
+	f.historical = params.asOf != nil
+	f.asOf = rev
+	f.clientID = params.clientID
+	if f.clientID == "" {
+		f.clientID = v.clientID
+	}
+	f.minRevision = params.minRevision
+	f.revisionWait = params.minRevisionTimeout
+	return f, flags, nil
+}
+
+// openDatabase opens the store of a database no File has open. A database exists once its store does, missing
+// databases are only created with OpenCreate (with pageSize, or the VFS's page size when zero) and existing ones are
+// rejected with OpenExclusive.
+func (v *VFS) openDatabase(name string, flags sqlite3vfs.OpenFlag, pageSize int) (*dbRef, error) {
+	if v.coordinator != nil {
+		// The local store is a replica that catching up writes to, read-only Files are enforced by File alone
+		flags = flags&^sqlite3vfs.OpenReadOnly | sqlite3vfs.OpenReadWrite
+	}
+	if flags&sqlite3vfs.OpenExclusive != 0 {
+		store, err := v.openStore(name, flags&^sqlite3vfs.OpenCreate)
+		if err == nil {
+			_ = store.Close()
+			return nil, sqlite3vfs.CantOpenError
+		} else if !errors.Is(err, ErrStoreNotFound) {
+			return nil, err
+		}
+	}
+	store, err := v.openStore(name, flags)
+	if errors.Is(err, ErrStoreNotFound) {
+		return nil, sqlite3vfs.CantOpenError
+	} else if err != nil {
+		return nil, err
+	}
+
+	db := &dbRef{store: store, readOnly: store.ReadOnly()}
+	if db.readOnly {
+		db.pageSize, err = existingPageSize(store)
+	} else {
+		if pageSize == 0 {
+			pageSize = v.pageSize
+		}
+		db.pageSize, err = seedFirstPage(store, pageSize)
+		if err == nil {
+			err = startHistory(store)
+		}
+	}
+	if err == nil {
+		db.replica, err = isReplica(store)
+	}
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// existingPageSize returns the page size of a database that can't be seeded
+func existingPageSize(store PageStore) (int, error) {
+	txn, err := store.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	return storedPageSize(txn), nil
+}
+
+// seedFirstPage writes an empty first page with the given page size into an empty store. It returns the page size of
+// the database, which is only pageSize when the store was empty.
+func seedFirstPage(store PageStore, pageSize int) (int, error) {
+	txn, err := store.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if txn.Get(0) != nil {
+		return storedPageSize(txn), nil
+	}
+	hash, err := storeContent(txn, firstPageFor(pageSize), CodecNone)
+	if err != nil {
+		return 0, err
+	}
+	err = txn.Put(0, newRefPage(0, pageRef{hash: hash}))
+	if err != nil {
+		return 0, err
+	}
+	if err = putStoredPageSize(txn, pageSize); err != nil {
+		return 0, err
+	}
+	return pageSize, txn.Commit()
 }
 
 func (v *VFS) Delete(name string, dirSync bool) error {
+	if isWALName(name) {
+		walName, _, err := parseName(name)
+		if err != nil {
+			return err
+		}
+		return v.deleteWAL(walName)
+	}
+	name, err := v.tmpName(name)
+	if err != nil {
+		return err
+	}
 	return v.tmp.Delete(name, dirSync)
 }
 
 func (v *VFS) Access(name string, flags sqlite3vfs.AccessFlag) (bool, error) {
+	if isWALName(name) {
+		walName, params, err := parseName(name)
+		if err != nil {
+			return false, err
+		}
+		if params.asOf != nil {
+			return false, nil // SQLite would read a past state with the current WAL
+		}
+		return v.walExists(walName)
+	}
+	name, err := v.tmpName(name)
+	if err != nil {
+		return false, err
+	}
 	return v.tmp.Access(name, flags)
 }
 
@@ -124,16 +375,15 @@ type TmpVFS struct {
 	tmpdir string
 }
 
-func newTempVFS() *TmpVFS {
-
-	dir, err := os.MkdirTemp( /*os.Getenv("TMPDIR")*/ "/Users/bwarminski/src/bolt-sandbox", "sqlite3vfs_test_tmpvfs")
+func newTempVFS(parent string) (*TmpVFS, error) {
+	dir, err := os.MkdirTemp(parent, "skylite-tmp")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return &TmpVFS{
 		tmpdir: dir,
-	}
+	}, nil
 }
 
 func (vfs *TmpVFS) Open(name string, flags sqlite3vfs.OpenFlag) (sqlite3vfs.File, sqlite3vfs.OpenFlag, error) {
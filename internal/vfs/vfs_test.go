@@ -0,0 +1,199 @@
+package vfs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestVFS_Open_Create(t *testing.T) {
+	vfsInstance := makeVFS()
+	_, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	assert.Equal(t, sqlite3vfs.CantOpenError, err, "Missing databases are only created with OpenCreate")
+
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	file, _, err = vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	require.NoError(t, err, "The database exists once created")
+	require.NoError(t, file.Close())
+}
+
+func TestVFS_Open_Exclusive(t *testing.T) {
+	vfsInstance := makeVFS()
+	flags := sqlite3vfs.OpenMainDB | sqlite3vfs.OpenReadWrite | sqlite3vfs.OpenCreate | sqlite3vfs.OpenExclusive
+	file, _, err := vfsInstance.Open("test.db", flags)
+	require.NoError(t, err)
+
+	_, _, err = vfsInstance.Open("test.db", flags)
+	assert.Equal(t, sqlite3vfs.CantOpenError, err, "An open database exists")
+	require.NoError(t, file.Close())
+	_, _, err = vfsInstance.Open("test.db", flags)
+	assert.Equal(t, sqlite3vfs.CantOpenError, err, "A closed database still exists")
+}
+
+func TestVFS_Open_ReadOnly(t *testing.T) {
+	vfsInstance := makeVFS()
+	writer, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(writer)
+	lockForRead(t, writer)
+	lockForWrite(t, writer)
+	_, err = writer.WriteAt(sector("Hello, World!"), SectorSize)
+	require.NoError(t, err)
+	require.NoError(t, writer.(*File).ConfirmCommit())
+	unlockForWrite(t, writer)
+	unlockForRead(t, writer)
+
+	reader, flags, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadOnly)
+	require.NoError(t, err)
+	defer cleanup(t)(reader)
+	assert.Equal(t, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadOnly, flags)
+
+	lockForRead(t, reader)
+	assertPage(t, reader, SectorSize, "Hello, World!")
+	_, err = reader.WriteAt(sector("Goodbye"), SectorSize)
+	assert.Equal(t, sqlite3vfs.ReadOnlyError, err)
+	assert.Equal(t, sqlite3vfs.ReadOnlyError, reader.Truncate(SectorSize))
+	assert.Equal(t, sqlite3vfs.ReadOnlyError, reader.Lock(sqlite3vfs.LockReserved))
+	unlockForRead(t, reader)
+}
+
+func TestVFS_Open_ReadOnlyBoltStore(t *testing.T) {
+	vfsInstance := makeVFS()
+	vfsInstance.dataDir = t.TempDir()
+	vfsInstance.boltOptions = DefaultBoltOptions()
+	vfsInstance.openStore = vfsInstance.openBoltStore
+
+	_, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadOnly)
+	assert.Equal(t, sqlite3vfs.CantOpenError, err)
+	file, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	reader, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadOnly)
+	require.NoError(t, err)
+	header := make([]byte, 100)
+	_, err = reader.ReadAt(header, 0)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPageSize, headerPageSize(header))
+
+	_, err = reader.WriteAt(sector("Hello, World!"), SectorSize)
+	assert.Equal(t, sqlite3vfs.ReadOnlyError, err)
+	options := DefaultBoltOptions()
+	options.ReadOnly = true
+	options.Timeout = 100 * time.Millisecond
+	process, err := bolt.Open(filepath.Join(vfsInstance.dataDir, "test.db"), 0600, options)
+	require.NoError(t, err, "Read-only opens shouldn't keep other processes out")
+	require.NoError(t, process.Close())
+
+	// A read-write open upgrades the store, the read-only File stays read-only
+	writer, flags, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	assert.NotZero(t, flags&sqlite3vfs.OpenReadWrite)
+	lockForRead(t, writer)
+	writePages(t, writer, map[int64]string{SectorSize: "Hello, World!"})
+	unlockForRead(t, writer)
+	_, err = reader.WriteAt(sector("Hello, World!"), SectorSize)
+	assert.Equal(t, sqlite3vfs.ReadOnlyError, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, reader.Close())
+
+	// A store held by another process can't be upgraded, read-write opens are read-only until it is released
+	options = DefaultBoltOptions()
+	options.ReadOnly = true
+	held, err := bolt.Open(filepath.Join(vfsInstance.dataDir, "test.db"), 0600, options)
+	require.NoError(t, err)
+	defer held.Close()
+	reader, _, err = vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadOnly)
+	require.NoError(t, err)
+	defer cleanup(t)(reader)
+	other, flags, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(other)
+	assert.Zero(t, flags&sqlite3vfs.OpenReadWrite)
+	assert.NotZero(t, flags&sqlite3vfs.OpenReadOnly)
+	_, err = other.WriteAt(sector("Hello, World!"), SectorSize)
+	assert.Equal(t, sqlite3vfs.ReadOnlyError, err)
+}
+
+func TestParseName(t *testing.T) {
+	name, params, err := parseName("/app.db")
+	require.NoError(t, err)
+	assert.Equal(t, "app.db", name)
+	assert.Zero(t, params.pageSize)
+	assert.Nil(t, params.asOf)
+
+	name, params, err = parseName("/app.db?dir=/var/lib/app&page_size=8192")
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/app/app.db", name)
+	assert.Equal(t, 8192, params.pageSize)
+
+	_, params, err = parseName("app.db?as_of=42&client_id=worker-1")
+	require.NoError(t, err)
+	assert.Equal(t, &asOf{revision: 42}, params.asOf)
+	assert.Equal(t, "worker-1", params.clientID)
+	_, params, err = parseName("app.db?as_of=2026-10-17T10%3A00%3A00%2B02%3A00")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC), params.asOf.at.UTC())
+	assert.Equal(t, DefaultMinRevisionTimeout, params.minRevisionTimeout)
+	_, params, err = parseName("app.db?min_revision=7&min_revision_timeout=250ms")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), params.minRevision)
+	assert.Equal(t, 250*time.Millisecond, params.minRevisionTimeout)
+
+	_, _, err = parseName("app.db?dir=relative")
+	assert.Error(t, err)
+	_, _, err = parseName("app.db?page_size=1000")
+	assert.Error(t, err)
+	_, _, err = parseName("app.db?as_of=yesterday")
+	assert.Error(t, err)
+	_, _, err = parseName("app.db?min_revision=-1")
+	assert.Error(t, err)
+	_, _, err = parseName("app.db?min_revision=1&min_revision_timeout=soon")
+	assert.Error(t, err)
+}
+
+func TestNewVFS_Options(t *testing.T) {
+	_, err := NewVFS(Options{TmpDir: t.TempDir(), PageSize: 1000})
+	assert.Error(t, err)
+
+	dataDir, otherDir := t.TempDir(), t.TempDir()
+	vfsInstance, err := NewVFS(Options{DataDir: dataDir, TmpDir: t.TempDir(), PageSize: 8192})
+	require.NoError(t, err)
+
+	file, _, err := vfsInstance.Open("/options.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	assert.FileExists(t, filepath.Join(dataDir, "options.db"))
+	assert.Equal(t, int64(8192), file.(*File).pageSize)
+
+	file, _, err = vfsInstance.Open("/options.db?dir="+otherDir+"&page_size=16384", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	assert.FileExists(t, filepath.Join(otherDir, "options.db"))
+	assert.Equal(t, int64(16384), file.(*File).pageSize, "A database in another directory is another database")
+
+	other, err := NewVFS(Options{DataDir: otherDir, TmpDir: t.TempDir(), PageSize: 4096})
+	require.NoError(t, err)
+	file, _, err = other.Open("/options.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	assert.Equal(t, int64(16384), file.(*File).pageSize, "VFSs should share the databases in the same directory")
+	file, _, err = other.Open("/options.db?dir="+dataDir, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file)
+	assert.Equal(t, int64(8192), file.(*File).pageSize)
+
+	journal, err := vfsInstance.tmpName("/options.db-journal")
+	require.NoError(t, err)
+	otherJournal, err := vfsInstance.tmpName("/options.db-journal?dir=" + otherDir)
+	require.NoError(t, err)
+	assert.NotEqual(t, journal, otherJournal, "Databases in different directories should have different journals")
+}
@@ -0,0 +1,98 @@
+package vfs
+
+import (
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// In WAL mode SQLite keeps a shared lock on the database for as long as the connection is open and commits to the
+// WAL file instead (see walFile and shm.go), so the database file is only written by checkpoints. Checkpoints write
+// without holding the reserved lock, so they are collected in a write transaction of their own that is committed when
+// SQLite syncs the database, or at the latest when it unlocks it. Every read transaction takes a fresh snapshot when
+// it takes its read lock in the WAL index (see ShmLock) and keeps it to its end: the WAL index guarantees the pages a
+// reader takes from the database file are the ones it expects, as long as it sees every checkpoint that completed
+// before it.
+//
+// WAL databases can't be shared through a coordinator, the WAL index only exists in this process.
+
+// walMode reports whether the database header in the current transaction selects WAL mode
+func (f *File) walMode() bool {
+	page, err := f.readPage(0, dontRecord(), defaultFirstPage())
+	if err != nil {
+		return false
+	}
+	return page[18] == 2 || page[19] == 2
+}
+
+// prepareWrite ensures the transaction can be written to. Outside of WAL mode that takes the reserved lock, in WAL
+// mode a write without it starts a checkpoint.
+func (f *File) prepareWrite() error {
+	if f.txn == nil {
+		f.vfs.logger.Error().Msg("unexpected write without transaction")
+		return sqlite3vfs.IOError
+	}
+	if f.txn.Writable() {
+		return nil
+	}
+	if !f.wal {
+		f.vfs.logger.Error().Msg("unexpected write without write transaction")
+		return sqlite3vfs.IOError
+	}
+
+	err := f.txn.Rollback()
+	if err != nil && err != ErrTxClosed {
+		f.vfs.logger.Error().Err(err).Msg("error rolling back transaction")
+		return sqlite3vfs.IOError
+	}
+	f.txn, err = f.store.Begin(true)
+	if err != nil {
+		f.txn = nil
+		f.vfs.logger.Error().Err(err).Msg("error starting checkpoint transaction")
+		return sqlite3vfs.IOError
+	}
+	f.commitRevision = storedRevision(f.txn) + 1
+	f.written = make(map[int64]struct{})
+	f.truncated = make(map[int64]struct{})
+	f.bases = make(map[int64][]byte)
+	f.codec = f.vfs.databaseCodec(f.txn)
+	f.checkpointing = true
+	return nil
+}
+
+// finishCheckpoint commits the checkpoint transaction and goes back to reading
+func (f *File) finishCheckpoint() error {
+	f.checkpointing = false
+	err := putStoredRevision(f.txn, f.commitRevision)
+	if err == nil {
+		err = recordCommit(f.txn, f.commitRevision, f.written, f.clientID)
+	}
+	if err == nil {
+		err = f.txn.Commit()
+	} else {
+		_ = f.txn.Rollback()
+	}
+	if err == nil {
+		f.committed()
+	}
+	var err2 error
+	f.txn, err2 = f.store.Begin(false)
+	if err2 != nil {
+		f.txn = nil
+	}
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// refreshSnapshot moves the read transaction to the latest committed state, as a WAL read transaction starts
+func (f *File) refreshSnapshot() error {
+	err := f.txn.Rollback()
+	if err != nil && err != ErrTxClosed {
+		return err
+	}
+	f.txn, err = f.store.Begin(false)
+	if err != nil {
+		f.txn = nil
+	}
+	return err
+}
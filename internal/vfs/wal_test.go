@@ -0,0 +1,227 @@
+package vfs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"s3qlite/internal/coordinator"
+	"s3qlite/internal/sqlite3vfs"
+)
+
+func TestWALFile(t *testing.T) {
+	vfsInstance := makeVFS()
+	exists, err := vfsInstance.Access("/test.db-wal", sqlite3vfs.AccessExists)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, _, err = vfsInstance.Open("/test.db-wal", sqlite3vfs.OpenWAL|sqlite3vfs.OpenReadWrite)
+	assert.Error(t, err, "Opening a missing WAL without OpenCreate should fail")
+
+	file, _, err := vfsInstance.Open("/test.db-wal", sqlite3vfs.OpenWAL|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, file.Close()) }()
+	exists, err = vfsInstance.Access("/test.db-wal", sqlite3vfs.AccessExists)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// A frame header followed by a page straddling a chunk boundary
+	_, err = file.WriteAt([]byte("frame header"), walChunkSize-24)
+	require.NoError(t, err)
+	_, err = file.WriteAt(sector("page"), walChunkSize-12)
+	require.NoError(t, err)
+	size, err := file.FileSize()
+	require.NoError(t, err)
+	assert.Equal(t, int64(walChunkSize-12+SectorSize), size)
+
+	buf := make([]byte, 16)
+	n, err := file.ReadAt(buf, walChunkSize-24)
+	require.NoError(t, err)
+	assert.Equal(t, 16, n)
+	assert.Equal(t, "frame headerpage", string(buf))
+
+	// Short reads are zero filled
+	buf = []byte("xxxxxxxx")
+	n, err = file.ReadAt(buf, size-4)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, make([]byte, 8), buf)
+
+	require.NoError(t, file.Truncate(walChunkSize-20))
+	size, err = file.FileSize()
+	require.NoError(t, err)
+	assert.Equal(t, int64(walChunkSize-20), size)
+	require.NoError(t, file.Truncate(walChunkSize))
+	buf = make([]byte, 12)
+	_, err = file.ReadAt(buf, walChunkSize-24)
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte("fram"), make([]byte, 8)...), buf, "Truncated bytes should read as zeros when the file grows again")
+
+	require.NoError(t, vfsInstance.Delete("/test.db-wal", false))
+	exists, err = vfsInstance.Access("/test.db-wal", sqlite3vfs.AccessExists)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestWALFile_Sync(t *testing.T) {
+	vfsInstance := makeVFS()
+	file1, _, err := vfsInstance.Open("/test.db-wal", sqlite3vfs.OpenWAL|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, file1.Close()) }()
+	file2, _, err := vfsInstance.Open("/test.db-wal", sqlite3vfs.OpenWAL|sqlite3vfs.OpenReadWrite)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, file2.Close()) }()
+	storedSize := func() int64 {
+		txn, err := file1.(*walFile).store.Begin(false)
+		require.NoError(t, err)
+		defer func() { _ = txn.Rollback() }()
+		return walSize(txn)
+	}
+
+	_, err = file1.WriteAt([]byte("frame"), 0)
+	require.NoError(t, err)
+	_, err = file1.WriteAt(sector("page"), 5)
+	require.NoError(t, err)
+	assert.Zero(t, storedSize(), "Writes should be buffered until the WAL is synced")
+	buf := make([]byte, 9)
+	_, err = file2.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "framepage", string(buf), "Buffered writes should be read by every connection")
+
+	require.NoError(t, file1.Sync(sqlite3vfs.SyncNormal))
+	assert.Equal(t, int64(5+SectorSize), storedSize())
+	size, err := file2.FileSize()
+	require.NoError(t, err)
+	assert.Equal(t, int64(5+SectorSize), size)
+}
+
+func TestFile_Shm(t *testing.T) {
+	vfsInstance := makeVFS()
+	file1, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file1)
+	file2, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(file2)
+	f1, f2 := file1.(*File), file2.(*File)
+
+	region, err := f1.ShmMap(0, 32768, false)
+	require.NoError(t, err)
+	assert.Nil(t, region)
+	region, err = f1.ShmMap(0, 32768, true)
+	require.NoError(t, err)
+	region[0] = 42
+	shared, err := f2.ShmMap(0, 32768, false)
+	require.NoError(t, err)
+	assert.Equal(t, byte(42), shared[0], "Files of a database should share regions")
+
+	require.NoError(t, f1.ShmLock(3, 1, sqlite3vfs.ShmLock|sqlite3vfs.ShmShared))
+	require.NoError(t, f2.ShmLock(3, 1, sqlite3vfs.ShmLock|sqlite3vfs.ShmShared))
+	assert.Equal(t, sqlite3vfs.BusyError, f2.ShmLock(3, 1, sqlite3vfs.ShmLock|sqlite3vfs.ShmExclusive))
+	require.NoError(t, f1.ShmLock(3, 1, sqlite3vfs.ShmUnlock|sqlite3vfs.ShmShared))
+	require.NoError(t, f2.ShmLock(3, 1, sqlite3vfs.ShmLock|sqlite3vfs.ShmExclusive), "A shared lock can be upgraded when no one else holds it")
+	assert.Equal(t, sqlite3vfs.BusyError, f1.ShmLock(2, 2, sqlite3vfs.ShmLock|sqlite3vfs.ShmShared))
+	require.NoError(t, f1.ShmLock(0, 1, sqlite3vfs.ShmLock|sqlite3vfs.ShmExclusive))
+
+	require.NoError(t, f2.ShmUnmap(false))
+	require.NoError(t, f1.ShmLock(2, 2, sqlite3vfs.ShmLock|sqlite3vfs.ShmShared), "Unmapping should release locks")
+	require.NoError(t, f1.ShmUnmap(true))
+
+	region, err = f1.ShmMap(0, 32768, false)
+	require.NoError(t, err)
+	assert.Nil(t, region, "The index should be discarded once the last file unmaps it")
+	require.NoError(t, f1.ShmUnmap(true))
+}
+
+func TestFile_WALCheckpoint(t *testing.T) {
+	vfsInstance := makeVFS()
+	writer, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(writer)
+	reader, _, err := vfsInstance.Open("test.db", sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	require.NoError(t, err)
+	defer cleanup(t)(reader)
+
+	// Switching to WAL mode is an ordinary write transaction
+	lockForRead(t, writer)
+	lockForWrite(t, writer)
+	header := firstPageFor(SectorSize)
+	header[18], header[19] = 2, 2
+	_, err = writer.WriteAt(header, 0)
+	require.NoError(t, err)
+	require.NoError(t, writer.(*File).ConfirmCommit())
+	unlockForWrite(t, writer)
+	assert.True(t, writer.(*File).wal)
+
+	lockForRead(t, reader)
+	assert.True(t, reader.(*File).wal)
+
+	// Checkpoints write while holding the shared lock and are published when the database is synced
+	_, err = writer.WriteAt(sector("checkpointed"), SectorSize)
+	require.NoError(t, err)
+	require.NoError(t, writer.(*File).ConfirmCommit(), "WAL commits don't involve the database file")
+	readLock := func() {
+		require.NoError(t, reader.(*File).ShmLock(shmReadLock, 1, sqlite3vfs.ShmUnlock|sqlite3vfs.ShmShared))
+		require.NoError(t, reader.(*File).ShmLock(shmReadLock, 1, sqlite3vfs.ShmLock|sqlite3vfs.ShmShared))
+	}
+	readLock()
+	_, err = reader.ReadAt(make([]byte, SectorSize), SectorSize)
+	assert.Error(t, err, "Checkpoint writes shouldn't be visible before the sync")
+	require.NoError(t, writer.Sync(sqlite3vfs.SyncNormal))
+	_, err = reader.ReadAt(make([]byte, SectorSize), SectorSize)
+	assert.Error(t, err, "A read transaction should keep its snapshot")
+	readLock()
+	assertPage(t, reader, SectorSize, "checkpointed")
+	assertPage(t, writer, SectorSize, "checkpointed")
+	require.NoError(t, reader.(*File).ShmUnmap(false))
+	unlockForRead(t, reader)
+	unlockForRead(t, writer)
+}
+
+func TestVFS_WAL_WithCoordinator(t *testing.T) {
+	vfsInstance := makeCoordinatedVFS(coordinator.NewEmbedded())
+	_, _, err := vfsInstance.Open("/test.db-wal", sqlite3vfs.OpenWAL|sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate)
+	assert.Error(t, err)
+}
+
+func TestVFS_SQLite_WAL(t *testing.T) {
+	dataDir := t.TempDir()
+	logger := zerolog.Nop()
+	vfsInstance, err := NewVFS(Options{DataDir: t.TempDir(), TmpDir: t.TempDir(), Logger: &logger})
+	require.NoError(t, err)
+	require.NoError(t, sqlite3vfs.RegisterVFS("skylite-wal", vfsInstance))
+	defer func() {
+		require.NoError(t, sqlite3vfs.UnregisterVFS("skylite-wal"))
+	}()
+	uri := "file:wal.db?vfs=skylite-wal&dir=" + dataDir
+
+	writer, err := sqlite3vfs.OpenConn(uri)
+	require.NoError(t, err)
+	rows, err := writer.Query("PRAGMA journal_mode = WAL")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"wal"}}, rows)
+	require.NoError(t, writer.Exec("CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('a'), ('b')"))
+
+	reader, err := sqlite3vfs.OpenConn(uri)
+	require.NoError(t, err)
+	rows, err = reader.Query("SELECT group_concat(v) FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"a,b"}}, rows, "Connections share the WAL index")
+
+	require.NoError(t, writer.Exec("INSERT INTO t VALUES ('c'); PRAGMA wal_checkpoint(TRUNCATE)"))
+	rows, err = reader.Query("SELECT group_concat(v) FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"a,b,c"}}, rows)
+	require.NoError(t, reader.Close())
+	require.NoError(t, writer.Close())
+	assert.FileExists(t, filepath.Join(dataDir, "wal.db"))
+
+	reopened, err := sqlite3vfs.OpenConn(uri)
+	require.NoError(t, err)
+	defer reopened.Close()
+	rows, err = reopened.Query("SELECT count(*) FROM t")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"3"}}, rows)
+}
@@ -0,0 +1,358 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+
+	"s3qlite/internal/sqlite3vfs"
+)
+
+// WAL files are kept in a PageStore of their own, named after the database with a -wal suffix. Unlike database files
+// they are written at arbitrary offsets and lengths (frame headers and pages are separate writes), so the store holds
+// the file as fixed size chunks keyed by their offset, and the file size in the metadata. SQLite only relies on the WAL
+// being durable once it syncs it and a crash mid-write is covered by the frame checksums, so writes are buffered in a
+// walBuffer shared by the database's walFiles and committed in a single transaction by Sync, or once walBufferChunks
+// chunks are buffered when SQLite doesn't sync (synchronous=OFF). Truncating and closing commit the buffer too.
+
+const walChunkSize = 64 * 1024
+
+// walBufferChunks is the most chunks buffered before they're committed without a sync
+const walBufferChunks = 64
+
+var walSizeMetaKey = "size"
+
+func isWALName(name string) bool {
+	name, _, _ = strings.Cut(name, "?")
+	return strings.HasSuffix(name, "-wal")
+}
+
+type walFile struct {
+	vfs    *VFS
+	name   string
+	store  PageStore
+	buffer *walBuffer
+	lock   sqlite3vfs.LockType
+}
+
+// walBuffer holds the chunks written to a WAL file since it was last committed, so every connection reads the frames
+// others wrote before they're durable
+type walBuffer struct {
+	mutex  sync.Mutex // guards the buffer and orders the writes to the store
+	chunks map[int64][]byte
+	size   int64 // size of the file while chunks are buffered
+}
+
+// walBuffer returns the write buffer of a WAL whose store is retained
+func (v *VFS) walBuffer(name string) *walBuffer {
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	ref := v.state.dbs[v.storePath(name)]
+	if ref.wal == nil {
+		ref.wal = &walBuffer{chunks: make(map[int64][]byte)}
+	}
+	return ref.wal
+}
+
+// chunk returns the chunk at off, nil if it was never written
+func (b *walBuffer) chunk(txn PageTxn, off int64) []byte {
+	if chunk, ok := b.chunks[off]; ok {
+		return chunk
+	}
+	return txn.Get(off)
+}
+
+func (b *walBuffer) fileSize(txn PageTxn) int64 {
+	if len(b.chunks) != 0 {
+		return b.size
+	}
+	return walSize(txn)
+}
+
+// flush writes the buffered chunks in txn, they're only dropped by reset once txn is committed
+func (b *walBuffer) flush(txn PageTxn) error {
+	if len(b.chunks) == 0 {
+		return nil
+	}
+	for off, chunk := range b.chunks {
+		if err := txn.Put(off, chunk); err != nil {
+			return err
+		}
+	}
+	return putWALSize(txn, b.size)
+}
+
+func (b *walBuffer) reset() {
+	clear(b.chunks)
+}
+
+func (v *VFS) openWAL(name string, flags sqlite3vfs.OpenFlag) (sqlite3vfs.File, sqlite3vfs.OpenFlag, error) {
+	store, _, err := v.retainStore(name, sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenCreate, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	f := &walFile{vfs: v, name: name, store: store, buffer: v.walBuffer(name)}
+	txn, err := store.Begin(true)
+	if err != nil {
+		f.release()
+		return nil, 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if txn.GetMeta(walSizeMetaKey) == nil {
+		if flags&sqlite3vfs.OpenCreate == 0 {
+			f.release()
+			return nil, 0, sqlite3vfs.CantOpenError
+		}
+		if err = putWALSize(txn, 0); err != nil {
+			f.release()
+			return nil, 0, err
+		}
+		if err = txn.Commit(); err != nil {
+			f.release()
+			return nil, 0, err
+		}
+	}
+	return f, flags, nil
+}
+
+// walExists reports whether the WAL file has been created and not deleted since
+func (v *VFS) walExists(name string) (bool, error) {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadWrite, false)
+	if errors.Is(err, ErrStoreNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer release()
+	txn, err := store.Begin(false)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = txn.Rollback() }()
+	return txn.GetMeta(walSizeMetaKey) != nil, nil
+}
+
+// deleteWAL discards the contents of the WAL file
+func (v *VFS) deleteWAL(name string) error {
+	store, release, err := v.retainStore(name, sqlite3vfs.OpenReadWrite, false)
+	if errors.Is(err, ErrStoreNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer release()
+	buffer := v.walBuffer(name)
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	txn, err := store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = txn.Rollback() }()
+	if err = truncateChunks(txn, 0); err != nil {
+		return err
+	}
+	if err = txn.DeleteMeta(walSizeMetaKey); err != nil {
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	buffer.reset()
+	return nil
+}
+
+func walSize(txn PageTxn) int64 {
+	buf := txn.GetMeta(walSizeMetaKey)
+	if len(buf) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+func putWALSize(txn PageTxn, size int64) error {
+	return txn.PutMeta(walSizeMetaKey, binary.BigEndian.AppendUint64(nil, uint64(size)))
+}
+
+// truncateChunks deletes every chunk past size and zeroes the end of the chunk holding it
+func truncateChunks(txn PageTxn, size int64) error {
+	var offsets []int64
+	err := txn.ForEach(func(off int64, chunk []byte) error {
+		if off+walChunkSize > size {
+			offsets = append(offsets, off)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, off := range offsets {
+		if off >= size {
+			err = txn.Delete(off)
+		} else {
+			chunk := make([]byte, walChunkSize)
+			copy(chunk[:size-off], txn.Get(off))
+			err = txn.Put(off, chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *walFile) release() {
+	f.vfs.releaseStore(f.name)
+}
+
+func (f *walFile) Close() error {
+	err := f.commit(nil)
+	f.release()
+	return err
+}
+
+// commit writes the buffered chunks to the store, then applies fn if set, in a single transaction
+func (f *walFile) commit(fn func(txn PageTxn) error) error {
+	f.buffer.mutex.Lock()
+	defer f.buffer.mutex.Unlock()
+	return f.commitLocked(fn)
+}
+
+func (f *walFile) commitLocked(fn func(txn PageTxn) error) error {
+	if len(f.buffer.chunks) == 0 && fn == nil {
+		return nil
+	}
+	txn, err := f.store.Begin(true)
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error starting WAL transaction")
+		return sqlite3vfs.IOError
+	}
+	defer func() { _ = txn.Rollback() }()
+	err = f.buffer.flush(txn)
+	if err == nil && fn != nil {
+		err = fn(txn)
+	}
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error committing WAL")
+		return sqlite3vfs.IOError
+	}
+	f.buffer.reset()
+	return nil
+}
+
+func (f *walFile) ReadAt(p []byte, off int64) (int, error) {
+	f.buffer.mutex.Lock()
+	defer f.buffer.mutex.Unlock()
+	txn, err := f.store.Begin(false)
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error starting WAL transaction")
+		return 0, sqlite3vfs.IOError
+	}
+	defer func() { _ = txn.Rollback() }()
+
+	size := f.buffer.fileSize(txn)
+	n := 0
+	for n < len(p) && off+int64(n) < size {
+		pos := off + int64(n)
+		chunkOff := pos - pos%walChunkSize
+		end := min(int64(len(p)-n), size-pos, chunkOff+walChunkSize-pos)
+		chunk := f.buffer.chunk(txn, chunkOff)
+		if chunk == nil {
+			clear(p[n : n+int(end)]) // never written, reads as zeros like a sparse file
+		} else {
+			copy(p[n:n+int(end)], chunk[pos-chunkOff:])
+		}
+		n += int(end)
+	}
+	clear(p[n:]) // SQLite expects short reads to be zero filled
+	return n, nil
+}
+
+func (f *walFile) WriteAt(p []byte, off int64) (int, error) {
+	f.buffer.mutex.Lock()
+	defer f.buffer.mutex.Unlock()
+	txn, err := f.store.Begin(false)
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error starting WAL transaction")
+		return 0, sqlite3vfs.IOError
+	}
+	size := f.buffer.fileSize(txn)
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		chunkOff := pos - pos%walChunkSize
+		chunk, ok := f.buffer.chunks[chunkOff]
+		if !ok {
+			chunk = make([]byte, walChunkSize)
+			copy(chunk, txn.Get(chunkOff))
+			f.buffer.chunks[chunkOff] = chunk
+		}
+		n += copy(chunk[pos-chunkOff:], p[n:])
+	}
+	_ = txn.Rollback()
+	f.buffer.size = max(size, off+int64(len(p)))
+
+	if len(f.buffer.chunks) >= walBufferChunks {
+		if err = f.commitLocked(nil); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *walFile) Truncate(size int64) error {
+	return f.commit(func(txn PageTxn) error {
+		if size < walSize(txn) {
+			if err := truncateChunks(txn, size); err != nil {
+				return err
+			}
+		}
+		return putWALSize(txn, size)
+	})
+}
+
+func (f *walFile) Sync(flag sqlite3vfs.SyncType) error {
+	return f.commit(nil)
+}
+
+func (f *walFile) FileSize() (int64, error) {
+	f.buffer.mutex.Lock()
+	defer f.buffer.mutex.Unlock()
+	txn, err := f.store.Begin(false)
+	if err != nil {
+		f.vfs.logger.Error().Err(err).Msg("error starting WAL transaction")
+		return 0, sqlite3vfs.IOError
+	}
+	defer func() { _ = txn.Rollback() }()
+	return f.buffer.fileSize(txn), nil
+}
+
+// SQLite doesn't lock WAL files, access is coordinated through the WAL index
+func (f *walFile) Lock(elock sqlite3vfs.LockType) error {
+	f.lock = elock
+	return nil
+}
+
+func (f *walFile) Unlock(elock sqlite3vfs.LockType) error {
+	f.lock = elock
+	return nil
+}
+
+func (f *walFile) CheckReservedLock() (bool, error) {
+	return f.lock > sqlite3vfs.LockShared, nil
+}
+
+func (f *walFile) SectorSize() int64 {
+	return SectorSize
+}
+
+func (f *walFile) DeviceCharacteristics() sqlite3vfs.DeviceCharacteristic {
+	return 0
+}
+
+func (f *walFile) ConfirmCommit() error {
+	return nil
+}